@@ -31,7 +31,7 @@ const sendMessage = async <T>(socket: WebSocket, incoming: Message) => {
 const client = new WebSocket("ws://localhost:1985/");
 
 type TSDBRecord = {
-    ts: number;
+    ts: number | string; // a string when the query asks for rfc3339
     data: string;
 };
 
@@ -43,7 +43,7 @@ type TSDBRequest = {
 };
 
 type TSDBInsertMessageRequest = {
-    ts: number;
+    ts?: number | "now"; // the time of the server when omitted or "now"
     uid: string;
     data: string;
     collection: string;
@@ -51,11 +51,18 @@ type TSDBInsertMessageRequest = {
 
 type TSDBInsertMessageResponse = {
     id: string;
+    results: {
+        status: "accepted" | "overwrote" | "merged" | "ignored" | "rejected";
+        error?: string;
+        ts?: number; // the timestamp stored when the server stamped or clamped it
+        clamped?: boolean;
+    }[];
 };
 
 type TSDBQueryMessageRequest = {
     ts: number;
     collection: string;
+    timeFormat?: "unix" | "rfc3339"; // rfc3339 returns the timestamps of the records as strings
 };
 
 type TSDBQueryMessageResponse = {
@@ -68,6 +75,7 @@ type TSDBQueryUserMessage = {
     from: number;
     to: number;
     collection: string;
+    timeFormat?: "unix" | "rfc3339";
 };
 
 type TSDBQueryUserMessageResponse = {
@@ -77,14 +85,24 @@ type TSDBQueryUserMessageResponse = {
 
 const secretKey = process.env.SECRET_KEY;
 const randomId = () => Math.random().toString(36).substring(2, 15);
-const insert = async (data: TSDBInsertMessageRequest[]) => {
-    const res = await sendMessage<TSDBInsertMessageResponse>(client, {
-        id: randomId(),
-        secretKey,
-        type: "insert",
-        data: JSON.stringify(data),
-    });
-    return res;
+// retries send the same write id, so a batch that was inserted before the
+// timeout isn't inserted again
+const insert = async (records: TSDBInsertMessageRequest[], attempts = 3) => {
+    const writeId = randomId();
+    for (let attempt = 1; ; attempt++) {
+        try {
+            return await sendMessage<TSDBInsertMessageResponse>(client, {
+                id: randomId(),
+                secretKey,
+                type: "insert",
+                data: JSON.stringify({ records, writeId }),
+            });
+        } catch (err) {
+            if (err !== "Timeout" || attempt === attempts) {
+                throw err;
+            }
+        }
+    }
 };
 const query = async (collection: string, ts: number) => {
     const res = await sendMessage<TSDBQueryMessageResponse>(client, {
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"path"
+	"slices"
+)
+
+// statuses of the records of an insert
+const (
+	insertAccepted  = "accepted"
+	insertOverwrote = "overwrote" // a record with the same timestamp was replaced
+	insertMerged    = "merged"    // the payload was merged into the record with the same timestamp
+	insertIgnored   = "ignored"   // the record with the same timestamp was kept
+	insertRejected  = "rejected"
+)
+
+// insertItem is a record of an insert whose collection is open
+type insertItem struct {
+	db      *Database
+	uid     string
+	ts      int64
+	data    string
+	stamped bool // ts is the time of the server
+}
+
+// parseInsertRequest reads an insert message, either a list of records or an
+// object with the records and the options of the insert
+func parseInsertRequest(message []byte) (insertRequest, error) {
+	var request insertRequest
+	if trimmed := bytes.TrimSpace(message); len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(message, &request.Records)
+		return request, err
+	}
+	err := json.Unmarshal(message, &request)
+	return request, err
+}
+
+// resolveInsert checks the fields of a record and opens its collection
+func resolveInsert(reg *registry, msg dataPayload) (insertItem, error) {
+	// all these are required!
+	if msg.Uid == nil || msg.Collection == nil {
+		return insertItem{}, errors.New("uid and collection are required")
+	}
+	data, err := payloadText(msg.Data)
+	if err != nil {
+		return insertItem{}, err
+	}
+	// the collection is opened when it matches a pattern
+	db, err := reg.getOrOpen(*msg.Collection)
+	if err != nil {
+		return insertItem{}, err
+	}
+	item := insertItem{db: db, uid: *msg.Uid, data: data}
+	if msg.Ts == nil || msg.Ts.now {
+		item.ts, item.stamped = db.now(), true
+	} else {
+		item.ts = msg.Ts.value
+	}
+	return item, nil
+}
+
+// insertRecords inserts the records of a request. A request sent again with
+// the write id of an earlier one gets its results, and so does a record.
+// Write ids are only remembered once something was inserted, a request whose
+// records were all rejected can be sent again.
+func insertRecords(reg *registry, ids *writeIds, request insertRequest) []insertResult {
+	key := ""
+	if request.WriteId != "" {
+		key = "batch:" + request.WriteId
+		if results, ok := ids.begin(key); ok {
+			return results
+		}
+	}
+	var results []insertResult
+	if request.Atomic {
+		results = insertAtomic(reg, ids, request.Records)
+	} else {
+		results = insertBatch(reg, ids, request.Records)
+	}
+	if key != "" {
+		ids.finish(key, rememberedResults(results))
+	}
+	return results
+}
+
+// insertBatch inserts the records one by one, a rejected record doesn't stop
+// the others
+func insertBatch(reg *registry, ids *writeIds, records []dataPayload) []insertResult {
+	results := make([]insertResult, len(records))
+	for i, msg := range records {
+		key := ""
+		if msg.WriteId != "" {
+			key = "record:" + msg.WriteId
+			if remembered, ok := ids.begin(key); ok {
+				results[i] = remembered[0]
+				continue
+			}
+		}
+		item, err := resolveInsert(reg, msg)
+		if err == nil {
+			var outcome insertOutcome
+			outcome, err = item.db.insertRecord(item.uid, item.ts, item.data)
+			results[i] = insertedResult(item, outcome)
+		}
+		if err != nil {
+			results[i] = insertResult{Status: insertRejected, Error: err.Error()}
+		}
+		if key != "" {
+			ids.finish(key, rememberedResults([]insertResult{results[i]}))
+		}
+	}
+	return results
+}
+
+// insertAtomic inserts all the records, across collections, or none of them.
+// The records inserted before one is rejected are removed again, concurrent
+// queries may see them in between. Rollups are only updated once every
+// record is inserted. Records whose write id is remembered are skipped and
+// get their earlier result.
+func insertAtomic(reg *registry, ids *writeIds, records []dataPayload) []insertResult {
+	items := make([]insertItem, len(records))
+	for i, msg := range records {
+		item, err := resolveInsert(reg, msg)
+		if err != nil {
+			return abortedResults(len(records), i, err, nil)
+		}
+		items[i] = item
+	}
+
+	// write ids are reserved in order, so concurrent batches sharing some
+	// can't wait for each other
+	keys := make(map[string]int)
+	if ids != nil {
+		for i, msg := range records {
+			if msg.WriteId == "" {
+				continue
+			}
+			key := "record:" + msg.WriteId
+			if _, ok := keys[key]; ok {
+				return abortedResults(len(records), i, fmt.Errorf("write id %q is used twice", msg.WriteId), nil)
+			}
+			keys[key] = i
+		}
+	}
+	sorted := slices.Sorted(maps.Keys(keys))
+	results := make([]insertResult, len(records))
+	previous := make([]insertResult, len(records))
+	remembered := make([]bool, len(records))
+	var reserved []string
+	for _, key := range sorted {
+		if earlier, ok := ids.begin(key); ok {
+			i := keys[key]
+			results[i], previous[i], remembered[i] = earlier[0], earlier[0], true
+			continue
+		}
+		reserved = append(reserved, key)
+	}
+
+	outcomes := make([]insertOutcome, len(records))
+	for i, item := range items {
+		if remembered[i] {
+			continue
+		}
+		var err error
+		if outcomes[i], err = item.db.insertChecked(item.uid, item.ts, item.data); err != nil {
+			undoInserts(items[:i], outcomes[:i], remembered[:i])
+			for _, key := range reserved {
+				ids.finish(key, nil)
+			}
+			return abortedResults(len(records), i, err, previous)
+		}
+		results[i] = insertedResult(item, outcomes[i])
+	}
+	for i, item := range items {
+		if !remembered[i] {
+			item.db.updateRollups(item.uid, outcomes[i])
+		}
+	}
+	for _, key := range reserved {
+		ids.finish(key, []insertResult{results[keys[key]]})
+	}
+	return results
+}
+
+// rememberedResults returns the results to remember for a write id, nil when
+// nothing was inserted
+func rememberedResults(results []insertResult) []insertResult {
+	for _, result := range results {
+		if result.Status != insertRejected {
+			return results
+		}
+	}
+	return nil
+}
+
+// insertedResult returns the result of an inserted record, with the
+// timestamp stored when the server stamped or clamped it
+func insertedResult(item insertItem, outcome insertOutcome) insertResult {
+	result := insertResult{Status: outcome.status, Clamped: outcome.clamped}
+	if item.stamped || outcome.clamped {
+		ts := outcome.record.Timestamp
+		result.Ts = &ts
+	}
+	return result
+}
+
+// abortedResults rejects every record of an atomic insert because of the
+// record that failed, except the ones whose earlier result is remembered
+func abortedResults(n int, failed int, err error, remembered []insertResult) []insertResult {
+	results := make([]insertResult, n)
+	for i := range results {
+		if remembered != nil && remembered[i].Status != "" {
+			results[i] = remembered[i]
+			continue
+		}
+		results[i] = insertResult{Status: insertRejected, Error: fmt.Sprintf("not inserted, record %d of the atomic batch was rejected", failed)}
+	}
+	results[failed].Error = err.Error()
+	return results
+}
+
+// recordGen identifies a record by its database and the generation of its write
+type recordGen struct {
+	db  *Database
+	gen uint64
+}
+
+// undoInserts reverts the inserts of an atomic batch, backwards so a
+// timestamp inserted twice gets its first record back. A record of the batch
+// put back gets a new generation, the undo of its own insert looks for it.
+func undoInserts(items []insertItem, outcomes []insertOutcome, remembered []bool) {
+	putBack := make(map[recordGen]uint64)
+	for j := len(items) - 1; j >= 0; j-- {
+		if remembered[j] {
+			continue
+		}
+		outcome := outcomes[j]
+		if gen, ok := putBack[recordGen{items[j].db, outcome.record.gen}]; ok {
+			outcome.record.gen = gen
+		}
+		if gen := items[j].db.undoInsert(items[j].uid, outcome); gen != 0 {
+			putBack[recordGen{items[j].db, outcome.replaced.gen}] = gen
+		}
+	}
+}
+
+// undoInsert reverts an insert, putting back the record it replaced or
+// removing the one it added. The stored record is only undone while it's the
+// one of the insert, a record written meanwhile by another insert is kept.
+// It returns the generation of the record put back, 0 if there is none.
+func (db *Database) undoInsert(uid string, outcome insertOutcome) uint64 {
+	if outcome.status == insertIgnored {
+		return 0
+	}
+	db.metrics.inserted.Add(-1)
+	if db.dropped.Load() {
+		return 0
+	}
+	if outcome.replaced == nil {
+		if err := db.removeRecord(uid, outcome.record); err != nil {
+			log.Printf("Error undoing insert into %s for uid %s: %v", db.name, uid, err)
+		}
+		return 0
+	}
+	sh := db.shardFor(uid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	s := sh.get(uid)
+	if s == nil {
+		return 0
+	}
+	if current := s.at(outcome.record.Timestamp); current == nil || current.gen != outcome.record.gen {
+		return 0
+	}
+	// a new generation, so Flush writes it over the undone record
+	record := *outcome.replaced
+	record.gen = db.gen.Add(1)
+	if _, err := db.insert(sh, uid, record, false, false); err != nil {
+		log.Printf("Error undoing insert into %s for uid %s: %v", db.name, uid, err)
+		return 0
+	}
+	return record.gen
+}
+
+// removeRecord removes the record written by an insert, found by its
+// generation among the records with its timestamp. When it was flushed
+// meanwhile, it's removed from the flushed files too, where it's told apart
+// from the records with the same payload by its position.
+func (db *Database) removeRecord(uid string, record Record) error {
+	// hold the flush lock so a concurrent flush can't write the record back
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	sh := db.shardFor(uid)
+	sh.mu.Lock()
+	s := sh.get(uid)
+	if s == nil {
+		sh.mu.Unlock()
+		return nil
+	}
+	payload := record.payload()
+	position := 0
+	for _, other := range s.rangeRecords(record.Timestamp, record.Timestamp) {
+		if other.gen == record.gen {
+			break
+		}
+		if other.payload() == payload {
+			position++
+		}
+	}
+	before := s.bytes
+	found, err := s.removeGen(record.Timestamp, record.gen)
+	db.trackMemory(s.bytes - before)
+	if found {
+		db.recordCount.Add(-1)
+		if s.len() == 0 {
+			db.removeSeries(sh, uid, s)
+		}
+		sh.shrink(record.Timestamp, record.Timestamp)
+	}
+	sh.mu.Unlock()
+	if err != nil || !found || db.storageDir == "" || db.flushedGen[uid] < record.gen {
+		return err
+	}
+
+	delta, err := rewriteUserFiles(path.Join(db.storageDir, db.name, uid), func(stored Record) bool {
+		if stored.Timestamp != record.Timestamp || stored.payload() != payload {
+			return true
+		}
+		position--
+		return position != -1
+	})
+	sh.mu.Lock()
+	if s := sh.get(uid); s != nil {
+		s.bytesOnDisk += delta
+		db.bytesOnDisk.Add(delta)
+		db.manifest.Index[uid] = s.indexEntry()
+	} else {
+		delete(db.manifest.Index, uid)
+	}
+	sh.mu.Unlock()
+	if err := db.manifest.write(path.Join(db.storageDir, db.name)); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInsertRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		records int
+		atomic  bool
+		wantErr bool
+	}{
+		{"list", `[{"ts":1,"uid":"1","data":"a","collection":"c"}]`, 1, false, false},
+		{"list with spaces", ` [ ]`, 0, false, false},
+		{"object", `{"records":[{"ts":1,"uid":"1","data":"a","collection":"c"}],"atomic":true}`, 1, true, false},
+		{"invalid", `{"records":1}`, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseInsertRequest([]byte(tt.message))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (len(request.Records) != tt.records || request.Atomic != tt.atomic) {
+				t.Errorf("Expected %d records and atomic %v, got %+v", tt.records, tt.atomic, request)
+			}
+		})
+	}
+}
+
+// insertPayloads returns the records of an insert message
+func insertPayloads(t *testing.T, message string) []dataPayload {
+	t.Helper()
+	var records []dataPayload
+	if err := json.Unmarshal([]byte(message), &records); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func resultStatuses(results []insertResult) string {
+	statuses := make([]string, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	return strings.Join(statuses, ",")
+}
+
+func TestInsertBatch(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "events", TTL: 1, JSONSchema: []byte(`{"required":["kind"]}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := insertBatch(reg, nil, insertPayloads(t, `[
+		{"ts":1,"uid":"1","data":{"kind":"start"},"collection":"events"},
+		{"ts":1,"uid":"1","data":{"kind":"restart"},"collection":"events"},
+		{"ts":2,"uid":"1","data":{"type":"stop"},"collection":"events"},
+		{"ts":3,"uid":"1","data":{"kind":"stop"},"collection":"other"},
+		{"ts":3,"data":{"kind":"stop"},"collection":"events"},
+		{"ts":4,"uid":"1","data":{"kind":"stop"},"collection":"events"}
+	]`))
+	if statuses := resultStatuses(results); statuses != "accepted,overwrote,rejected,rejected,rejected,accepted" {
+		t.Fatalf("Expected the records to be inserted one by one, got %s", statuses)
+	}
+	if !strings.Contains(results[2].Error, `missing required property "kind"`) {
+		t.Errorf("Expected the reason of the rejection, got %q", results[2].Error)
+	}
+	if results[0].Error != "" || results[4].Error == "" {
+		t.Errorf("Expected errors only for rejected records, got %+v", results)
+	}
+	db := reg.get("events")
+	records := db.GetRecordsForUser("1", 0, 10)
+	if len(records) != 2 || records[0].Data != `{"kind":"restart"}` || records[1].Timestamp != 4 {
+		t.Errorf("Expected the overwritten record and the last one, got %+v", records)
+	}
+}
+
+func TestInsertAtomic(t *testing.T) {
+	collections := []Collection{
+		{Name: "metrics", TTL: 1, Rollups: []Rollup{{Resolution: 60, TTL: 1}}},
+		{Name: "devices", TTL: 1, MaxUids: 1},
+	}
+	reg, err := newRegistry(storageOptions{}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := reg.getOrOpen("metrics")
+	devices, _ := reg.getOrOpen("devices")
+	if err := metrics.Insert("1", 5, `{"v":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.Insert("a", 1, "on"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last record goes over the uid limit of devices once the others are inserted
+	results := insertAtomic(reg, nil, insertPayloads(t, `[
+		{"ts":1,"uid":"1","data":{"v":2},"collection":"metrics"},
+		{"ts":5,"uid":"1","data":{"v":3},"collection":"metrics"},
+		{"ts":5,"uid":"1","data":{"v":4},"collection":"metrics"},
+		{"ts":2,"uid":"a","data":"off","collection":"devices"},
+		{"ts":1,"uid":"b","data":"on","collection":"devices"}
+	]`))
+	if statuses := resultStatuses(results); statuses != "rejected,rejected,rejected,rejected,rejected" {
+		t.Fatalf("Expected every record to be rejected, got %s", statuses)
+	}
+	if !strings.Contains(results[4].Error, "limit") || !strings.Contains(results[0].Error, "record 4") {
+		t.Errorf("Expected the failing record to be named, got %+v", results)
+	}
+	if records := metrics.GetRecordsForUser("1", 0, 10); len(records) != 1 || records[0].Data != `{"v":1}` {
+		t.Errorf("Expected the records of metrics to be restored, got %+v", records)
+	}
+	if records := devices.GetRecordsForUser("a", 0, 10); len(records) != 1 {
+		t.Errorf("Expected the records of devices to be removed, got %+v", records)
+	}
+	if inserted := metrics.metrics.inserted.Load(); inserted != 1 {
+		t.Errorf("Expected 1 insert to be counted, got %d", inserted)
+	}
+	if summary, _ := metrics.GetRollupRecords("1", 0, 10, 60); len(summary) != 1 || !strings.Contains(summary[0].Data, `"count":1`) {
+		t.Errorf("Expected the rollups not to count the batch, got %+v", summary)
+	}
+
+	results = insertAtomic(reg, nil, insertPayloads(t, `[
+		{"ts":1,"uid":"1","data":{"v":2},"collection":"metrics"},
+		{"ts":5,"uid":"1","data":{"v":3},"collection":"metrics"},
+		{"ts":2,"uid":"a","data":"off","collection":"devices"}
+	]`))
+	if statuses := resultStatuses(results); statuses != "accepted,overwrote,accepted" {
+		t.Errorf("Expected the batch to be inserted, got %s", statuses)
+	}
+	// the overwritten record isn't counted anymore
+	if summary, _ := metrics.GetRollupRecords("1", 0, 10, 60); len(summary) != 1 || !strings.Contains(summary[0].Data, `"count":2`) {
+		t.Errorf("Expected the rollups to count the batch, got %+v", summary)
+	}
+
+	results = insertAtomic(reg, nil, insertPayloads(t, `[
+		{"ts":6,"uid":"1","data":{"v":2},"collection":"metrics"},
+		{"ts":6,"uid":"1","collection":"metrics"}
+	]`))
+	if statuses := resultStatuses(results); statuses != "rejected,rejected" {
+		t.Errorf("Expected an invalid record to reject the batch, got %s", statuses)
+	}
+	if records := metrics.GetRecordsForUser("1", 6, 6); len(records) != 0 {
+		t.Errorf("Expected nothing to be inserted, got %+v", records)
+	}
+}
+
+func TestUndoKeepsConcurrentWrites(t *testing.T) {
+	for _, conflict := range []string{conflictLast, conflictMerge} {
+		t.Run(conflict, func(t *testing.T) {
+			db := conflictDatabase(t, t.TempDir(), conflict)
+			// a record added by the batch and overwritten by another client
+			added, err := db.insertChecked("1", 1, `{"a":1}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Insert("1", 1, `{"b":2}`)
+			db.undoInsert("1", added)
+			if latest := db.GetLatestRecordForUser("1", 1); latest == nil || !strings.Contains(latest.Data, `"b":2`) {
+				t.Errorf("Expected the record of the other client to be kept, got %+v", latest)
+			}
+
+			// a record replaced by the batch and overwritten by another client
+			db.Insert("1", 2, `{"c":3}`)
+			replaced, err := db.insertChecked("1", 2, `{"d":4}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Insert("1", 2, `{"e":5}`)
+			db.undoInsert("1", replaced)
+			if latest := db.GetLatestRecordForUser("1", 2); latest == nil || !strings.Contains(latest.Data, `"e":5`) {
+				t.Errorf("Expected the record of the other client to be kept, got %+v", latest)
+			}
+
+			// the record of the batch itself is undone
+			undone, err := db.insertChecked("1", 2, `{"f":6}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.undoInsert("1", undone)
+			if latest := db.GetLatestRecordForUser("1", 2); latest == nil || strings.Contains(latest.Data, `"f":6`) || !strings.Contains(latest.Data, `"e":5`) {
+				t.Errorf("Expected the replaced record back, got %+v", latest)
+			}
+		})
+	}
+}
+
+func TestInsertWriteIds(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "events", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := newWriteIds(time.Minute, 100)
+	request := insertRequest{WriteId: "batch-1", Records: insertPayloads(t, `[
+		{"ts":1,"uid":"1","data":"a","collection":"events"},
+		{"ts":2,"uid":"1","collection":"events"}
+	]`)}
+	first := insertRecords(reg, ids, request)
+	if statuses := resultStatuses(first); statuses != "accepted,rejected" {
+		t.Fatalf("Expected the batch to be inserted, got %s", statuses)
+	}
+	// the retry would overwrite the first record
+	if retry := insertRecords(reg, ids, request); resultStatuses(retry) != "accepted,rejected" || retry[1].Error != first[1].Error {
+		t.Errorf("Expected the first results, got %+v", retry)
+	}
+	db := reg.get("events")
+	if inserted := db.metrics.inserted.Load(); inserted != 1 {
+		t.Errorf("Expected the retry not to insert, got %d inserts", inserted)
+	}
+
+	// write ids of records, atomic or not
+	records := insertPayloads(t, `[
+		{"ts":3,"uid":"1","data":"b","collection":"events","writeId":"r1"},
+		{"ts":3,"uid":"1","data":"c","collection":"events","writeId":"r2"}
+	]`)
+	if statuses := resultStatuses(insertRecords(reg, ids, insertRequest{Records: records[:1]})); statuses != "accepted" {
+		t.Fatalf("Expected the record to be inserted, got %s", statuses)
+	}
+	if statuses := resultStatuses(insertRecords(reg, ids, insertRequest{Records: records, Atomic: true})); statuses != "accepted,overwrote" {
+		t.Errorf("Expected the first result of r1, got %s", statuses)
+	}
+	if statuses := resultStatuses(insertRecords(reg, ids, insertRequest{Records: records})); statuses != "accepted,overwrote" {
+		t.Errorf("Expected the first results of r1 and r2, got %s", statuses)
+	}
+	if records := db.GetRecordsForUser("1", 3, 3); len(records) != 1 || records[0].Data != "c" {
+		t.Errorf("Expected r1 not to be inserted again, got %+v", records)
+	}
+
+	// write ids of rejected inserts aren't remembered
+	rejected := insertPayloads(t, `[
+		{"ts":4,"uid":"1","data":"d","collection":"events","writeId":"r3"},
+		{"ts":4,"uid":"1","data":"e","collection":"other"}
+	]`)
+	if statuses := resultStatuses(insertRecords(reg, ids, insertRequest{Records: rejected, Atomic: true})); statuses != "rejected,rejected" {
+		t.Fatalf("Expected the batch to be rejected, got %s", statuses)
+	}
+	if statuses := resultStatuses(insertRecords(reg, ids, insertRequest{Records: rejected[:1]})); statuses != "accepted" {
+		t.Errorf("Expected r3 to be inserted once the batch was fixed, got %s", statuses)
+	}
+
+	duplicated := insertPayloads(t, `[
+		{"ts":5,"uid":"1","data":"f","collection":"events","writeId":"r4"},
+		{"ts":6,"uid":"1","data":"g","collection":"events","writeId":"r4"}
+	]`)
+	if results := insertRecords(reg, ids, insertRequest{Records: duplicated, Atomic: true}); !strings.Contains(results[1].Error, "used twice") {
+		t.Errorf("Expected a write id used twice to be rejected, got %+v", results)
+	}
+}
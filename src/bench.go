@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchOptions describe the workload of runBench
+type benchOptions struct {
+	uids        int
+	records     int // records per uid
+	payloadSize int // bytes of data per record
+	concurrency int
+	storageDir  string // flushes to a temporary collection when set
+}
+
+// runBench measures inserts and queries on a database of its own and
+// writes the throughput of every phase to w
+func runBench(opts benchOptions, w io.Writer) error {
+	storageDir := ""
+	if opts.storageDir != "" {
+		dir, err := os.MkdirTemp(opts.storageDir, "bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		storageDir = dir
+	}
+	db := NewDatabase("bench", storageDir, 0)
+	defer db.Stop()
+
+	uids := make([]string, opts.uids)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("uid-%d", i)
+	}
+	payload := fmt.Sprintf(`{"value":"%s"}`, strings.Repeat("x", max(0, opts.payloadSize-12)))
+	total := opts.uids * opts.records
+
+	report := func(phase string, operations int, elapsed time.Duration) {
+		fmt.Fprintf(w, "%-8s %10d ops in %10s %12.0f ops/s\n", phase, operations, elapsed.Round(time.Millisecond), float64(operations)/elapsed.Seconds())
+	}
+
+	elapsed, err := benchUids(uids, opts.concurrency, func(uid string) error {
+		for ts := range opts.records {
+			if err := db.Insert(uid, int64(ts), payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report("insert", total, elapsed)
+
+	if storageDir != "" {
+		start := time.Now()
+		if err := db.Flush(); err != nil {
+			return err
+		}
+		report("flush", total, time.Since(start))
+	}
+
+	elapsed, _ = benchUids(uids, opts.concurrency, func(uid string) error {
+		db.GetRecordsForUser(uid, math.MinInt64, math.MaxInt64)
+		return nil
+	})
+	report("range", opts.uids, elapsed)
+
+	elapsed, _ = benchUids(uids, opts.concurrency, func(uid string) error {
+		for ts := range opts.records {
+			db.GetLatestRecordForUser(uid, int64(ts))
+		}
+		return nil
+	})
+	report("latest", total, elapsed)
+	return nil
+}
+
+// benchUids calls fn for every uid from concurrency goroutines and returns
+// the time it took
+func benchUids(uids []string, concurrency int, fn func(uid string) error) (time.Duration, error) {
+	start := time.Now()
+	jobs := make(chan string)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for range max(1, concurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := range jobs {
+				if err := fn(uid); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	for _, uid := range uids {
+		jobs <- uid
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return 0, err
+	default:
+		return time.Since(start), nil
+	}
+}
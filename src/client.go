@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// client talks to a running server over the websocket API, it's used by the
+// commands that work against a server instead of a storage directory
+type client struct {
+	conn   *websocket.Conn
+	nextId int
+}
+
+// dialServer connects to the server at url and authenticates with the secret key
+func dialServer(url string, secretKey string) (*client, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", url, err)
+	}
+	c := &client{conn: conn}
+	if _, err := c.send("api-key", secretKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// call sends a message with data encoded as JSON and returns the response
+func (c *client) call(messageType string, data any) ([]byte, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(messageType, string(payload))
+}
+
+func (c *client) send(messageType string, data string) ([]byte, error) {
+	c.nextId++
+	id := strconv.Itoa(c.nextId)
+	message, err := json.Marshal(request{Id: &id, MessageType: &messageType, Data: &data})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		return nil, err
+	}
+	_, response, err := c.conn.ReadMessage()
+	if err != nil {
+		// the server closes the connection when a message fails
+		return nil, errors.New("the server closed the connection, check its log for the error")
+	}
+	return response, nil
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
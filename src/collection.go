@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Collection is a configured collection pattern with the ttl and limits of
+// the collections it matches. Patterns are dot separated segments:
+//
+//	users      matches users only
+//	users.*    matches users.a but not users or users.a.b
+//	users.**   matches users, users.a and users.a.b
+//	logs.app-* matches logs.app-web but not logs.db
+//
+// A * within a segment matches any characters of that segment, a ** segment
+// matches any number of segments, none included.
+type Collection struct {
+	Name string `json:"pattern"`
+	TTL  int    `json:"ttl"`
+	// limits of every collection matching the pattern, 0 for no limit
+	MaxUids          int `json:"maxUids,omitempty"`
+	MaxRecordsPerUid int `json:"maxRecordsPerUid,omitempty"`
+	// downsampling tiers of every collection matching the pattern
+	Rollups []Rollup `json:"rollups,omitempty"`
+	// type of the payloads, opaque strings when empty, see typed.go
+	Type   string            `json:"type,omitempty"`
+	Schema map[string]string `json:"schema,omitempty"` // field types of the object type
+	// JSON schema the payloads are validated against, see schema.go
+	JSONSchema json.RawMessage `json:"jsonSchema,omitempty"`
+	// what an insert does with a record of the same timestamp, see conflict.go
+	Conflict string `json:"conflict,omitempty"`
+	// how far from the time of the server timestamps can be, in seconds, 0
+	// for no limit, and what records beyond the limits get, see timestamps.go
+	MaxPast   int64  `json:"maxPast,omitempty"`
+	MaxFuture int64  `json:"maxFuture,omitempty"`
+	Skew      string `json:"skew,omitempty"`
+	// time unit of the timestamps, seconds when empty, see units.go
+	Unit string `json:"unit,omitempty"`
+}
+
+var (
+	ErrCollectionLimit   = errors.New("collection limit reached")
+	ErrCollectionDropped = errors.New("collection was dropped")
+)
+
+// NewCollection parses a collection flag of the form pattern:ttl
+func NewCollection(spec string) (Collection, error) {
+	pattern, ttlText, ok := strings.Cut(spec, ":")
+	if !ok {
+		return Collection{}, fmt.Errorf("invalid collection %q: expected pattern:ttl", spec)
+	}
+	if strings.Contains(ttlText, ":") {
+		return Collection{}, fmt.Errorf("invalid collection %q: expected a single colon between pattern and ttl", spec)
+	}
+	if err := validatePattern(pattern); err != nil {
+		return Collection{}, fmt.Errorf("invalid collection %q: %w", spec, err)
+	}
+	ttl, err := strconv.Atoi(ttlText)
+	if err != nil || ttl < 0 {
+		return Collection{}, fmt.Errorf("invalid collection %q: ttl %q must be a non-negative integer", spec, ttlText)
+	}
+	return Collection{Name: pattern, TTL: ttl}, nil
+}
+
+// validate checks a collection configured at runtime
+func (c Collection) validate() error {
+	if err := validatePattern(c.Name); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", c.Name, err)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("invalid ttl %d: must be a non-negative integer", c.TTL)
+	}
+	if c.MaxUids < 0 || c.MaxRecordsPerUid < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if err := validateType(c.Type, c.Schema); err != nil {
+		return err
+	}
+	if len(c.JSONSchema) > 0 {
+		if _, err := compileSchema(c.JSONSchema); err != nil {
+			return err
+		}
+	}
+	if err := validateConflict(c.Conflict); err != nil {
+		return err
+	}
+	if c.MaxPast < 0 || c.MaxFuture < 0 {
+		return errors.New("time limits can't be negative")
+	}
+	if err := validateSkew(c.Skew); err != nil {
+		return err
+	}
+	if err := validateUnit(c.Unit); err != nil {
+		return err
+	}
+	return validateRollups(c.Rollups)
+}
+
+// parseCollections parses the collection flags, a pattern can't be configured twice
+func parseCollections(specs []string) ([]Collection, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no collection is configured")
+	}
+	collections := make([]Collection, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		collection, err := NewCollection(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[collection.Name] {
+			return nil, fmt.Errorf("collection pattern %q is configured twice", collection.Name)
+		}
+		seen[collection.Name] = true
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+// validatePattern checks the segments of a pattern, wildcards aside they
+// follow the rules of collection names
+func validatePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("pattern is empty")
+	}
+	for _, segment := range strings.Split(pattern, ".") {
+		if segment == "**" {
+			continue
+		}
+		if strings.Contains(segment, "**") {
+			return fmt.Errorf("** must be a whole segment, got %q", segment)
+		}
+		if err := validateSegment(strings.ReplaceAll(segment, "*", "x")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCollectionName checks a collection name is a valid directory name
+// that patterns can match
+func validateCollectionName(name string) error {
+	if name == "" {
+		return errors.New("collection name is empty")
+	}
+	for _, segment := range strings.Split(name, ".") {
+		if err := validateSegment(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateSegment(segment string) error {
+	if segment == "" {
+		return errors.New("empty segment, names can't start or end with a dot or have two dots in a row")
+	}
+	if i := strings.IndexAny(segment, `/\:*`); i >= 0 {
+		return fmt.Errorf("invalid character %q in segment %q", segment[i], segment)
+	}
+	return nil
+}
+
+// IsCollection returns whether the pattern matches the collection name
+func (c Collection) IsCollection(other string) bool {
+	if validateCollectionName(other) != nil {
+		return false
+	}
+	return matchSegments(strings.Split(c.Name, "."), strings.Split(other, "."))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 || !matchSegment(pattern[0], name[0]) {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// matchSegment matches a segment against a pattern segment where * matches
+// any characters
+func matchSegment(pattern string, segment string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == segment
+	}
+	if !strings.HasPrefix(segment, parts[0]) {
+		return false
+	}
+	segment = segment[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(segment, part)
+		if i < 0 {
+			return false
+		}
+		segment = segment[i+len(part):]
+	}
+	return len(segment) >= len(last) && strings.HasSuffix(segment, last)
+}
+
+// specificity ranks the patterns matching the same name. Patterns with more
+// literal segments win, then the ones with fewer ** and * segments.
+func (c Collection) specificity() [3]int {
+	var literal, doubleStars, stars int
+	for _, segment := range strings.Split(c.Name, ".") {
+		switch {
+		case segment == "**":
+			doubleStars++
+		case segment == "*":
+			stars++
+		case !strings.Contains(segment, "*"):
+			literal++
+		}
+	}
+	return [3]int{literal, -doubleStars, -stars}
+}
+
+// matchCollection returns the most specific pattern matching the name. When
+// patterns are as specific, the one configured first wins.
+func matchCollection(collections []Collection, name string) (Collection, bool) {
+	var best Collection
+	var bestRank [3]int
+	found := false
+	for _, collection := range collections {
+		if !collection.IsCollection(name) {
+			continue
+		}
+		rank := collection.specificity()
+		if !found || greaterRank(rank, bestRank) {
+			best, bestRank, found = collection, rank, true
+		}
+	}
+	return best, found
+}
+
+func greaterRank(a [3]int, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewCollection(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantName string
+		wantTTL  int
+		wantErr  string
+	}{
+		{
+			name:     "valid simple collection",
+			input:    "users:3600",
+			wantName: "users",
+			wantTTL:  3600,
+		},
+		{
+			name:     "valid collection with wildcard",
+			input:    "users.*:7200",
+			wantName: "users.*",
+			wantTTL:  7200,
+		},
+		{
+			name:     "valid collection with several wildcards",
+			input:    "users.*.posts.*:3600",
+			wantName: "users.*.posts.*",
+			wantTTL:  3600,
+		},
+		{
+			name:     "valid collection with double star",
+			input:    "logs.**:60",
+			wantName: "logs.**",
+			wantTTL:  60,
+		},
+		{
+			name:     "valid collection with wildcard in a segment",
+			input:    "logs.app-*:60",
+			wantName: "logs.app-*",
+			wantTTL:  60,
+		},
+		{
+			name:     "valid zero ttl",
+			input:    "users:0",
+			wantName: "users",
+			wantTTL:  0,
+		},
+		{
+			name:    "invalid format - missing TTL",
+			input:   "users",
+			wantErr: "expected pattern:ttl",
+		},
+		{
+			name:    "invalid format - empty string",
+			input:   "",
+			wantErr: "expected pattern:ttl",
+		},
+		{
+			name:    "invalid format - empty pattern",
+			input:   ":60",
+			wantErr: "pattern is empty",
+		},
+		{
+			name:    "invalid format - multiple colons",
+			input:   "users:3600:extra",
+			wantErr: "single colon",
+		},
+		{
+			name:    "invalid pattern - empty segment",
+			input:   "users..posts:60",
+			wantErr: "empty segment",
+		},
+		{
+			name:    "invalid pattern - leading dot",
+			input:   ".users:60",
+			wantErr: "empty segment",
+		},
+		{
+			name:    "invalid pattern - trailing dot",
+			input:   "users.:60",
+			wantErr: "empty segment",
+		},
+		{
+			name:    "invalid pattern - double star in a segment",
+			input:   "users.a**:60",
+			wantErr: "** must be a whole segment",
+		},
+		{
+			name:    "invalid pattern - slash",
+			input:   "users/posts:60",
+			wantErr: "invalid character",
+		},
+		{
+			name:    "invalid TTL - not a number",
+			input:   "users:abc",
+			wantErr: "must be a non-negative integer",
+		},
+		{
+			name:    "invalid TTL - negative number",
+			input:   "users:-3600",
+			wantErr: "must be a non-negative integer",
+		},
+		{
+			name:    "invalid TTL - empty",
+			input:   "users:",
+			wantErr: "must be a non-negative integer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCollection(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewCollection(%q) error = %v, want %q", tt.input, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewCollection(%q) unexpected error: %v", tt.input, err)
+			}
+			if got.Name != tt.wantName {
+				t.Errorf("NewCollection(%q).Name = %q, want %q", tt.input, got.Name, tt.wantName)
+			}
+			if got.TTL != tt.wantTTL {
+				t.Errorf("NewCollection(%q).TTL = %d, want %d", tt.input, got.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestParseCollections(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		wantErr string
+	}{
+		{name: "valid", input: []string{"users:60", "users.*:120"}},
+		{name: "none", input: nil, wantErr: "no collection"},
+		{name: "invalid", input: []string{"users:60", "posts"}, wantErr: `"posts"`},
+		{name: "duplicate", input: []string{"users.*:60", "users.*:120"}, wantErr: "configured twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCollections(tt.input)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("parseCollections(%v) unexpected error: %v", tt.input, err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("parseCollections(%v) error = %v, want %q", tt.input, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCollection_IsCollection(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"exact match", "users", "users", true},
+		{"no match", "users", "posts", false},
+		{"exact no match - extra segment", "users", "users.a", false},
+		{"dotted literal match", "a.b", "a.b", true},
+		{"dotted literal no match - last segment", "a.b", "a.c", false},
+		{"dotted literal no match - first segment", "a.b", "x.b", false},
+		{"wildcard match", "users.*", "users.123", true},
+		{"wildcard no match - different prefix", "users.*", "posts.123", false},
+		{"wildcard no match - extra segments", "users.*", "users.123.posts", false},
+		{"wildcard no match - missing segment", "users.*", "users", false},
+		{"leading wildcard", "*.events", "app.events", true},
+		{"leading wildcard no match", "*.events", "app.logs", false},
+		{"middle wildcard", "users.*.posts", "users.1.posts", true},
+		{"middle wildcard no match - last segment", "users.*.posts", "users.1.likes", false},
+		{"several wildcards", "*.*", "a.b", true},
+		{"several wildcards no match", "*.*", "a", false},
+		{"double star - none", "logs.**", "logs", true},
+		{"double star - one", "logs.**", "logs.app", true},
+		{"double star - several", "logs.**", "logs.app.web.1", true},
+		{"double star no match", "logs.**", "metrics.app", false},
+		{"double star in the middle", "logs.**.errors", "logs.app.web.errors", true},
+		{"double star in the middle - none", "logs.**.errors", "logs.errors", true},
+		{"double star in the middle no match", "logs.**.errors", "logs.app.warnings", false},
+		{"double star alone", "**", "anything.at.all", true},
+		{"segment glob prefix", "logs.app-*", "logs.app-web", true},
+		{"segment glob prefix - empty rest", "logs.app-*", "logs.app-", true},
+		{"segment glob prefix no match", "logs.app-*", "logs.db-web", false},
+		{"segment glob suffix", "logs.*-prod", "logs.web-prod", true},
+		{"segment glob suffix no match", "logs.*-prod", "logs.web-dev", false},
+		{"segment glob middle", "logs.a*b*c", "logs.aXbYc", true},
+		{"segment glob middle no match", "logs.a*b*c", "logs.aXcYb", false},
+		{"segment glob overlapping", "logs.ab*ba", "logs.aba", false},
+		{"empty string", "users", "", false},
+		{"empty segment", "**", "a..b", false},
+		{"path traversal", "*", "..", false},
+		{"slash in name", "*", "a/b", false},
+		{"hidden directory", "**", ".quarantine", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collection := Collection{Name: tt.pattern, TTL: 3600}
+			got := collection.IsCollection(tt.input)
+			if got != tt.want {
+				t.Errorf("Collection{Name: %q}.IsCollection(%q) = %v, want %v",
+					tt.pattern, tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCollection(t *testing.T) {
+	collections := []Collection{
+		{Name: "**", TTL: 1},
+		{Name: "users.*", TTL: 2},
+		{Name: "users.admin", TTL: 3},
+		{Name: "users.**", TTL: 4},
+		{Name: "logs.app-*", TTL: 5},
+		{Name: "logs.*", TTL: 6},
+		{Name: "a.*", TTL: 7},
+		{Name: "*.b", TTL: 8},
+	}
+	tests := []struct {
+		name    string
+		input   string
+		wantTTL int
+		wantOk  bool
+	}{
+		{"literal beats wildcards", "users.admin", 3, true},
+		{"star beats double star", "users.bob", 2, true},
+		{"double star with more literals beats catch all", "users.bob.posts", 4, true},
+		{"double star with no segment", "users", 4, true},
+		{"segment glob beats star", "logs.app-web", 5, true},
+		{"star when the segment glob doesn't match", "logs.db", 6, true},
+		{"first configured wins a tie", "a.b", 7, true},
+		{"catch all", "other", 1, true},
+		{"invalid name", "../etc", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchCollection(collections, tt.input)
+			if ok != tt.wantOk || got.TTL != tt.wantTTL {
+				t.Errorf("matchCollection(%q) = %+v, %v, want ttl %d, %v", tt.input, got, ok, tt.wantTTL, tt.wantOk)
+			}
+		})
+	}
+
+	if _, ok := matchCollection(collections[1:3], "posts"); ok {
+		t.Errorf("Expected no match for posts")
+	}
+}
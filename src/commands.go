@@ -0,0 +1,619 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Start the server",
+		Long:  `Start the server with specific arguments`,
+		Args:  cobra.NoArgs,
+		RunE:  serve,
+	}
+	cmd.Flags().StringP("secret-key", "s", "", "The secret key for the server")
+	cmd.Flags().StringArrayP("collection", "c", []string{}, "The collection patterns followed by colon and ttl in minutes. * matches within a segment, ** any number of segments. Example: -c 'public:60' -c 'group.*:120' -c 'logs.**:30'")
+	cmd.Flags().StringArrayP("type", "t", []string{}, "The type of the payloads of a collection pattern: float64, int64, bool or a schema of name=type fields. Example: -t 'sensors.*:float64' -t 'gps.*:lat=float64,lon=float64,moving=bool'")
+	cmd.Flags().StringArray("json-schema", []string{}, "The JSON schema the payloads of a collection pattern are validated against, inline or from a file with @. Example: --json-schema 'events.*:{\"type\":\"object\",\"required\":[\"kind\"]}' --json-schema 'gps.*:@gps.json'")
+	cmd.Flags().StringArrayP("rollup", "r", []string{}, "The rollup tiers of a collection pattern, as pattern, resolution and ttl separated by colons. Example: -r 'metrics.*:1m:7d' -r 'metrics.*:1h:1y'")
+	cmd.Flags().StringArray("conflict", []string{}, "What an insert does with a record of the same uid and timestamp in a collection pattern: last replaces it (the default), first keeps it, merge applies the new payload as a JSON merge patch, all keeps both. Example: --conflict 'devices.*:merge'")
+	cmd.Flags().StringArray("unit", []string{}, "The time unit of the timestamps of a collection pattern: s (the default), ms, us or ns. Ttls, rollups, time limits and the timestamps the server assigns follow it. Example: --unit 'sensors.*:ms'")
+	cmd.Flags().StringArray("time-limit", []string{}, "How far in the past and in the future from the time of the server the timestamps of a collection pattern can be, 0 for no limit, and whether records beyond are rejected (the default) or clamped to the limit. Example: --time-limit 'devices.*:7d:5m:clamp'")
+	cmd.Flags().StringP("storage-dir", "d", "", "The directory to store the data, if not set, data will not be stored on disk")
+	cmd.Flags().IntP("storage-interval", "i", 0, "The interval to flush the data to the storage in seconds, if not set, data will not be flushed to the storage")
+	cmd.Flags().Int("retention-interval", 60, "The interval to delete the records older than the ttl of their collection in seconds, with or without storage. 0 disables it")
+	cmd.Flags().BoolP("lazy-load", "l", false, "Start serving right after reading the index of each collection, records are loaded on first access and in the background")
+	cmd.Flags().Int("load-concurrency", 0, "The number of uids read from disk in parallel when loading a collection, defaults to the number of CPUs")
+	cmd.Flags().StringP("max-memory", "m", "", "The memory limit for the records of all collections, like 512MB or 2GB. Flushed data is evicted to disk when it's reached, if not set, memory is not limited")
+	cmd.Flags().Int("write-id-window", 600, "The time in seconds the result of an insert sent with a write id is kept, a retry within it gets the same result. 0 ignores write ids")
+	cmd.Flags().Int("max-write-ids", 100000, "The number of write ids kept at most, the oldest are forgotten first")
+	cmd.Flags().String("snapshot-dir", "snapshots", "The directory the snapshot message writes archives to")
+	return cmd
+}
+
+func serve(cmd *cobra.Command, args []string) error {
+	secretKey, _ := cmd.Flags().GetString("secret-key")
+	collectionFlags, _ := cmd.Flags().GetStringArray("collection")
+	types, _ := cmd.Flags().GetStringArray("type")
+	schemas, _ := cmd.Flags().GetStringArray("json-schema")
+	rollups, _ := cmd.Flags().GetStringArray("rollup")
+	conflicts, _ := cmd.Flags().GetStringArray("conflict")
+	timeLimits, _ := cmd.Flags().GetStringArray("time-limit")
+	units, _ := cmd.Flags().GetStringArray("unit")
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	storageInterval, _ := cmd.Flags().GetInt("storage-interval")
+	retentionInterval, _ := cmd.Flags().GetInt("retention-interval")
+	maxMemoryFlag, _ := cmd.Flags().GetString("max-memory")
+	lazyLoad, _ := cmd.Flags().GetBool("lazy-load")
+	loadConcurrency, _ := cmd.Flags().GetInt("load-concurrency")
+	snapshotDir, _ := cmd.Flags().GetString("snapshot-dir")
+	writeIdWindow, _ := cmd.Flags().GetInt("write-id-window")
+	maxWriteIds, _ := cmd.Flags().GetInt("max-write-ids")
+
+	if secretKey == "" {
+		return errors.New("secret-key is not set")
+	}
+	collections, err := parseCollections(collectionFlags)
+	if err != nil {
+		return err
+	}
+	if err := parseTypes(types, collections); err != nil {
+		return err
+	}
+	if err := parseSchemas(schemas, collections); err != nil {
+		return err
+	}
+	if err := parseRollups(rollups, collections); err != nil {
+		return err
+	}
+	if err := parseConflicts(conflicts, collections); err != nil {
+		return err
+	}
+	if err := parseTimeLimits(timeLimits, collections); err != nil {
+		return err
+	}
+	if err := parseUnits(units, collections); err != nil {
+		return err
+	}
+	if storageInterval < 0 {
+		return errors.New("storage-interval can't be negative")
+	}
+	if retentionInterval < 0 {
+		return errors.New("retention-interval can't be negative")
+	}
+	if storageDir == "" && storageInterval > 0 {
+		log.Println("storage-interval is ignored, the storage directory is not set")
+	}
+	if writeIdWindow < 0 {
+		return errors.New("write-id-window can't be negative")
+	}
+	if maxWriteIds < 1 {
+		return errors.New("max-write-ids must be at least 1")
+	}
+	if loadConcurrency < 0 {
+		return errors.New("load-concurrency can't be negative")
+	}
+	var maxMemory int64
+	if maxMemoryFlag != "" {
+		var err error
+		if maxMemory, err = parseByteSize(maxMemoryFlag); err != nil {
+			return err
+		}
+	}
+
+	log.Println(versionString())
+	log.Printf("secret-key: %s", secretKey)
+	log.Printf("collections: %v", collectionFlags)
+	log.Printf("types: %v", types)
+	log.Printf("json-schemas: %v", schemas)
+	log.Printf("rollups: %v", rollups)
+	log.Printf("conflicts: %v", conflicts)
+	log.Printf("time-limits: %v", timeLimits)
+	log.Printf("units: %v", units)
+	log.Printf("storage-dir: %s", storageDir)
+	log.Printf("storage-interval: %d", storageInterval)
+	log.Printf("retention-interval: %d", retentionInterval)
+	log.Printf("max-memory: %d", maxMemory)
+	log.Printf("lazy-load: %t", lazyLoad)
+	log.Printf("load-concurrency: %d", loadConcurrency)
+	log.Printf("snapshot-dir: %s", snapshotDir)
+	log.Printf("write-id-window: %d", writeIdWindow)
+	log.Printf("max-write-ids: %d", maxWriteIds)
+
+	options := serverOptions{
+		storageDir:        storageDir,
+		storageInterval:   storageInterval,
+		retentionInterval: retentionInterval,
+		maxMemory:         maxMemory,
+		lazyLoad:          lazyLoad,
+		loadConcurrency:   loadConcurrency,
+		snapshotDir:       snapshotDir,
+		writeIdWindow:     writeIdWindow,
+		maxWriteIds:       maxWriteIds,
+	}
+	return startServer(secretKey, collections, options)
+}
+
+func newSnapshotCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Write a snapshot archive of the collections",
+		Long:  `Ask a running server to write a snapshot archive, or write one from a storage directory that no server is using`,
+		Args:  cobra.NoArgs,
+		RunE:  snapshot,
+	}
+	cmd.Flags().String("server", "", "The websocket url of a running server, like ws://localhost:1985")
+	cmd.Flags().StringP("secret-key", "s", "", "The secret key of the server")
+	cmd.Flags().StringP("storage-dir", "d", "", "The storage directory to archive when no server is given")
+	cmd.Flags().StringP("output", "o", "snapshots", "The directory to write the archive to when no server is given")
+	cmd.Flags().StringArrayP("collection", "c", []string{}, "The collections to archive, all if not set")
+	cmd.MarkFlagsOneRequired("server", "storage-dir")
+	cmd.MarkFlagsMutuallyExclusive("server", "storage-dir")
+	return cmd
+}
+
+func snapshot(cmd *cobra.Command, args []string) error {
+	server, _ := cmd.Flags().GetString("server")
+	secretKey, _ := cmd.Flags().GetString("secret-key")
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	output, _ := cmd.Flags().GetString("output")
+	collections, _ := cmd.Flags().GetStringArray("collection")
+
+	if server != "" {
+		c, err := dialServer(server, secretKey)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		response, err := c.call("snapshot", snapshotRequest{Collections: collections})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), string(response))
+		return nil
+	}
+
+	databases, err := openStorageDir(storageDir)
+	if err != nil {
+		return err
+	}
+	dbs, err := selectDatabases(databases, collections)
+	if err != nil {
+		return err
+	}
+	file, checksum, _, err := createSnapshot(output, dbs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s  %s\n", checksum, file)
+	return nil
+}
+
+// openStorageDir loads every collection of a storage directory that no server is using
+func openStorageDir(storageDir string) (map[string]*Database, error) {
+	dirs, err := os.ReadDir(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	databases := make(map[string]*Database)
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		databases[dir.Name()] = NewDatabase(dir.Name(), storageDir, 0)
+	}
+	return databases, nil
+}
+
+func newRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a snapshot archive into an empty storage directory",
+		Args:  cobra.NoArgs,
+		RunE:  restore,
+	}
+	cmd.Flags().StringP("archive", "a", "", "The snapshot archive to restore")
+	cmd.Flags().StringP("storage-dir", "d", "", "The empty storage directory to restore to")
+	cmd.Flags().StringArrayP("collection", "c", []string{}, "The collections to restore, all if not set")
+	cmd.Flags().StringArray("rename", []string{}, "Restore a collection under another name. Example: --rename 'old:new'")
+	cmd.Flags().Int64("from", math.MinInt64, "Only restore records with a timestamp >= from")
+	cmd.Flags().Int64("to", math.MaxInt64, "Only restore records with a timestamp <= to")
+	cmd.MarkFlagRequired("archive")
+	cmd.MarkFlagRequired("storage-dir")
+	return cmd
+}
+
+func restore(cmd *cobra.Command, args []string) error {
+	archive, _ := cmd.Flags().GetString("archive")
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	collections, _ := cmd.Flags().GetStringArray("collection")
+	renames, _ := cmd.Flags().GetStringArray("rename")
+	from, _ := cmd.Flags().GetInt64("from")
+	to, _ := cmd.Flags().GetInt64("to")
+
+	opts := restoreOptions{
+		collections: make(map[string]bool),
+		rename:      make(map[string]string),
+		from:        from,
+		to:          to,
+	}
+	for _, collection := range collections {
+		opts.collections[collection] = true
+	}
+	for _, rename := range renames {
+		oldName, newName, ok := strings.Cut(rename, ":")
+		if !ok || oldName == "" || newName == "" {
+			return fmt.Errorf("rename must be old:new, got %s", rename)
+		}
+		opts.rename[oldName] = newName
+	}
+
+	info, err := restoreSnapshot(archive, storageDir, opts)
+	if err != nil {
+		return err
+	}
+	log.Println("Restored snapshot created at", time.Unix(info.CreatedAt, 0).Format("2006-01-02 15:04:05"), "into", storageDir)
+	return nil
+}
+
+// validateFormat checks the format flag of the export and import commands
+func validateFormat(format string) error {
+	switch format {
+	case formatNDJSON, formatCSV, formatColumnar:
+		return nil
+	}
+	return fmt.Errorf("format must be %s, %s or %s, got %s", formatNDJSON, formatCSV, formatColumnar, format)
+}
+
+func newExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the records of a collection as NDJSON, CSV or a columnar file",
+		Long:  `Export the records of a collection from a running server, or from a storage directory that no server is using`,
+		Args:  cobra.NoArgs,
+		RunE:  export,
+	}
+	cmd.Flags().String("server", "", "The websocket url of a running server, like ws://localhost:1985")
+	cmd.Flags().StringP("secret-key", "s", "", "The secret key of the server")
+	cmd.Flags().StringP("storage-dir", "d", "", "The storage directory to read when no server is given")
+	cmd.Flags().StringP("collection", "c", "", "The collection to export")
+	cmd.Flags().String("uid-prefix", "", "Only export the uids starting with this prefix")
+	cmd.Flags().Int64("from", math.MinInt64, "Only export records with a timestamp >= from")
+	cmd.Flags().Int64("to", math.MaxInt64, "Only export records with a timestamp <= to")
+	cmd.Flags().StringP("format", "f", formatNDJSON, "The output format: ndjson, csv or columnar")
+	cmd.Flags().Bool("flatten", false, "Write the fields of JSON payloads as CSV columns")
+	cmd.Flags().StringP("output", "o", "", "The file to write to, stdout if not set")
+	addPatternFlags(cmd)
+	cmd.MarkFlagRequired("collection")
+	cmd.MarkFlagsOneRequired("server", "storage-dir")
+	cmd.MarkFlagsMutuallyExclusive("server", "storage-dir")
+	return cmd
+}
+
+func export(cmd *cobra.Command, args []string) error {
+	server, _ := cmd.Flags().GetString("server")
+	secretKey, _ := cmd.Flags().GetString("secret-key")
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	format, _ := cmd.Flags().GetString("format")
+	flatten, _ := cmd.Flags().GetBool("flatten")
+	output, _ := cmd.Flags().GetString("output")
+	filter := exportFilter{}
+	filter.collection, _ = cmd.Flags().GetString("collection")
+	filter.uidPrefix, _ = cmd.Flags().GetString("uid-prefix")
+	filter.from, _ = cmd.Flags().GetInt64("from")
+	filter.to, _ = cmd.Flags().GetInt64("to")
+
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	if filter.from > filter.to {
+		return errors.New("from must be <= to")
+	}
+
+	out := cmd.OutOrStdout()
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	w, err := newExportWriter(format, out, flatten)
+	if err != nil {
+		return err
+	}
+
+	if server != "" {
+		c, err := dialServer(server, secretKey)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := exportServer(c, filter, w); err != nil {
+			return err
+		}
+	} else {
+		config, err := storageConfigFlags(cmd, storageDir, filter.collection)
+		if err != nil {
+			return err
+		}
+		if err := exportStorage(storageDir, config, filter, w); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
+
+func newImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the records of an export into a collection",
+		Long:  `Import the records of an export into a running server, or into a storage directory that no server is using`,
+		Args:  cobra.NoArgs,
+		RunE:  importRecords,
+	}
+	cmd.Flags().String("server", "", "The websocket url of a running server, like ws://localhost:1985")
+	cmd.Flags().StringP("secret-key", "s", "", "The secret key of the server")
+	cmd.Flags().StringP("storage-dir", "d", "", "The storage directory to write when no server is given")
+	cmd.Flags().StringP("collection", "c", "", "The collection to import into")
+	cmd.Flags().Int64("ttl", 0, "The ttl of the collection when importing into a storage directory, expired records are dropped")
+	cmd.Flags().StringP("format", "f", formatNDJSON, "The input format: ndjson, csv or columnar")
+	cmd.Flags().Int("batch-size", 1000, "The number of records sent in each insert message")
+	cmd.Flags().StringP("input", "i", "", "The file to read from, stdin if not set")
+	addPatternFlags(cmd)
+	cmd.MarkFlagRequired("collection")
+	cmd.MarkFlagsOneRequired("server", "storage-dir")
+	cmd.MarkFlagsMutuallyExclusive("server", "storage-dir")
+	return cmd
+}
+
+func importRecords(cmd *cobra.Command, args []string) error {
+	server, _ := cmd.Flags().GetString("server")
+	secretKey, _ := cmd.Flags().GetString("secret-key")
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	collection, _ := cmd.Flags().GetString("collection")
+	ttl, _ := cmd.Flags().GetInt64("ttl")
+	format, _ := cmd.Flags().GetString("format")
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	input, _ := cmd.Flags().GetString("input")
+
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		return errors.New("batch-size must be positive")
+	}
+	if ttl < 0 {
+		return errors.New("ttl can't be negative")
+	}
+
+	in := cmd.InOrStdin()
+	if input != "" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var count int
+	var err error
+	if server != "" {
+		c, dialErr := dialServer(server, secretKey)
+		if dialErr != nil {
+			return dialErr
+		}
+		defer c.Close()
+		count, err = importServer(c, collection, format, in, batchSize)
+	} else {
+		config, configErr := storageConfigFlags(cmd, storageDir, collection)
+		if configErr != nil {
+			return configErr
+		}
+		count, err = importStorage(storageDir, collection, config, ttl, format, in)
+	}
+	if err != nil {
+		return fmt.Errorf("error after importing %d records: %w", count, err)
+	}
+	log.Printf("Imported %d records into %s", count, collection)
+	return nil
+}
+
+// addStorageFlags adds the flags of the commands working on a storage directory without a server
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("storage-dir", "d", "", "The storage directory, no server may be using it")
+	cmd.Flags().StringArrayP("collection", "c", []string{}, "The collections to use, all if not set")
+	cmd.MarkFlagRequired("storage-dir")
+}
+
+// addPatternFlags adds the flags configuring collection patterns like serve
+// to the commands reading and writing records in a storage directory
+func addPatternFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("type", "t", []string{}, "The type of the payloads of a collection pattern, as given to serve, used when no server is given. Example: -t 'sensors.*:float64'")
+	cmd.Flags().StringArray("json-schema", []string{}, "The JSON schema of a collection pattern, as given to serve, used when no server is given. Example: --json-schema 'gps.*:@gps.json'")
+	cmd.Flags().StringArray("conflict", []string{}, "The conflict policy of a collection pattern, as given to serve, used when no server is given. Example: --conflict 'devices.*:all'")
+	cmd.Flags().StringArray("unit", []string{}, "The time unit of a collection pattern, as given to serve, used when no server is given. Patterns created at runtime use the configuration saved in the storage directory. Example: --unit 'sensors.*:ms'")
+}
+
+// storageConfigFlags returns the configuration of a collection of the
+// storage directory given to the command, from its collections file and the
+// pattern flags
+func storageConfigFlags(cmd *cobra.Command, storageDir string, collection string) (Collection, error) {
+	flags := patternFlags{}
+	flags.types, _ = cmd.Flags().GetStringArray("type")
+	flags.schemas, _ = cmd.Flags().GetStringArray("json-schema")
+	flags.conflicts, _ = cmd.Flags().GetStringArray("conflict")
+	flags.units, _ = cmd.Flags().GetStringArray("unit")
+	patterns, err := storagePatterns(storageDir, flags)
+	if err != nil {
+		return Collection{}, err
+	}
+	return storageConfig(patterns, collection), nil
+}
+
+// inspectStorageFlags inspects the storage directory and collections given to the command
+func inspectStorageFlags(cmd *cobra.Command) (*storageReport, error) {
+	storageDir, _ := cmd.Flags().GetString("storage-dir")
+	collections, _ := cmd.Flags().GetStringArray("collection")
+	return inspectStorage(storageDir, collections)
+}
+
+func newInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Print the files, records, time range and size of every collection and uid of a storage directory",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := inspectStorageFlags(cmd)
+			if err != nil {
+				return err
+			}
+			return printInspectReport(cmd.OutOrStdout(), report)
+		},
+	}
+	addStorageFlags(cmd)
+	return cmd
+}
+
+func newVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that every file of a storage directory parses and is sorted",
+		Long:  `Check that every file of a storage directory parses and is sorted, exits with status 1 when there are problems`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := inspectStorageFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if problems := printProblems(cmd.OutOrStdout(), report); problems > 0 {
+				return fmt.Errorf("%d problems found", problems)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "No problems found")
+			return nil
+		},
+	}
+	addStorageFlags(cmd)
+	return cmd
+}
+
+func newRepairCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Rewrite or quarantine the bad files of a storage directory that no server is using",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storageDir, _ := cmd.Flags().GetString("storage-dir")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			conflictFlags, _ := cmd.Flags().GetStringArray("conflict")
+			conflicts, err := storagePatterns(storageDir, patternFlags{conflicts: conflictFlags})
+			if err != nil {
+				return err
+			}
+			report, err := inspectStorageFlags(cmd)
+			if err != nil {
+				return err
+			}
+			actions, err := repairStorage(storageDir, report, conflicts, dryRun)
+			for _, action := range actions {
+				fmt.Fprintln(cmd.OutOrStdout(), action)
+			}
+			if err != nil {
+				return err
+			}
+			if len(actions) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "No problems found")
+			}
+			return nil
+		},
+	}
+	addStorageFlags(cmd)
+	cmd.Flags().Bool("dry-run", false, "Print what would be done without changing any file")
+	cmd.Flags().StringArray("conflict", []string{}, "The conflict policy of a collection pattern, as given to serve. Records with the same timestamp in rewritten files are resolved with it. Patterns created at runtime use the policy saved in the storage directory. Example: --conflict 'devices.*:all'")
+	return cmd
+}
+
+func newCompactCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Merge the flushed files of every uid into one file",
+		Long:  `Merge the flushed files of every uid of a storage directory that no server is using into one file. Uids with bad files are skipped, repair fixes them`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storageDir, _ := cmd.Flags().GetString("storage-dir")
+			collections, _ := cmd.Flags().GetStringArray("collection")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			conflictFlags, _ := cmd.Flags().GetStringArray("conflict")
+			conflicts, err := storagePatterns(storageDir, patternFlags{conflicts: conflictFlags})
+			if err != nil {
+				return err
+			}
+			report, err := inspectStorage(storageDir, collections)
+			if err != nil {
+				return err
+			}
+			skipped := 0
+			for _, c := range report.Collections {
+				config, _ := matchCollection(conflicts, c.Name)
+				result, err := compactCollection(storageDir, c.Name, config.Conflict, dryRun)
+				if err != nil {
+					return fmt.Errorf("error compacting %s: %w", c.Name, err)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: merged %d files of %d uids\n", c.Name, result.FilesBefore, result.Uids)
+				for _, uid := range result.Skipped {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s: skipped %s, it has bad files\n", c.Name, uid)
+				}
+				skipped += len(result.Skipped)
+			}
+			if skipped > 0 {
+				return fmt.Errorf("%d uids skipped, run repair first", skipped)
+			}
+			return nil
+		},
+	}
+	addStorageFlags(cmd)
+	cmd.Flags().Bool("dry-run", false, "Print what would be merged without changing any file")
+	cmd.Flags().StringArray("conflict", []string{}, "The conflict policy of a collection pattern, as given to serve. Patterns created at runtime use the policy saved in the storage directory. Example: --conflict 'devices.*:all'")
+	return cmd
+}
+
+func newBenchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the throughput of inserts and queries",
+		Long:  `Measure the throughput of inserts and queries on a collection of its own, in memory or flushed to a temporary directory`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := benchOptions{}
+			opts.uids, _ = cmd.Flags().GetInt("uids")
+			opts.records, _ = cmd.Flags().GetInt("records")
+			opts.payloadSize, _ = cmd.Flags().GetInt("payload-size")
+			opts.concurrency, _ = cmd.Flags().GetInt("concurrency")
+			opts.storageDir, _ = cmd.Flags().GetString("storage-dir")
+			if opts.uids <= 0 || opts.records <= 0 || opts.concurrency <= 0 {
+				return errors.New("uids, records and concurrency must be positive")
+			}
+			if opts.payloadSize < 0 {
+				return errors.New("payload-size can't be negative")
+			}
+			return runBench(opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().Int("uids", 1000, "The number of uids")
+	cmd.Flags().Int("records", 1000, "The number of records per uid")
+	cmd.Flags().Int("payload-size", 64, "The size of the data of every record in bytes")
+	cmd.Flags().Int("concurrency", 4, "The number of goroutines inserting and querying")
+	cmd.Flags().StringP("storage-dir", "d", "", "Flush to a temporary directory in this directory, in memory only if not set")
+	return cmd
+}
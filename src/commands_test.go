@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func executeCommand(args ...string) (string, error) {
+	cmd := newRootCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestCommandValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unknown flag", []string{"serve", "--unknown"}},
+		{"no secret key", []string{"serve", "-c", "test:1"}},
+		{"no collection", []string{"serve", "-s", "secret"}},
+		{"collection without ttl", []string{"serve", "-s", "secret", "-c", "test"}},
+		{"negative retention interval", []string{"serve", "-s", "secret", "-c", "test:1", "--retention-interval", "-1"}},
+		{"rollup of an unknown pattern", []string{"serve", "-s", "secret", "-c", "test:1", "-r", "other:1m:1d"}},
+		{"invalid rollup resolution", []string{"serve", "-s", "secret", "-c", "test:1", "-r", "test:soon:1d"}},
+		{"unknown type", []string{"serve", "-s", "secret", "-c", "test:1", "-t", "test:float32"}},
+		{"invalid json schema", []string{"serve", "-s", "secret", "-c", "test:1", "--json-schema", "test:{"}},
+		{"negative write id window", []string{"serve", "-s", "secret", "-c", "test:1", "--write-id-window", "-1"}},
+		{"no write ids kept", []string{"serve", "-s", "secret", "-c", "test:1", "--max-write-ids", "0"}},
+		{"invalid max memory", []string{"serve", "-s", "secret", "-c", "test:1", "-m", "lots"}},
+		{"export without source", []string{"export", "-c", "test"}},
+		{"export with both sources", []string{"export", "-c", "test", "-d", "dir", "--server", "ws://localhost"}},
+		{"export with unknown format", []string{"export", "-c", "test", "-d", "dir", "-f", "xml"}},
+		{"import with zero batch size", []string{"import", "-c", "test", "-d", "dir", "--batch-size", "0"}},
+		{"inspect without storage dir", []string{"inspect"}},
+		{"bench with no uids", []string{"bench", "--uids", "0"}},
+		{"unexpected argument", []string{"version", "extra"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := executeCommand(tt.args...); err == nil {
+				t.Errorf("Expected an error for %v", tt.args)
+			}
+		})
+	}
+}
+
+func TestHelpDoesNotStartServer(t *testing.T) {
+	out, err := executeCommand("serve", "--help")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "--secret-key") {
+		t.Errorf("Expected the serve flags in the help, got %s", out)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	out, err := executeCommand("version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "tsdb "+version) {
+		t.Errorf("Expected the version, got %s", out)
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+	if _, err := executeCommand("verify", "-d", dir); err != nil {
+		t.Errorf("Expected no problems, got %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "test", "1", "1.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := executeCommand("verify", "-d", dir); err == nil || !strings.Contains(out, "1.json") {
+		t.Errorf("Expected a problem with 1.json, got %v: %s", err, out)
+	}
+}
+
+func TestBenchCommand(t *testing.T) {
+	out, err := executeCommand("bench", "--uids", "10", "--records", "10", "-d", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"insert", "flush", "range", "latest"} {
+		if !strings.Contains(out, phase) {
+			t.Errorf("Expected a %s line, got %s", phase, out)
+		}
+	}
+}
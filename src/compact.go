@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// compactResult counts what compactCollection did
+type compactResult struct {
+	Uids        int      // uids whose files were merged
+	FilesBefore int      // files of those uids before merging
+	Skipped     []string // uids with files that inspect reports problems for
+}
+
+// compactCollection merges the flushed files of every uid of a collection
+// in a storage directory that no server is using into a single file. The
+// file is named after the newest of the merged files, so tombstones still
+// apply to it. Records with the same timestamp are merged with the conflict
+// policy of the collection, like Load does. Uids with files Load would skip
+// are left alone, repair must fix them first or their records would be lost.
+func compactCollection(storageDir string, name string, conflict string, dryRun bool) (*compactResult, error) {
+	db := emptyDatabase(name, storageDir, 0, shardCount)
+	defer db.Stop()
+	// completes interrupted deletions before files are merged
+	if err := db.LoadIndex(); err != nil {
+		return nil, err
+	}
+
+	dir := path.Join(storageDir, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := &compactResult{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		uid := entry.Name()
+		uidDir := path.Join(dir, uid)
+		report, err := inspectUid(uidDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(report.Problems) > 0 {
+			result.Skipped = append(result.Skipped, uid)
+			continue
+		}
+		files, newest, err := flushedFiles(uidDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) < 2 {
+			continue
+		}
+		result.Uids++
+		result.FilesBefore += len(files)
+		if dryRun {
+			continue
+		}
+
+		s, err := readSeries(uidDir, nil, nil, conflict)
+		if err != nil {
+			return nil, fmt.Errorf("error reading user %s: %w", uid, err)
+		}
+		data, err := json.Marshal(s.rangeRecords(s.firstTimestamp(), s.lastTimestamp()))
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path.Join(uidDir, newest), data); err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file == newest {
+				continue
+			}
+			if err := os.Remove(path.Join(uidDir, file)); err != nil {
+				return nil, fmt.Errorf("error removing file %s: %w", file, err)
+			}
+		}
+		s.bytesOnDisk = int64(len(data))
+		db.manifest.Index[uid] = s.indexEntry()
+	}
+
+	if !dryRun && result.Uids > 0 {
+		if err := db.manifest.write(dir); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// flushedFiles returns the names of the flushed files of a uid and the name
+// of the newest one
+func flushedFiles(dir string) ([]string, string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	var files []string
+	newest := ""
+	newestTime := int64(0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		files = append(files, entry.Name())
+		if t, ok := flushFileTime(entry.Name()); ok && (newest == "" || t > newestTime) {
+			newest = entry.Name()
+			newestTime = t
+		}
+	}
+	if newest == "" && len(files) > 0 {
+		newest = files[len(files)-1]
+	}
+	return files, newest, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCompactCollection(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 0)
+	for i := range 3 {
+		createRecords(db, "1", 10*(i+1))
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createRecords(db, "2", 5)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Stop()
+	if err := os.WriteFile(path.Join(dir, "test", "2", "1.json"), []byte("["), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run changes nothing
+	result, err := compactCollection(dir, "test", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uids != 1 || result.FilesBefore != 3 || len(result.Skipped) != 1 {
+		t.Errorf("Expected 3 files of uid 1 and uid 2 skipped, got %+v", result)
+	}
+	if files, _, _ := flushedFiles(path.Join(dir, "test", "1")); len(files) != 3 {
+		t.Errorf("Expected 3 files after a dry run, got %v", files)
+	}
+
+	if _, err := compactCollection(dir, "test", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if files, _, _ := flushedFiles(path.Join(dir, "test", "1")); len(files) != 1 {
+		t.Errorf("Expected 1 file, got %v", files)
+	}
+	if files, _, _ := flushedFiles(path.Join(dir, "test", "2")); len(files) != 2 {
+		t.Errorf("Expected the files of uid 2 to be left alone, got %v", files)
+	}
+
+	db = NewDatabase("test", dir, 0)
+	defer db.Stop()
+	if records := db.GetRecordsForUser("1", 0, 100); len(records) != 30 {
+		t.Errorf("Expected 30 records, got %d", len(records))
+	}
+	m, err := readManifest(path.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := m.Index["1"]; entry.Records != 30 {
+		t.Errorf("Expected the index to have 30 records, got %+v", entry)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// conflict policies of a collection, they decide what an insert does when
+// the uid already has a record with the same timestamp
+const (
+	conflictLast  = "last"  // the new record replaces the existing one, the default
+	conflictFirst = "first" // the existing record is kept and the new one ignored
+	conflictMerge = "merge" // the new payload is applied to the existing one as a JSON merge patch
+	conflictAll   = "all"   // both records are kept, in the order they were inserted
+)
+
+func validateConflict(conflict string) error {
+	switch conflict {
+	case "", conflictLast, conflictFirst, conflictMerge, conflictAll:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q, expected %s, %s, %s or %s", conflict, conflictLast, conflictFirst, conflictMerge, conflictAll)
+}
+
+// parseConflicts sets the conflict policies of the collection patterns named
+// by the conflict flags, of the form pattern:policy
+func parseConflicts(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, conflict, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("invalid conflict policy %q: expected pattern:policy", spec)
+		}
+		if err := validateConflict(conflict); err != nil {
+			return fmt.Errorf("invalid conflict policy %q: %w", spec, err)
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid conflict policy %q: collection pattern %q is not configured", spec, pattern)
+		}
+		collections[i].Conflict = conflict
+	}
+	return nil
+}
+
+// replayConflict returns the policy that rebuilds a series from its flushed
+// files. Merged records are flushed whole, so replaying them replaces the
+// records they were merged into.
+func replayConflict(conflict string) string {
+	if conflict == conflictMerge {
+		return conflictLast
+	}
+	return conflict
+}
+
+// replay adds a record read from disk following the conflict policy. Files
+// are read oldest first, so the records are replayed in the order they were
+// written.
+func (s *series) replay(record Record, conflict string) {
+	switch replayConflict(conflict) {
+	case conflictFirst:
+		if s.at(record.Timestamp) != nil {
+			return
+		}
+		s.put(record, false)
+	case conflictAll:
+		s.put(record, true)
+	default:
+		s.put(record, false)
+	}
+}
+
+// mergePayloads applies a payload to an existing one as a JSON merge patch
+// (RFC 7386). A patch that isn't an object replaces the existing payload.
+func mergePayloads(existing string, patch string) (string, error) {
+	patchValue, err := decodeJSON(patch)
+	if err != nil {
+		return "", fmt.Errorf("%w: merge patches must be JSON: %s", ErrInvalidPayload, err)
+	}
+	// payloads that aren't JSON are replaced like any other non object
+	existingValue, _ := decodeJSON(existing)
+	merged, err := json.Marshal(mergePatch(existingValue, patchValue))
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+func mergePatch(target any, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]any)
+	if !ok {
+		result = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(result, name)
+			continue
+		}
+		result[name] = mergePatch(result[name], value)
+	}
+	return result
+}
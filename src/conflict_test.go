@@ -0,0 +1,201 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMergePayloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		patch    string
+		want     string
+		wantErr  bool
+	}{
+		{"adds and replaces fields", `{"a":1,"b":2}`, `{"b":3,"c":4}`, `{"a":1,"b":3,"c":4}`, false},
+		{"null removes a field", `{"a":1,"b":2}`, `{"b":null}`, `{"a":1}`, false},
+		{"nested objects", `{"pos":{"lat":1,"lon":2}}`, `{"pos":{"lat":3}}`, `{"pos":{"lat":3,"lon":2}}`, false},
+		{"non object patch replaces", `{"a":1}`, `[1,2]`, `[1,2]`, false},
+		{"non JSON existing payload", `text`, `{"a":1}`, `{"a":1}`, false},
+		{"non JSON patch", `{"a":1}`, `text`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := mergePayloads(tt.existing, tt.patch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if merged != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, merged)
+			}
+		})
+	}
+}
+
+func TestParseConflicts(t *testing.T) {
+	collections := []Collection{{Name: "devices.*"}, {Name: "logs"}}
+	if err := parseConflicts([]string{"devices.*:merge", "logs:all"}, collections); err != nil {
+		t.Fatal(err)
+	}
+	if collections[0].Conflict != conflictMerge || collections[1].Conflict != conflictAll {
+		t.Errorf("Expected merge and all, got %+v", collections)
+	}
+	for _, spec := range []string{"devices.*", "devices.*:newest", "other:first"} {
+		if err := parseConflicts([]string{spec}, collections); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
+
+// conflictDatabase opens a collection with the conflict policy stored in dir
+func conflictDatabase(t *testing.T, dir string, conflict string) *Database {
+	t.Helper()
+	db, err := openDatabase("test", Collection{Name: "test", Conflict: conflict}, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Stop)
+	return db
+}
+
+func TestConflictPolicies(t *testing.T) {
+	tests := []struct {
+		conflict string
+		statuses string
+		want     []string
+	}{
+		{conflictLast, "accepted,overwrote,overwrote", []string{`{"a":3}`}},
+		{conflictFirst, "accepted,ignored,ignored", []string{`{"a":1,"b":1}`}},
+		{conflictMerge, "accepted,merged,merged", []string{`{"a":3,"c":2}`}},
+		{conflictAll, "accepted,accepted,accepted", []string{`{"a":1,"b":1}`, `{"b":null,"c":2}`, `{"a":3}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			dir := t.TempDir()
+			db := conflictDatabase(t, dir, tt.conflict)
+			var statuses []string
+			for i, data := range []string{`{"a":1,"b":1}`, `{"b":null,"c":2}`, `{"a":3}`} {
+				outcome, err := db.insertRecord("1", 5, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				statuses = append(statuses, outcome.status)
+				// flushed one by one, so Load replays them from separate files
+				if err := db.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					db.Insert("1", 4, "{}")
+				}
+			}
+			if got := strings.Join(statuses, ","); got != tt.statuses {
+				t.Errorf("Expected %s, got %s", tt.statuses, got)
+			}
+			check := func(db *Database, when string) {
+				records := db.GetRecordsForUser("1", 5, 5)
+				if len(records) != len(tt.want) {
+					t.Fatalf("Expected %d records %s, got %+v", len(tt.want), when, records)
+				}
+				for i, record := range records {
+					if record.Data != tt.want[i] {
+						t.Errorf("Expected %s %s, got %s", tt.want[i], when, record.Data)
+					}
+				}
+				if latest := db.GetLatestRecordForUser("1", 10); latest.Data != tt.want[len(tt.want)-1] {
+					t.Errorf("Expected the latest record to be %s %s, got %s", tt.want[len(tt.want)-1], when, latest.Data)
+				}
+				if stats := db.Stats(); stats.Records != len(tt.want)+1 {
+					t.Errorf("Expected %d records counted %s, got %d", len(tt.want)+1, when, stats.Records)
+				}
+			}
+			check(db, "after insert")
+			db.Stop()
+			check(conflictDatabase(t, dir, tt.conflict), "after load")
+
+			if _, err := compactCollection(dir, "test", tt.conflict, false); err != nil {
+				t.Fatal(err)
+			}
+			if files, _, _ := flushedFiles(path.Join(dir, "test", "1")); len(files) != 1 {
+				t.Errorf("Expected the files to be compacted, got %v", files)
+			}
+			check(conflictDatabase(t, dir, tt.conflict), "after compaction")
+		})
+	}
+}
+
+func TestMergeValidatesMergedPayload(t *testing.T) {
+	collections := []Collection{{Name: "events", TTL: 1, Conflict: conflictMerge, JSONSchema: []byte(`{"required":["kind"]}`)}}
+	reg, err := newRegistry(storageOptions{}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("events")
+	if err := db.Insert("1", 1, `{"value":1}`); err == nil {
+		t.Error("Expected a first record without kind to be refused")
+	}
+	if err := db.Insert("1", 1, `{"kind":"start"}`); err != nil {
+		t.Fatal(err)
+	}
+	// the patch alone doesn't have kind, the merged payload does
+	if err := db.Insert("1", 1, `{"value":1}`); err != nil {
+		t.Errorf("Expected the patch to be accepted, got %v", err)
+	}
+	if err := db.Insert("1", 1, `{"kind":null}`); err == nil {
+		t.Error("Expected a patch removing kind to be refused")
+	}
+	if latest := db.GetLatestRecordForUser("1", 1); latest.Data != `{"kind":"start","value":1}` {
+		t.Errorf("Expected the merged record, got %s", latest.Data)
+	}
+}
+
+func TestInsertAtomicKeepAll(t *testing.T) {
+	reg, err := newRegistry(storageOptions{dir: t.TempDir()}, []Collection{{Name: "logs", TTL: 1, Conflict: conflictAll, MaxRecordsPerUid: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("logs")
+	defer db.Stop()
+	if err := db.Insert("1", 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third record goes over the limit, only the records of the batch are removed
+	results := insertAtomic(reg, nil, insertPayloads(t, `[
+		{"ts":1,"uid":"1","data":"b","collection":"logs"},
+		{"ts":1,"uid":"1","data":"a","collection":"logs"},
+		{"ts":1,"uid":"1","data":"c","collection":"logs"}
+	]`))
+	if statuses := resultStatuses(results); statuses != "rejected,rejected,rejected" {
+		t.Fatalf("Expected every record to be rejected, got %s", statuses)
+	}
+	if records := db.GetRecordsForUser("1", 1, 1); len(records) != 1 || records[0].Data != "a" {
+		t.Errorf("Expected the first record only, got %+v", records)
+	}
+
+	// records flushed before the batch is undone are removed from the files
+	if err := db.Insert("1", 1, "b"); err != nil {
+		t.Fatal(err)
+	}
+	outcome, err := db.insertChecked("1", 1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.undoInsert("1", outcome)
+	if records := db.GetRecordsForUser("1", 1, 1); len(records) != 2 || records[1].Data != "b" {
+		t.Errorf("Expected the records before the undone one, got %+v", records)
+	}
+	db.Stop()
+	loaded, err := openDatabase("logs", Collection{Name: "logs", Conflict: conflictAll}, storageOptions{dir: reg.opts.dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Stop()
+	if records := loaded.GetRecordsForUser("1", 1, 1); len(records) != 2 || records[0].Data != "a" || records[1].Data != "b" {
+		t.Errorf("Expected the undone record not to be loaded, got %+v", records)
+	}
+}
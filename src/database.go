@@ -4,193 +4,455 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Record struct {
 	Timestamp int64  `json:"ts"`
 	Data      string `json:"data"`
-	isNew     bool
+	gen       uint64 // generation of the write, 0 for records loaded from disk
+	value     uint64 // bits of the value of typed records, see typed.go
 }
 
-type RecordHeader struct {
-	hasChanged bool
-	records    []Record
+// number of decoded payloads kept per database for filter evaluation
+const payloadCacheSize = 10000
+
+// number of lock-striped shards the uids of a database are spread over
+const shardCount = 16
+
+// shard owns a subset of the uids of a database. Inserts and range queries
+// take its lock, the latest record of every uid can be read without it.
+type shard struct {
+	mu     sync.RWMutex // protects the series
+	uids   sync.Map     // uid -> *series, only modified while holding mu
+	oldest atomic.Int64 // timestamp of the oldest record, only modified while holding mu
+	newest atomic.Int64 // timestamp of the newest record, only modified while holding mu
+}
+
+func newShard() *shard {
+	sh := &shard{}
+	sh.oldest.Store(math.MaxInt64)
+	sh.newest.Store(math.MinInt64)
+	return sh
+}
+
+func (sh *shard) get(uid string) *series {
+	if s, ok := sh.uids.Load(uid); ok {
+		return s.(*series)
+	}
+	return nil
+}
+
+// each calls fn for every uid of the shard until it returns false
+func (sh *shard) each(fn func(uid string, s *series) bool) {
+	sh.uids.Range(func(key, value any) bool {
+		return fn(key.(string), value.(*series))
+	})
+}
+
+// widen extends the bounds of the shard to records from first to last. The
+// caller must hold mu.
+func (sh *shard) widen(first int64, last int64) {
+	if first < sh.oldest.Load() {
+		sh.oldest.Store(first)
+	}
+	if last > sh.newest.Load() {
+		sh.newest.Store(last)
+	}
+}
+
+// shrink updates the bounds of the shard once records from first to last
+// were removed. The uids are only scanned when a bound was removed. The
+// caller must hold mu.
+func (sh *shard) shrink(first int64, last int64) {
+	if first > sh.oldest.Load() && last < sh.newest.Load() {
+		return
+	}
+	sh.refreshBounds()
+}
+
+// refreshBounds computes the bounds of the shard from its uids. The caller
+// must hold mu.
+func (sh *shard) refreshBounds() {
+	oldest, newest := int64(math.MaxInt64), int64(math.MinInt64)
+	sh.each(func(uid string, s *series) bool {
+		if s.len() > 0 {
+			oldest = min(oldest, s.firstTimestamp())
+			newest = max(newest, s.lastTimestamp())
+		}
+		return true
+	})
+	sh.oldest.Store(oldest)
+	sh.newest.Store(newest)
 }
 
 type Database struct {
-	data       map[string]RecordHeader
-	name       string
-	ttl        int64 // hours
-	stopChan   chan struct{}
-	mu         sync.RWMutex // To protect access to data
-	storageDir string
+	shards      []*shard
+	sortedUids  uidSet // every uid in lexical order, for ListUids
+	name        string
+	config      atomic.Pointer[Collection] // the pattern this database matched, its ttl in hours and limits
+	dropped     atomic.Bool                // set by Drop, inserts are refused afterwards
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+	gen         atomic.Uint64     // incremented on every write
+	flushMu     sync.Mutex        // serializes flushes with deletions on disk
+	manifest    *manifest         // protected by flushMu
+	flushedGen  map[string]uint64 // uid -> generation written to disk, protected by flushMu
+	storageDir  string
+	payloads    *payloadCache // decoded payloads used by filters
+	uidCount    atomic.Int64
+	recordCount atomic.Int64                  // number of records across all uids
+	bytesOnDisk atomic.Int64                  // size of all flushed files
+	memoryBytes atomic.Int64                  // estimated memory used by the records
+	budget      *memoryBudget                 // shared memory limit, nil when unlimited
+	coldUids    atomic.Int64                  // uids registered from the index and not loaded yet
+	rollups     atomic.Pointer[[]*rollupTier] // downsampling tiers sorted by resolution
+	rollupMu    sync.Mutex                    // serializes changes of the tiers
+	schema      atomic.Pointer[jsonSchema]    // JSON schema of the payloads, nil without one
+	metrics     collectionMetrics
+
+	loadConcurrency int // number of uids read in parallel by Load
+}
+
+// CollectionStats is the bookkeeping of a database, maintained on insert
+type CollectionStats struct {
+	Uids        int
+	Records     int
+	Oldest      int64
+	Newest      int64
+	BytesOnDisk int64
+	MemoryBytes int64
+}
+
+// UidStats is the bookkeeping of a single uid
+type UidStats struct {
+	Uid     string `json:"uid"`
+	First   int64  `json:"first"`
+	Last    int64  `json:"last"`
+	Records int    `json:"records"`
+}
+
+// collectionMetrics counts the outcomes of the inserts into a collection
+type collectionMetrics struct {
+	inserted atomic.Int64 // records inserted
+	valid    atomic.Int64 // records that passed the validation of the type or schema
+	invalid  atomic.Int64 // records refused by the validation
+
+	clamped    atomic.Int64 // timestamps moved to the time limits
+	outOfRange atomic.Int64 // records refused for a timestamp beyond the time limits
 }
 
 // NewDatabase creates a new instance of Database
 func NewDatabase(name string, storageDir string, ttl int64) *Database {
+	return newDatabase(name, storageDir, ttl, shardCount)
+}
 
+func newDatabase(name string, storageDir string, ttl int64, shards int) *Database {
+	db := emptyDatabase(name, storageDir, ttl, shards)
+	if err := db.Load(); err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func emptyDatabase(name string, storageDir string, ttl int64, shards int) *Database {
 	db := &Database{
-		data:       make(map[string]RecordHeader),
+		shards:     make([]*shard, shards),
 		name:       name,
-		ttl:        ttl,
 		stopChan:   make(chan struct{}),
 		storageDir: storageDir,
+		payloads:   newPayloadCache(payloadCacheSize),
+		manifest:   newManifest(),
+		flushedGen: make(map[string]uint64),
+
+		loadConcurrency: defaultLoadConcurrency(),
+	}
+	for i := range db.shards {
+		db.shards[i] = newShard()
 	}
+	db.config.Store(&Collection{TTL: int(ttl)})
+	return db
+}
 
-	if err := db.Load(); err != nil {
-		log.Fatal(err)
+// configure applies the configuration of the pattern the database matches
+func (db *Database) configure(collection Collection, opts storageOptions) {
+	db.config.Store(&collection)
+	// the unit only changes while the collection has no records
+	db.flushMu.Lock()
+	db.manifest.Unit = unitName(collection.Unit)
+	db.flushMu.Unlock()
+	var schema *jsonSchema
+	if len(collection.JSONSchema) > 0 {
+		// validated with the collection
+		schema, _ = compileSchema(collection.JSONSchema)
 	}
+	db.schema.Store(schema)
+	db.setRollups(collection.Rollups, opts)
+}
 
-	return db
+// shardFor returns the shard owning the uid
+func (db *Database) shardFor(uid string) *shard {
+	return db.shards[uidHash(uid)%uint32(len(db.shards))]
 }
 
-func (db *Database) insert(uid string, ts int64, data string, isNew bool) {
-	// Create the record
-	record := Record{
-		Timestamp: ts,
-		Data:      data,
-		isNew:     isNew,
+// uidHash hashes a uid with FNV-1a
+func uidHash(uid string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(uid); i++ {
+		hash ^= uint32(uid[i])
+		hash *= 16777619
 	}
+	return hash
+}
 
-	// Ensure the user's data slice exists
-	if _, exists := db.data[uid]; !exists {
-		db.data[uid] = RecordHeader{
-			hasChanged: isNew,
-			records:    []Record{record},
-		}
-		return
+// insert adds a record to the uid and returns the record it replaced, if
+// any. With keepAll records with the same timestamp are kept. The caller
+// must hold the lock of its shard.
+func (db *Database) insert(sh *shard, uid string, record Record, isNew bool, keepAll bool) (*Record, error) {
+	// new records get a generation so Flush can find them
+	if isNew {
+		record.gen = db.gen.Add(1)
 	}
 
-	records := db.data[uid]
-	// Insert the record in the correct position in the slice (chronologically sorted)
-	n := len(records.records)
-	// Binary search for the correct insertion point
-	left, right := 0, n-1
-	for left <= right {
-		mid := (left + right) / 2
-		if records.records[mid].Timestamp < ts {
-			left = mid + 1
-		} else if records.records[mid].Timestamp > ts {
-			right = mid - 1
-		} else {
-			records.records[mid] = record
-			return
-		}
-	}
-
-	// If not found, insert at the found index
-	db.data[uid] = RecordHeader{
-		hasChanged: isNew,
-		records:    append(records.records[:left], append([]Record{record}, records.records[left:]...)...),
-	}
-}
-
-// Insert inserts a new record for a user, maintaining chronological order
-func (db *Database) Insert(uid string, ts int64, data string) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	db.insert(uid, ts, data, true)
-}
-
-// getEarliestUserRecordIndex performs a binary search to find the index of the earliest record
-// that has a timestamp >= minTimestamp. The records are assumed to be sorted by timestamp.
-//
-// Edge cases:
-//  1. If minTimestamp is less than all records' timestamps, returns 0 (first record)
-//     since all records will be >= minTimestamp
-//  2. If minTimestamp is greater than all records' timestamps, returns -1 since no records
-//     will be >= minTimestamp
-//  3. If no records exist for the user, returns -1
-//  4. If multiple records have the same timestamp >= minTimestamp, returns the leftmost/earliest one
-func (db *Database) getEarliestUserRecordIndex(uid string, minTimestamp int64) int {
-
-	if records, exists := db.data[uid]; exists {
-		// Binary search for the earliest record after minTimestamp
-		left, right := 0, len(records.records)-1
-		var earliestIndex int
-		for left <= right {
-			mid := (left + right) / 2
-			if records.records[mid].Timestamp >= minTimestamp {
-				earliestIndex = mid
-				right = mid - 1
-			} else {
-				left = mid + 1
-			}
-		}
+	// Ensure the user's series exists
+	s := sh.get(uid)
+	if s == nil {
+		s = &series{}
+		sh.uids.Store(uid, s)
+		db.sortedUids.add(uid)
+		db.uidCount.Add(1)
+	}
+	before := s.bytes
+	replaced, err := s.put(record, keepAll)
+	db.trackMemory(s.bytes - before)
+	if err == nil {
+		sh.widen(record.Timestamp, record.Timestamp)
+	}
+	if replaced == nil && err == nil {
+		db.recordCount.Add(1)
+	}
+	return replaced, err
+}
 
-		return earliestIndex
+// removeSeries removes a uid from its shard, the caller must hold the lock of
+// the shard and update its bounds
+func (db *Database) removeSeries(sh *shard, uid string, s *series) {
+	sh.uids.Delete(uid)
+	db.sortedUids.remove(uid)
+	db.untrackSeries(s)
+}
+
+// untrackSeries removes a series from the bookkeeping of the database
+func (db *Database) untrackSeries(s *series) {
+	db.uidCount.Add(-1)
+	db.recordCount.Add(-int64(s.len()))
+	db.bytesOnDisk.Add(-s.bytesOnDisk)
+	db.trackMemory(-s.bytes)
+	if s.cold.Load() != nil {
+		db.coldUids.Add(-1)
 	}
-	return -1
 }
 
-// getLatestUserRecordIndex performs a binary search to find the index of the latest record
-// that has a timestamp <= maxTimestamp. The records are assumed to be sorted by timestamp.
-//
-// Edge cases:
-//  1. If maxTimestamp is greater than all records' timestamps, returns the last record's index
-//     since it will be the latest record <= maxTimestamp
-//  2. If maxTimestamp is less than the first record's timestamp, returns -1 since no records
-//     will be <= maxTimestamp
-//  3. If no records exist for the user, returns -1
-//  4. If multiple records have the same timestamp <= maxTimestamp, returns the rightmost/latest one
-func (db *Database) getLatestUserRecordIndex(uid string, maxTimestamp int64) int {
+// Insert inserts a new record for a user, maintaining chronological order.
+// A record with the timestamp of an existing one is handled with the
+// conflict policy of the collection. It fails when the memory limit or a
+// limit of the collection is reached, when the collection was dropped or the
+// payload doesn't match the type of the collection. The rollups of the
+// collection are updated once the record is inserted.
+func (db *Database) Insert(uid string, ts int64, data string) error {
+	_, err := db.insertRecord(uid, ts, data)
+	return err
+}
 
-	if records, exists := db.data[uid]; exists {
-		// Binary search for the latest record up to maxTimestamp
-		left, right := 0, len(records.records)-1
-		var latestIndex int
+// insertOutcome is what an insert did with its record
+type insertOutcome struct {
+	status   string  // accepted, overwrote, merged or ignored
+	record   Record  // the record stored, with its generation
+	replaced *Record // the record with the same timestamp that was replaced
+	clamped  bool    // the timestamp was moved to the time limits of the collection
+}
 
-		for left <= right {
-			mid := (left + right) / 2
-			if records.records[mid].Timestamp <= maxTimestamp {
-				latestIndex = mid
-				left = mid + 1
-			} else {
-				right = mid - 1
+// insertRecord inserts a record like Insert and returns what it did
+func (db *Database) insertRecord(uid string, ts int64, data string) (insertOutcome, error) {
+	outcome, err := db.insertChecked(uid, ts, data)
+	if err != nil {
+		return outcome, err
+	}
+	db.updateRollups(uid, outcome)
+	return outcome, nil
+}
+
+// insertChecked inserts a record without updating the rollups. Timestamps
+// beyond the time limits of the collection are refused or clamped first.
+// Records of collections merging conflicts are validated once merged, and
+// when they don't fit in the memory limit the lock of the shard is released
+// to reclaim memory before merging them again.
+func (db *Database) insertChecked(uid string, ts int64, data string) (insertOutcome, error) {
+	config := db.config.Load()
+	ts, clamped, err := db.checkTimestamp(ts)
+	if err != nil {
+		return insertOutcome{}, err
+	}
+	var record Record
+	if config.Conflict != conflictMerge {
+		if record, err = db.validateRecord(ts, data); err != nil {
+			return insertOutcome{}, err
+		}
+		if db.budget != nil && !db.budget.allow(recordSize(record)) {
+			return insertOutcome{}, db.memoryLimitError()
+		}
+	}
+	sh := db.shardFor(uid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	var s *series
+	var existing *Record
+	for reclaimed := false; ; reclaimed = true {
+		if db.dropped.Load() {
+			return insertOutcome{}, fmt.Errorf("%w: %s", ErrCollectionDropped, db.name)
+		}
+		s = sh.get(uid)
+		if s != nil && s.cold.Load() != nil {
+			s = db.hydrateLocked(sh, uid, s)
+		}
+		existing = nil
+		if s != nil && (config.Conflict == conflictFirst || config.Conflict == conflictMerge) {
+			existing = s.at(ts)
+		}
+		if config.Conflict != conflictMerge {
+			break
+		}
+		merged := data
+		if existing != nil {
+			if merged, err = mergePayloads(existing.payload(), data); err != nil {
+				return insertOutcome{}, err
 			}
 		}
+		if record, err = db.validateRecord(ts, merged); err != nil {
+			return insertOutcome{}, err
+		}
+		if db.budget == nil || db.budget.fits(recordSize(record)) {
+			break
+		}
+		if reclaimed {
+			return insertOutcome{}, db.memoryLimitError()
+		}
+		// reclaiming takes the locks of the shards, the record is merged
+		// again once the lock is taken back
+		sh.mu.Unlock()
+		allowed := db.budget.allow(recordSize(record))
+		sh.mu.Lock()
+		if !allowed {
+			return insertOutcome{}, db.memoryLimitError()
+		}
+	}
+	if config.Conflict == conflictFirst && existing != nil {
+		return insertOutcome{status: insertIgnored, record: *existing, clamped: clamped}, nil
+	}
 
-		return latestIndex
+	if err := db.checkLimits(uid, s, ts); err != nil {
+		return insertOutcome{}, err
+	}
+	// the generation is given here so the outcome has it, undoing a record
+	// kept next to others of its timestamp needs it
+	record.gen = db.gen.Add(1)
+	replaced, err := db.insert(sh, uid, record, false, config.Conflict == conflictAll)
+	if err != nil {
+		return insertOutcome{}, err
+	}
+	db.metrics.inserted.Add(1)
+	outcome := insertOutcome{status: insertAccepted, record: record, replaced: replaced, clamped: clamped}
+	if replaced != nil {
+		outcome.status = insertOverwrote
+		if existing != nil {
+			outcome.status = insertMerged
+		}
+	}
+	return outcome, nil
+}
+
+// checkLimits refuses inserts that would add a uid or a record beyond the
+// limits of the collection. The uid limit is checked against the count of
+// all shards, concurrent inserts of new uids can exceed it slightly.
+func (db *Database) checkLimits(uid string, s *series, ts int64) error {
+	config := db.config.Load()
+	if s == nil && config.MaxUids > 0 && db.uidCount.Load() >= int64(config.MaxUids) {
+		return fmt.Errorf("%w: %s has %d uids", ErrCollectionLimit, db.name, config.MaxUids)
+	}
+	if s == nil || config.MaxRecordsPerUid == 0 || s.len() < config.MaxRecordsPerUid {
+		return nil
 	}
-	return -1
+	// a record replacing the one of its timestamp doesn't grow the uid
+	if config.Conflict != conflictAll && s.at(ts) != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: uid %s of %s has %d records", ErrCollectionLimit, uid, db.name, config.MaxRecordsPerUid)
 }
 
+// GetLatestRecordForUser returns the latest record with a timestamp <= maxTimestamp.
+// Queries for the current latest record don't take any lock.
 func (db *Database) GetLatestRecordForUser(uid string, maxTimestamp int64) *Record {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	index := db.getLatestUserRecordIndex(uid, maxTimestamp)
-	if index == -1 {
+	sh := db.shardFor(uid)
+	s := sh.get(uid)
+	if s == nil {
+		return nil
+	}
+	if latest := s.latest.Load(); latest != nil && latest.Timestamp <= maxTimestamp {
+		record := *latest
+		return &record
+	}
+	db.hydrate(sh, uid)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if s = sh.get(uid); s == nil {
 		return nil
 	}
-	return &db.data[uid].records[index]
+	return s.latestBefore(maxTimestamp)
 }
 
 func (db *Database) GetEarliestRecordForUser(uid string, minTimestamp int64) *Record {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	index := db.getEarliestUserRecordIndex(uid, minTimestamp)
-	if index == -1 {
+	sh := db.shardFor(uid)
+	db.hydrate(sh, uid)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	s := sh.get(uid)
+	if s == nil {
 		return nil
 	}
-	return &db.data[uid].records[index]
+	return s.earliestAfter(minTimestamp)
 }
 
+// GetAllLatestRecords returns the latest record of every uid with a timestamp
+// <= maxTimestamp. Uids whose latest record qualifies are read without locking,
+// the others take the read lock of their shard. Uids that aren't loaded yet
+// are loaded.
 func (db *Database) GetAllLatestRecords(maxTimestamp int64) map[string]*Record {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
 	latestRecords := make(map[string]*Record)
-	for uid := range db.data {
-		index := db.getLatestUserRecordIndex(uid, maxTimestamp)
-		if index == -1 {
-			continue
-		}
-		latestRecords[uid] = &db.data[uid].records[index]
+	for _, sh := range db.shards {
+		sh.each(func(uid string, s *series) bool {
+			if latest := s.latest.Load(); latest != nil && latest.Timestamp <= maxTimestamp {
+				record := *latest
+				latestRecords[uid] = &record
+				return true
+			}
+			db.hydrate(sh, uid)
+			sh.mu.RLock()
+			var record *Record
+			if s := sh.get(uid); s != nil {
+				record = s.latestBefore(maxTimestamp)
+			}
+			sh.mu.RUnlock()
+			if record != nil {
+				latestRecords[uid] = record
+			}
+			return true
+		})
 	}
 	return latestRecords
 }
@@ -205,76 +467,357 @@ func (db *Database) GetRecordsForUser(uid string, from int64, to int64) []Record
 	}
 
 	// acquire read lock to safely access data
-	db.mu.RLock()
+	sh := db.shardFor(uid)
+	db.hydrate(sh, uid)
+	sh.mu.RLock()
 	// defer unlock until function returns
-	defer db.mu.RUnlock()
+	defer sh.mu.RUnlock()
 
-	// Check if user exists in database
-	records, exists := db.data[uid]
 	// return nil if user not found
-	if !exists {
-		// return empty slice if user not found
+	s := sh.get(uid)
+	if s == nil {
 		return nil
 	}
 
-	// Check if there are any records
-	if len(records.records) == 0 {
-		// return empty slice if no records exist
-		return []Record{}
+	// copy the records between from and to
+	return s.rangeRecords(from, to)
+}
+
+// FilterRecords returns the records whose payload matches the filter
+func (db *Database) FilterRecords(records []Record, filter *Filter) []Record {
+	if filter == nil {
+		return records
 	}
+	result := make([]Record, 0, len(records))
+	for _, record := range records {
+		if filter.Match(record.payload(), db.payloads) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
 
-	// get index of earliest record after from
-	startIndex := db.getEarliestUserRecordIndex(uid, from)
-	// get index of latest record before to
-	endIndex := db.getLatestUserRecordIndex(uid, to)
+// FilterLatestRecords removes the uids whose record doesn't match the filter
+func (db *Database) FilterLatestRecords(records map[string]*Record, filter *Filter) map[string]*Record {
+	if filter == nil {
+		return records
+	}
+	result := make(map[string]*Record, len(records))
+	for uid, record := range records {
+		if record != nil && filter.Match(record.payload(), db.payloads) {
+			result[uid] = record
+		}
+	}
+	return result
+}
 
-	// return nil if either index is invalid
-	if startIndex == -1 || endIndex == -1 {
-		// return empty slice if either index is invalid
-		return []Record{}
+// Stats returns the bookkeeping of the database without scanning the records,
+// the oldest and newest timestamps come from the bounds of the shards
+func (db *Database) Stats() CollectionStats {
+	stats := CollectionStats{
+		Uids:        int(db.uidCount.Load()),
+		Records:     int(db.recordCount.Load()),
+		BytesOnDisk: db.bytesOnDisk.Load(),
+		MemoryBytes: db.memoryBytes.Load(),
 	}
+	oldest, newest := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, sh := range db.shards {
+		oldest = min(oldest, sh.oldest.Load())
+		newest = max(newest, sh.newest.Load())
+	}
+	if oldest <= newest {
+		stats.Oldest, stats.Newest = oldest, newest
+	}
+	return stats
+}
 
-	// Check if startIndex is after endIndex
-	if startIndex > endIndex {
-		// return empty slice if indices are in wrong order
-		return []Record{}
+// ListUids returns the uids starting with prefix in lexical order. Pagination
+// starts after the uid given in after, and the uid to continue from is
+// returned when there are more results.
+func (db *Database) ListUids(prefix string, after string, limit int) ([]UidStats, string) {
+	uids, more := db.sortedUids.page(prefix, after, limit)
+	next := ""
+	if more {
+		next = uids[len(uids)-1]
 	}
 
-	// Create new slice to avoid modifying original data
-	result := make([]Record, endIndex-startIndex+1)
-	// copy records between start and end indices
-	copy(result, records.records[startIndex:endIndex+1])
-	// return the copied records
-	return result
+	result := make([]UidStats, 0, len(uids))
+	for _, uid := range uids {
+		sh := db.shardFor(uid)
+		sh.mu.RLock()
+		if s := sh.get(uid); s != nil && s.len() > 0 {
+			result = append(result, UidStats{
+				Uid:     uid,
+				First:   s.firstTimestamp(),
+				Last:    s.lastTimestamp(),
+				Records: s.len(),
+			})
+		}
+		sh.mu.RUnlock()
+	}
+	return result, next
 }
 
 func (db *Database) Delete(uid string) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	delete(db.data, uid)
-	os.RemoveAll(path.Join(db.storageDir, db.name, uid))
+	for _, tier := range db.rollupTiers() {
+		tier.db.Delete(uid)
+	}
+
+	// hold the flush lock so a concurrent flush can't write the uid back
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	sh := db.shardFor(uid)
+	sh.mu.Lock()
+	if s := sh.get(uid); s != nil {
+		db.removeSeries(sh, uid, s)
+		if s.len() > 0 {
+			sh.shrink(s.firstTimestamp(), s.lastTimestamp())
+		}
+	}
+	sh.mu.Unlock()
+
+	delete(db.flushedGen, uid)
+	db.removeUids([]string{uid})
 }
 
-// delete all records if the last timestamp is older than maxTimestamp
-func (db *Database) DeleteOld() {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	maxTimestamp := time.Now().Unix() - db.ttl*60*60
+// removeUids removes the flushed files of the uids. A tombstone is written to
+// the manifest first, so a deletion interrupted by a crash is completed by
+// the next Load. The caller must hold flushMu.
+func (db *Database) removeUids(uids []string) {
+	if db.storageDir == "" {
+		return
+	}
+	dir := path.Join(db.storageDir, db.name)
+
+	pending := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		delete(db.manifest.Index, uid)
+		if _, err := os.Stat(path.Join(dir, uid)); err == nil {
+			pending = append(pending, uid)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for _, uid := range pending {
+		db.manifest.Tombstones[uid] = now
+	}
+	if err := db.manifest.write(dir); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
+
+	for _, uid := range pending {
+		if err := os.RemoveAll(path.Join(dir, uid)); err != nil {
+			// keep the tombstone, Load finishes the deletion
+			log.Printf("Error removing directory for user %s: %v", uid, err)
+			continue
+		}
+		delete(db.manifest.Tombstones, uid)
+	}
+	if err := db.manifest.write(dir); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
+}
+
+// DeleteRecords removes the records of a uid with from <= timestamp <= to and
+// returns how many were removed. The flushed files of the uid are rewritten
+// so the records don't come back on the next Load, and retracted from the
+// rollups.
+func (db *Database) DeleteRecords(uid string, from int64, to int64) (int, error) {
+	deleted, removed, err := db.deleteRecords(uid, from, to)
+	// rollups are updated without the flush lock, inserting into the tiers
+	// may reclaim memory
+	db.retractRollups(uid, removed)
+	return deleted, err
+}
+
+// deleteRecords removes the records like DeleteRecords and returns the
+// removed records when the collection has rollups
+func (db *Database) deleteRecords(uid string, from int64, to int64) (int, []Record, error) {
+	if from > to {
+		return 0, nil, fmt.Errorf("from %d is after to %d", from, to)
+	}
+
+	// hold the flush lock so a concurrent flush can't write the records back
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	sh := db.shardFor(uid)
+	db.hydrate(sh, uid)
+	sh.mu.Lock()
 	deleted := 0
-	for uid := range db.data {
-		records := db.data[uid]
-		// if last record is older than maxTimestamp, delete all records
-		if records.records[len(records.records)-1].Timestamp < maxTimestamp {
-			delete(db.data, uid)
-			deleted++
-			if db.storageDir == "" {
-				continue
+	var removed []Record
+	if s := sh.get(uid); s != nil {
+		if len(db.rollupTiers()) > 0 {
+			removed = s.rangeRecords(from, to)
+		}
+		before := s.bytes
+		var err error
+		deleted, err = s.deleteRange(from, to)
+		// records are removed in order, an error stops it part way
+		removed = removed[:min(deleted, len(removed))]
+		db.trackMemory(s.bytes - before)
+		db.recordCount.Add(-int64(deleted))
+		if err == nil && s.len() == 0 {
+			db.removeSeries(sh, uid, s)
+		}
+		if deleted > 0 {
+			sh.shrink(from, to)
+		}
+		if err != nil {
+			sh.mu.Unlock()
+			return deleted, removed, err
+		}
+	}
+	sh.mu.Unlock()
+
+	if db.storageDir == "" {
+		return deleted, removed, nil
+	}
+
+	delta, err := rewriteUserFiles(path.Join(db.storageDir, db.name, uid), func(record Record) bool {
+		return record.Timestamp < from || record.Timestamp > to
+	})
+
+	sh.mu.Lock()
+	if s := sh.get(uid); s != nil {
+		s.bytesOnDisk += delta
+		db.bytesOnDisk.Add(delta)
+	}
+	// only flushed uids are in the index
+	_, indexed := db.manifest.Index[uid]
+	updateIndex := indexed && deleted > 0
+	if updateIndex {
+		if s := sh.get(uid); s != nil {
+			db.manifest.Index[uid] = s.indexEntry()
+		} else {
+			delete(db.manifest.Index, uid)
+		}
+	}
+	sh.mu.Unlock()
+	if updateIndex {
+		if err := db.manifest.write(path.Join(db.storageDir, db.name)); err != nil {
+			log.Println("Error writing manifest:", err)
+		}
+	}
+
+	return deleted, removed, err
+}
+
+// rewriteUserFiles rewrites the flushed files of a uid keeping only the
+// records for which keep returns true. Files left without records are
+// removed. It returns the change in bytes on disk.
+func rewriteUserFiles(dir string, keep func(Record) bool) (int64, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+
+	var delta int64
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		filePath := path.Join(dir, file.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return delta, fmt.Errorf("error reading file %s: %w", filePath, err)
+		}
+		var records []Record
+		if err := json.Unmarshal(data, &records); err != nil {
+			log.Printf("Error unmarshaling data from %s: %v", filePath, err)
+			continue
+		}
+
+		kept := records[:0]
+		for _, record := range records {
+			if keep(record) {
+				kept = append(kept, record)
 			}
-			os.RemoveAll(path.Join(db.storageDir, db.name, uid))
 		}
+		if len(kept) == len(records) {
+			continue
+		}
+
+		if len(kept) == 0 {
+			if err := os.Remove(filePath); err != nil {
+				return delta, fmt.Errorf("error removing file %s: %w", filePath, err)
+			}
+			delta -= int64(len(data))
+			continue
+		}
+
+		jsonData, err := json.Marshal(kept)
+		if err != nil {
+			return delta, fmt.Errorf("error marshaling data for %s: %w", filePath, err)
+		}
+		if err := writeFileAtomic(filePath, jsonData); err != nil {
+			return delta, err
+		}
+		delta += int64(len(jsonData)) - int64(len(data))
 	}
+	return delta, nil
+}
+
+// writeFileAtomic writes the file through a temporary file and a rename so a
+// crash never leaves a partially written file behind
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing file %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error renaming file %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// delete all records if the last timestamp is older than maxTimestamp
+func (db *Database) DeleteOld() {
+	// tiers expire with their own ttl
+	for _, tier := range db.rollupTiers() {
+		tier.db.DeleteOld()
+	}
+
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	config := db.config.Load()
+	maxTimestamp := db.now() - int64(config.TTL)*60*60*unitsPerSecond(config.Unit)
+	var expired []string
+	for _, sh := range db.shards {
+		sh.mu.Lock()
+		sh.each(func(uid string, s *series) bool {
+			// the index may be behind the files, check the records before deleting
+			if s.cold.Load() != nil && s.lastTimestamp() < maxTimestamp {
+				if s = db.hydrateLocked(sh, uid, s); s == nil {
+					expired = append(expired, uid)
+					return true
+				}
+			}
+			// if last record is older than maxTimestamp, delete all records
+			if s.len() == 0 || s.lastTimestamp() < maxTimestamp {
+				db.removeSeries(sh, uid, s)
+				delete(db.flushedGen, uid)
+				expired = append(expired, uid)
+			}
+			return true
+		})
+		sh.refreshBounds()
+		sh.mu.Unlock()
+	}
+
+	db.removeUids(expired)
+	deleted := len(expired)
 	if deleted > 0 {
-		log.Println("Deleted", deleted, "records older than", time.Unix(maxTimestamp, 0).Format("2006-01-02 15:04:05"))
+		log.Println("Deleted", deleted, "records older than", unixTime(maxTimestamp, config.Unit).Format("2006-01-02 15:04:05"))
 	}
 }
 
@@ -286,31 +829,48 @@ func (db *Database) Flush() error {
 		return nil
 	}
 
+	for _, tier := range db.rollupTiers() {
+		if err := tier.db.Flush(); err != nil {
+			return err
+		}
+	}
+
 	log.Println("Maybe flushing data to disk")
 
-	db.mu.RLock()
-	// find all records that are new
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	if db.dropped.Load() {
+		return nil
+	}
+
+	// find all records written since the last flush of each uid, records
+	// overwritten after this point get a newer generation and are picked
+	// up by the next flush
 	updatedRecords := make(map[string][]Record)
+	flushingGen := make(map[string]uint64)
 	recordCount := 0
-	for uid, records := range db.data {
-		if !records.hasChanged {
-			continue
-		}
-		for i, record := range records.records {
-			if record.isNew {
-				updatedRecords[uid] = append(updatedRecords[uid], record)
-				records.records[i].isNew = false
-				recordCount += 1
+	for _, sh := range db.shards {
+		sh.mu.RLock()
+		sh.each(func(uid string, s *series) bool {
+			flushed := db.flushedGen[uid]
+			if s.lastGen <= flushed {
+				return true
 			}
-		}
+			records := s.writtenSince(flushed)
+			updatedRecords[uid] = records
+			recordCount += len(records)
+			flushingGen[uid] = s.lastGen
+			return true
+		})
+		sh.mu.RUnlock()
 	}
-	db.mu.RUnlock()
 	log.Println("Found", recordCount, "new records")
 	if recordCount == 0 {
 		log.Println("No new records found, skipping flush")
 		return nil
 	}
-	timestamp := time.Now().Unix()
+	// nanoseconds so two flushes within the same second don't overwrite each other
+	timestamp := time.Now().UnixNano()
 
 	for uid := range updatedRecords {
 
@@ -331,8 +891,22 @@ func (db *Database) Flush() error {
 			log.Println("Error writing file:", err)
 			continue
 		}
+		db.flushedGen[uid] = flushingGen[uid]
+
+		sh := db.shardFor(uid)
+		sh.mu.Lock()
+		// the uid may have been deleted while flushing
+		if s := sh.get(uid); s != nil {
+			s.bytesOnDisk += int64(len(jsonData))
+			db.bytesOnDisk.Add(int64(len(jsonData)))
+			db.manifest.Index[uid] = s.indexEntry()
+		}
+		sh.mu.Unlock()
 	}
 
+	if err := db.manifest.write(path.Join(db.storageDir, db.name)); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
 	return nil
 }
 
@@ -349,6 +923,16 @@ func (db *Database) Load() error {
 		return nil // Directory doesn't exist yet, that's ok
 	}
 
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	db.manifest = m
+	db.completeDeletions()
+
 	// Get all user directories
 	userDirs, err := os.ReadDir(dir)
 	if err != nil {
@@ -356,59 +940,149 @@ func (db *Database) Load() error {
 		return fmt.Errorf("error reading directory %s: %w", dir, err)
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	var uids []string
+	for _, userDir := range userDirs {
+		if userDir.IsDir() {
+			uids = append(uids, userDir.Name())
+		}
+	}
+	db.loadUids(dir, uids)
+
+	// rebuild the index so the next start can be lazy
+	clear(db.manifest.Index)
+	for _, sh := range db.shards {
+		sh.each(func(uid string, s *series) bool {
+			db.manifest.Index[uid] = s.indexEntry()
+			return true
+		})
+	}
+	if err := db.manifest.write(dir); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
 
-	recordCount := 0
+	return nil
+}
 
-	// For each user directory
-	for _, userDir := range userDirs {
-		if !userDir.IsDir() {
+// readUidFiles calls fn with the records and the size of every flushed file
+// of a uid. Chunks evicted by a previous run are removed, their records are
+// also in the flushed files.
+func readUidFiles(dir string, fn func(records []Record, size int64)) error {
+	if err := os.RemoveAll(path.Join(dir, evictedDir)); err != nil {
+		log.Printf("Error removing evicted chunks in %s: %v", dir, err)
+	}
+
+	// Get all JSON files in user directory
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
 			continue
 		}
-		uid := userDir.Name()
 
-		// Get all JSON files in user directory
-		files, err := os.ReadDir(path.Join(dir, uid))
+		filePath := path.Join(dir, file.Name())
+		data, err := os.ReadFile(filePath)
 		if err != nil {
-			log.Printf("Error reading directory for user %s: %v", uid, err)
+			log.Printf("Error reading file %s: %v", filePath, err)
 			continue
 		}
 
-		// Read and process each file
-		for _, file := range files {
-			if !strings.HasSuffix(file.Name(), ".json") {
-				continue
-			}
-
-			filePath := path.Join(dir, uid, file.Name())
-			data, err := os.ReadFile(filePath)
-			if err != nil {
-				log.Printf("Error reading file %s: %v", filePath, err)
-				continue
-			}
-
-			var records []Record
-			if err := json.Unmarshal(data, &records); err != nil {
-				log.Printf("Error unmarshaling data from %s: %v", filePath, err)
-				continue
-			}
-
-			// Insert each record
-			for _, record := range records {
-				db.insert(uid, record.Timestamp, record.Data, false)
-				recordCount += 1
-			}
+		var records []Record
+		if err := json.Unmarshal(data, &records); err != nil {
+			log.Printf("Error unmarshaling data from %s: %v", filePath, err)
+			continue
+		}
+		if len(records) == 0 {
+			continue
 		}
+		fn(records, int64(len(data)))
 	}
-
-	log.Println("Loaded", recordCount, "records from", db.name)
-
 	return nil
 }
 
+// completeDeletions removes the files left behind by deletions that were
+// interrupted. Files flushed after the deletion are kept. The caller must
+// hold flushMu.
+func (db *Database) completeDeletions() {
+	if len(db.manifest.Tombstones) == 0 {
+		return
+	}
+	dir := path.Join(db.storageDir, db.name)
+	for uid, deletedAt := range db.manifest.Tombstones {
+		if err := removeFilesBefore(path.Join(dir, uid), deletedAt); err != nil {
+			log.Printf("Error completing deletion of user %s: %v", uid, err)
+			continue
+		}
+		log.Println("Completed deletion of user", uid, "in", db.name)
+		delete(db.manifest.Tombstones, uid)
+	}
+	if err := db.manifest.write(dir); err != nil {
+		log.Println("Error writing manifest:", err)
+	}
+}
+
 func (db *Database) Stop() {
-	if db.stopChan != nil {
+	db.stopOnce.Do(func() {
 		close(db.stopChan)
+	})
+	for _, tier := range db.rollupTiers() {
+		tier.db.Stop()
+	}
+}
+
+// close stops a database that is discarded without being used, the memory
+// of its records and of its rollups goes back to the budget. Its directory
+// is left as it is.
+func (db *Database) close() {
+	db.Stop()
+	for _, tier := range db.rollupTiers() {
+		tier.db.close()
+	}
+	if db.budget != nil {
+		db.budget.detach(db)
+		db.budget.used.Add(-db.memoryBytes.Load())
 	}
 }
+
+// Drop stops the database, removes its records from memory and its
+// directory from disk. The directory is renamed first, so a drop interrupted
+// by a crash leaves a hidden directory that is never loaded.
+func (db *Database) Drop() error {
+	db.dropped.Store(true)
+	db.Stop()
+	db.dropRollups()
+	// before taking flushMu, reclaims take it while holding the lock of the budget
+	if db.budget != nil {
+		db.budget.detach(db)
+	}
+
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	for _, sh := range db.shards {
+		sh.mu.Lock()
+		sh.each(func(uid string, s *series) bool {
+			db.removeSeries(sh, uid, s)
+			return true
+		})
+		sh.refreshBounds()
+		sh.mu.Unlock()
+	}
+	db.flushedGen = make(map[string]uint64)
+
+	if db.storageDir == "" {
+		return nil
+	}
+	dir := path.Join(db.storageDir, db.name)
+	trash := path.Join(db.storageDir, fmt.Sprintf("%s%s-%d", droppedDirPrefix, db.name, time.Now().UnixNano()))
+	if err := os.Rename(dir, trash); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error removing directory %s: %w", dir, err)
+	}
+	if err := os.RemoveAll(trash); err != nil {
+		return fmt.Errorf("error removing directory %s: %w", trash, err)
+	}
+	return nil
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func createRecords(database *Database, uid string, count int) []Record {
@@ -14,7 +23,7 @@ func createRecords(database *Database, uid string, count int) []Record {
 }
 
 func TestGetLatest(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 15)
@@ -40,7 +49,7 @@ func TestGetLatest(t *testing.T) {
 }
 
 func TestGetLatestUpTo(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 15)
@@ -65,7 +74,7 @@ func TestGetLatestUpTo(t *testing.T) {
 }
 
 func TestGetRecordsForUserRange(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 1500)
@@ -97,7 +106,7 @@ func TestGetRecordsForUserRange(t *testing.T) {
 }
 
 func TestGetRecordsForUserOutOfRangeHigh(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 1500)
@@ -109,7 +118,7 @@ func TestGetRecordsForUserOutOfRangeHigh(t *testing.T) {
 }
 
 func TestGetRecordsForUserOutOfRangeLow(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 1500)
@@ -121,7 +130,7 @@ func TestGetRecordsForUserOutOfRangeLow(t *testing.T) {
 }
 
 func TestGetRecordsForUserOutOfRangeHighAndLow(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 1500)
@@ -133,7 +142,7 @@ func TestGetRecordsForUserOutOfRangeHighAndLow(t *testing.T) {
 }
 
 func TestGetLatestRecordUpTo(t *testing.T) {
-	db := NewDatabase("test", "test", 1)
+	db := NewDatabase("test", t.TempDir(), 1)
 	defer db.Stop()
 
 	createRecords(db, "1", 1500)
@@ -154,3 +163,506 @@ func TestGetLatestRecordUpTo(t *testing.T) {
 	}
 
 }
+
+func TestStats(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+
+	createRecords(db, "1", 15)
+	createRecords(db, "2", 12)
+	db.Insert("3", 20, "test_20")
+	// overwriting a timestamp doesn't add a record
+	db.Insert("3", 20, "test_20_again")
+
+	stats := db.Stats()
+	if stats.Uids != 3 {
+		t.Errorf("Expected 3 uids, got %d", stats.Uids)
+	}
+	if stats.Records != 28 {
+		t.Errorf("Expected 28 records, got %d", stats.Records)
+	}
+	if stats.Oldest != 1 || stats.Newest != 20 {
+		t.Errorf("Expected records from 1 to 20, got %d to %d", stats.Oldest, stats.Newest)
+	}
+
+	db.Delete("1")
+	if stats := db.Stats(); stats.Records != 13 {
+		t.Errorf("Expected 13 records after delete, got %d", stats.Records)
+	}
+
+	// deleting the records at the bounds moves them
+	db.DeleteRecords("2", 1, 1)
+	db.Delete("3")
+	if stats := db.Stats(); stats.Oldest != 2 || stats.Newest != 12 {
+		t.Errorf("Expected records from 2 to 12 after deletes, got %d to %d", stats.Oldest, stats.Newest)
+	}
+	db.Delete("2")
+	if stats := db.Stats(); stats.Oldest != 0 || stats.Newest != 0 {
+		t.Errorf("Expected no bounds without records, got %d to %d", stats.Oldest, stats.Newest)
+	}
+}
+
+func TestListUids(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+
+	createRecords(db, "user-1", 5)
+	createRecords(db, "user-2", 3)
+	createRecords(db, "user-3", 1)
+	createRecords(db, "device-1", 2)
+
+	uids, next := db.ListUids("user-", "", 2)
+	if len(uids) != 2 || uids[0].Uid != "user-1" || uids[1].Uid != "user-2" {
+		t.Fatalf("Expected user-1 and user-2, got %v", uids)
+	}
+	if next != "user-2" {
+		t.Errorf("Expected next to be user-2, got %q", next)
+	}
+	if uids[0].First != 1 || uids[0].Last != 5 || uids[0].Records != 5 {
+		t.Errorf("Unexpected stats for user-1: %+v", uids[0])
+	}
+
+	uids, next = db.ListUids("user-", next, 2)
+	if len(uids) != 1 || uids[0].Uid != "user-3" {
+		t.Fatalf("Expected user-3, got %v", uids)
+	}
+	if next != "" {
+		t.Errorf("Expected no next page, got %q", next)
+	}
+}
+
+func TestStatsBytesOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	createRecords(db, "1", 10)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	written := db.Stats().BytesOnDisk
+	if written == 0 {
+		t.Fatalf("Expected bytes on disk after flush")
+	}
+	db.Stop()
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	if stats := loaded.Stats(); stats.BytesOnDisk != written || stats.Records != 10 {
+		t.Errorf("Expected %d bytes and 10 records after load, got %d bytes and %d records", written, stats.BytesOnDisk, stats.Records)
+	}
+}
+
+func TestDeleteRecords(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+
+	createRecords(db, "1", 10)
+
+	deleted, err := db.DeleteRecords("1", 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected 3 deleted records, got %d", deleted)
+	}
+	records := db.GetRecordsForUser("1", 0, 10)
+	if len(records) != 7 {
+		t.Fatalf("Expected 7 records, got %d", len(records))
+	}
+	if records[1].Timestamp != 2 || records[2].Timestamp != 6 {
+		t.Errorf("Expected records 2 and 6 to be adjacent, got %d and %d", records[1].Timestamp, records[2].Timestamp)
+	}
+
+	// single record
+	if deleted, _ := db.DeleteRecords("1", 8, 8); deleted != 1 {
+		t.Errorf("Expected 1 deleted record, got %d", deleted)
+	}
+	// nothing in range
+	if deleted, _ := db.DeleteRecords("1", 20, 30); deleted != 0 {
+		t.Errorf("Expected 0 deleted records, got %d", deleted)
+	}
+	if _, err := db.DeleteRecords("1", 5, 3); err == nil {
+		t.Errorf("Expected an error when from is after to")
+	}
+	if stats := db.Stats(); stats.Records != 6 {
+		t.Errorf("Expected 6 records, got %d", stats.Records)
+	}
+
+	// deleting everything removes the uid
+	db.DeleteRecords("1", 0, 100)
+	if stats := db.Stats(); stats.Uids != 0 {
+		t.Errorf("Expected no uids, got %d", stats.Uids)
+	}
+}
+
+func TestDeleteRecordsPersist(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	createRecords(db, "1", 5)
+	db.Flush()
+	for i := 6; i <= 10; i++ {
+		db.Insert("1", int64(i), fmt.Sprintf("test_%d", i))
+	}
+	db.Flush()
+
+	// spans both flushed files
+	if _, err := db.DeleteRecords("1", 4, 7); err != nil {
+		t.Fatal(err)
+	}
+	// only in the first file, which is left empty
+	if _, err := db.DeleteRecords("1", 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	db.Stop()
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	records := loaded.GetRecordsForUser("1", 0, 100)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records after reload, got %d", len(records))
+	}
+	if records[0].Timestamp != 8 {
+		t.Errorf("Expected first record to be 8, got %d", records[0].Timestamp)
+	}
+	if stats := loaded.Stats(); stats.BytesOnDisk != db.Stats().BytesOnDisk {
+		t.Errorf("Expected %d bytes on disk, got %d", db.Stats().BytesOnDisk, stats.BytesOnDisk)
+	}
+}
+
+func TestDeleteDuringFlush(t *testing.T) {
+	dir := t.TempDir()
+
+	for i := 0; i < 10; i++ {
+		db := NewDatabase("test", dir, 1)
+		uids := make([]string, 200)
+		for j := range uids {
+			uids[j] = fmt.Sprintf("%d", j)
+			createRecords(db, uids[j], 10)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			db.Flush()
+		}()
+		go func() {
+			defer wg.Done()
+			// start deleting once the flush is writing files
+			for {
+				if entries, _ := os.ReadDir(path.Join(dir, "test")); len(entries) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Microsecond)
+			}
+			for _, uid := range uids {
+				db.Delete(uid)
+			}
+		}()
+		wg.Wait()
+		db.Stop()
+
+		loaded := NewDatabase("test", dir, 1)
+		if stats := loaded.Stats(); stats.Uids != 0 {
+			t.Fatalf("Iteration %d: expected deleted uids to stay deleted, got %d uids", i, stats.Uids)
+		}
+		loaded.Stop()
+	}
+}
+
+func TestInsertAfterDeleteSurvivesFlush(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	db.Insert("2", 0, "other")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ts := int64(1); ; ts++ {
+			select {
+			case <-stop:
+				return
+			default:
+				db.Insert("2", ts, "other")
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				db.Flush()
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		createRecords(db, "1", 10)
+		db.Delete("1")
+	}
+	// records inserted after the last delete must be kept
+	db.Insert("1", 1000, "after delete")
+	close(stop)
+	wg.Wait()
+	db.Flush()
+	db.Stop()
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	records := loaded.GetRecordsForUser("1", 0, 2000)
+	if len(records) != 1 || records[0].Data != "after delete" {
+		t.Errorf("Expected only the record inserted after the delete, got %v", records)
+	}
+	if loaded.GetLatestRecordForUser("2", 1<<62) == nil {
+		t.Errorf("Expected uid 2 to be loaded")
+	}
+}
+
+func TestLoadCompletesInterruptedDelete(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	createRecords(db, "1", 10)
+	db.Flush()
+	db.Stop()
+
+	// simulate a crash after the tombstone was written but before the files were removed
+	deletedAt := time.Now().UnixNano()
+	m := &manifest{Tombstones: map[string]int64{"1": deletedAt}}
+	if err := m.write(path.Join(dir, "test")); err != nil {
+		t.Fatal(err)
+	}
+	// a file flushed after the deletion is kept
+	later := path.Join(dir, "test", "1", fmt.Sprintf("%d.json", deletedAt+1))
+	if err := os.WriteFile(later, []byte(`[{"ts": 500, "data": "later"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	records := loaded.GetRecordsForUser("1", 0, 1000)
+	if len(records) != 1 || records[0].Data != "later" {
+		t.Errorf("Expected only the record flushed after the delete, got %v", records)
+	}
+	m, err := readManifest(path.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tombstones) != 0 {
+		t.Errorf("Expected tombstones to be cleared, got %v", m.Tombstones)
+	}
+}
+
+func TestFlushOverwrittenRecord(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	createRecords(db, "1", 5)
+	db.Flush()
+
+	// overwriting a flushed timestamp must be flushed again
+	db.Insert("1", 3, "updated")
+	db.Flush()
+	written := db.Stats().BytesOnDisk
+	// nothing changed, nothing is written
+	db.Flush()
+	if bytes := db.Stats().BytesOnDisk; bytes != written {
+		t.Errorf("Expected flush without changes to write nothing, bytes went from %d to %d", written, bytes)
+	}
+	db.Stop()
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	if record := loaded.GetLatestRecordForUser("1", 3); record == nil || record.Data != "updated" {
+		t.Errorf("Expected the overwritten record after reload, got %v", record)
+	}
+}
+
+func TestConcurrentInsertFlushQuery(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			uid := fmt.Sprintf("%d", w)
+			for i := 0; i < 500; i++ {
+				db.Insert(uid, int64(i), fmt.Sprintf("v%d", i))
+				// overwrite an earlier timestamp
+				db.Insert(uid, int64(i/2), fmt.Sprintf("v%d", i))
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					db.Flush()
+					db.GetAllLatestRecords(1000)
+					db.GetRecordsForUser("0", 0, 1000)
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	db.Flush()
+
+	expected := db.GetAllLatestRecords(1000)
+	expectedRange := db.GetRecordsForUser("2", 0, 1000)
+	db.Stop()
+
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	for uid, record := range loaded.GetAllLatestRecords(1000) {
+		if record.Data != expected[uid].Data {
+			t.Errorf("Expected %s for uid %s, got %s", expected[uid].Data, uid, record.Data)
+		}
+	}
+	records := loaded.GetRecordsForUser("2", 0, 1000)
+	if len(records) != len(expectedRange) {
+		t.Fatalf("Expected %d records after reload, got %d", len(expectedRange), len(records))
+	}
+	for i := range records {
+		if records[i].Data != expectedRange[i].Data {
+			t.Errorf("Expected %s at %d, got %s", expectedRange[i].Data, records[i].Timestamp, records[i].Data)
+		}
+	}
+}
+
+// benchmarkInsertUnderQueryLoad measures inserts while other goroutines keep
+// querying the same database
+func benchmarkInsertUnderQueryLoad(b *testing.B, shards int, query func(db *Database)) {
+	db := newDatabase("bench", "", 1, shards)
+	defer db.Stop()
+	for u := 0; u < 1000; u++ {
+		uid := fmt.Sprintf("%d", u)
+		for i := 0; i < 100; i++ {
+			db.Insert(uid, int64(i), "{}")
+		}
+	}
+
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					query(db)
+				}
+			}
+		}()
+	}
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := next.Add(1)
+			db.Insert(fmt.Sprintf("%d", i%1000), 100+i, "{}")
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	readers.Wait()
+}
+
+func BenchmarkInsertUnderQueryLoad(b *testing.B) {
+	queries := []struct {
+		name  string
+		query func(db *Database)
+	}{
+		// the latest record of every uid, served without locking
+		{"latest", func(db *Database) { db.GetAllLatestRecords(math.MaxInt64) }},
+		// the latest record before a timestamp, takes the shard locks
+		{"latest-before", func(db *Database) { db.GetAllLatestRecords(50) }},
+		{"range", func(db *Database) { db.GetRecordsForUser("1", 0, 50) }},
+	}
+	for _, shards := range []int{1, shardCount} {
+		for _, q := range queries {
+			b.Run(fmt.Sprintf("shards=%d/%s", shards, q.name), func(b *testing.B) {
+				benchmarkInsertUnderQueryLoad(b, shards, q.query)
+			})
+		}
+	}
+}
+
+// writeSyntheticStorage writes flushed files for a collection named bench
+func writeSyntheticStorage(tb testing.TB, dir string, uids int, files int, records int) {
+	for u := 0; u < uids; u++ {
+		uidDir := path.Join(dir, "bench", fmt.Sprintf("uid-%d", u))
+		if err := os.MkdirAll(uidDir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for f := 0; f < files; f++ {
+			batch := make([]Record, records)
+			for i := range batch {
+				batch[i] = Record{Timestamp: int64(f*records + i), Data: fmt.Sprintf(`{"value": %d}`, i)}
+			}
+			data, err := json.Marshal(batch)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if err := os.WriteFile(path.Join(uidDir, fmt.Sprintf("%d.json", f+1)), data, 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestParallelLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeSyntheticStorage(t, dir, 50, 3, 20)
+
+	for _, concurrency := range []int{1, 8} {
+		db := emptyDatabase("bench", dir, 1, shardCount)
+		db.loadConcurrency = concurrency
+		if err := db.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.Stats(); stats.Uids != 50 || stats.Records != 50*3*20 || stats.Newest != 59 {
+			t.Errorf("Expected 50 uids with 60 records each with concurrency %d, got %+v", concurrency, stats)
+		}
+		if records := db.GetRecordsForUser("uid-7", 0, 100); len(records) != 60 {
+			t.Errorf("Expected 60 records with concurrency %d, got %d", concurrency, len(records))
+		}
+		db.Stop()
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	dir := b.TempDir()
+	writeSyntheticStorage(b, dir, 2000, 5, 100)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db := emptyDatabase("bench", dir, 1, shardCount)
+				db.loadConcurrency = concurrency
+				if err := db.Load(); err != nil {
+					b.Fatal(err)
+				}
+				db.Stop()
+			}
+		})
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// export formats
+const (
+	formatNDJSON   = "ndjson"
+	formatCSV      = "csv"
+	formatColumnar = "columnar"
+)
+
+// number of rows per row group of a columnar file
+const columnarRowGroupSize = 65536
+
+// exportRow is a record of a uid as it's exported and imported
+type exportRow struct {
+	Uid  string `json:"uid"`
+	Ts   int64  `json:"ts"`
+	Data string `json:"data"`
+}
+
+// exportWriter writes the records of the uids in one of the export formats
+type exportWriter interface {
+	write(uid string, records []Record) error
+	close() error
+}
+
+func newExportWriter(format string, w io.Writer, flatten bool) (exportWriter, error) {
+	if flatten && format != formatCSV {
+		return nil, errors.New("only csv exports can be flattened")
+	}
+	switch format {
+	case formatNDJSON:
+		buffered := bufio.NewWriter(w)
+		return &ndjsonWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	case formatCSV:
+		return &csvWriter{writer: csv.NewWriter(w), flatten: flatten}, nil
+	case formatColumnar:
+		return &columnarWriter{gz: gzip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+type ndjsonWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (w *ndjsonWriter) write(uid string, records []Record) error {
+	for _, record := range records {
+		if err := w.encoder.Encode(exportRow{Uid: uid, Ts: record.Timestamp, Data: record.payload()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) close() error {
+	return w.buffered.Flush()
+}
+
+// csvWriter writes uid, ts and data columns. When flattening, the fields of
+// JSON payloads become columns named by their path, like the paths of
+// filters. The columns are only known at the end, so the rows are kept
+// until then.
+type csvWriter struct {
+	writer        *csv.Writer
+	flatten       bool
+	headerWritten bool
+	rows          []map[string]string
+	columns       map[string]bool
+}
+
+func (w *csvWriter) write(uid string, records []Record) error {
+	if !w.flatten {
+		if !w.headerWritten {
+			w.headerWritten = true
+			if err := w.writer.Write([]string{"uid", "ts", "data"}); err != nil {
+				return err
+			}
+		}
+		for _, record := range records {
+			if err := w.writer.Write([]string{uid, strconv.FormatInt(record.Timestamp, 10), record.payload()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if w.columns == nil {
+		w.columns = make(map[string]bool)
+	}
+	for _, record := range records {
+		row := make(map[string]string)
+		var payload any
+		if err := json.Unmarshal([]byte(record.payload()), &payload); err == nil {
+			if _, ok := payload.(map[string]any); ok {
+				flattenJSON("", payload, row)
+			}
+		}
+		if len(row) == 0 {
+			// payloads that aren't JSON objects are kept whole
+			row["data"] = record.payload()
+		}
+		for column := range row {
+			w.columns[column] = true
+		}
+		row["uid"] = uid
+		row["ts"] = strconv.FormatInt(record.Timestamp, 10)
+		w.rows = append(w.rows, row)
+	}
+	return nil
+}
+
+func (w *csvWriter) close() error {
+	if w.flatten {
+		columns := make([]string, 0, len(w.columns))
+		for column := range w.columns {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		header := append([]string{"uid", "ts"}, columns...)
+		if err := w.writer.Write(header); err != nil {
+			return err
+		}
+		line := make([]string, len(header))
+		for _, row := range w.rows {
+			for i, column := range header {
+				line[i] = row[column]
+			}
+			if err := w.writer.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// flattenJSON adds the leaves of a decoded JSON value to out, keyed by their path
+func flattenJSON(prefix string, value any, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			flattenJSON(name, field, out)
+		}
+	case []any:
+		for i, item := range v {
+			flattenJSON(fmt.Sprintf("%s[%d]", prefix, i), item, out)
+		}
+	case string:
+		out[prefix] = v
+	case nil:
+		out[prefix] = ""
+	default:
+		data, _ := json.Marshal(v)
+		out[prefix] = string(data)
+	}
+}
+
+// columnarHeader starts a columnar file, the row groups follow it
+type columnarHeader struct {
+	Format  string   `json:"format"`
+	Version int      `json:"version"`
+	Columns []string `json:"columns"`
+}
+
+// columnarRowGroup holds the columns of a run of rows. Uids are dictionary
+// encoded and timestamps are delta encoded, like the columns of Parquet.
+type columnarRowGroup struct {
+	Rows int      `json:"rows"`
+	Uids []string `json:"uids"` // dictionary of the uid column
+	Uid  []int    `json:"uid"`  // index in uids of every row
+	Ts   []int64  `json:"ts"`   // the first timestamp, then the difference with the previous row
+	Data []string `json:"data"`
+}
+
+// columnarWriter writes a gzipped stream of JSON documents, a header and then
+// the row groups
+type columnarWriter struct {
+	gz            *gzip.Writer
+	headerWritten bool
+	group         columnarRowGroup
+	uidIndex      map[string]int
+	lastTs        int64
+}
+
+func (w *columnarWriter) write(uid string, records []Record) error {
+	if !w.headerWritten {
+		w.headerWritten = true
+		header := columnarHeader{Format: "tsdb-columnar", Version: 1, Columns: []string{"uid", "ts", "data"}}
+		if err := json.NewEncoder(w.gz).Encode(header); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if w.uidIndex == nil {
+			w.uidIndex = make(map[string]int)
+		}
+		index, ok := w.uidIndex[uid]
+		if !ok {
+			index = len(w.group.Uids)
+			w.uidIndex[uid] = index
+			w.group.Uids = append(w.group.Uids, uid)
+		}
+		w.group.Uid = append(w.group.Uid, index)
+		w.group.Ts = append(w.group.Ts, record.Timestamp-w.lastTs)
+		w.lastTs = record.Timestamp
+		w.group.Data = append(w.group.Data, record.payload())
+		w.group.Rows++
+		if w.group.Rows == columnarRowGroupSize {
+			if err := w.flushGroup(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *columnarWriter) flushGroup() error {
+	if w.group.Rows == 0 {
+		return nil
+	}
+	if err := json.NewEncoder(w.gz).Encode(w.group); err != nil {
+		return err
+	}
+	w.group = columnarRowGroup{}
+	w.uidIndex = nil
+	w.lastTs = 0
+	return nil
+}
+
+func (w *columnarWriter) close() error {
+	if !w.headerWritten {
+		if err := w.write("", nil); err != nil {
+			return err
+		}
+	}
+	if err := w.flushGroup(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// readExport calls fn with every row of an export in the given format
+func readExport(format string, r io.Reader, fn func(row exportRow) error) error {
+	switch format {
+	case formatNDJSON:
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var row exportRow
+			if err := decoder.Decode(&row); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	case formatCSV:
+		return readCSVExport(r, fn)
+	case formatColumnar:
+		return readColumnarExport(r, fn)
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+func readCSVExport(r io.Reader, fn func(row exportRow) error) error {
+	reader := csv.NewReader(bufio.NewReader(r))
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{"uid": -1, "ts": -1, "data": -1}
+	for i, column := range header {
+		if _, ok := columns[column]; !ok {
+			return fmt.Errorf("unexpected csv column %s, flattened exports can't be imported", column)
+		}
+		columns[column] = i
+	}
+	for column, i := range columns {
+		if i == -1 {
+			return fmt.Errorf("csv has no %s column", column)
+		}
+	}
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ts, err := strconv.ParseInt(line[columns["ts"]], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", line[columns["ts"]])
+		}
+		if err := fn(exportRow{Uid: line[columns["uid"]], Ts: ts, Data: line[columns["data"]]}); err != nil {
+			return err
+		}
+	}
+}
+
+func readColumnarExport(r io.Reader, fn func(row exportRow) error) error {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	decoder := json.NewDecoder(gz)
+	var header columnarHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("error reading columnar header: %w", err)
+	}
+	if header.Format != "tsdb-columnar" || header.Version != 1 {
+		return fmt.Errorf("unsupported columnar file %s version %d", header.Format, header.Version)
+	}
+	for {
+		var group columnarRowGroup
+		if err := decoder.Decode(&group); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(group.Uid) != group.Rows || len(group.Ts) != group.Rows || len(group.Data) != group.Rows {
+			return errors.New("columnar row group has columns of different lengths")
+		}
+		ts := int64(0)
+		for i := 0; i < group.Rows; i++ {
+			if group.Uid[i] < 0 || group.Uid[i] >= len(group.Uids) {
+				return fmt.Errorf("uid index %d out of range", group.Uid[i])
+			}
+			ts += group.Ts[i]
+			if err := fn(exportRow{Uid: group.Uids[group.Uid[i]], Ts: ts, Data: group.Data[i]}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportFilter selects the records of an export
+type exportFilter struct {
+	collection string
+	uidPrefix  string
+	from       int64
+	to         int64
+}
+
+// storageConfig returns the configuration import and export read and write
+// the records of a collection with: the type, JSON schema, conflict policy
+// and unit of the pattern matching it. Limits, time limits and rollups are
+// left out, they only apply to the inserts of a server.
+func storageConfig(patterns []Collection, name string) Collection {
+	pattern, _ := matchCollection(patterns, name)
+	return Collection{
+		Name:       pattern.Name,
+		Type:       pattern.Type,
+		Schema:     pattern.Schema,
+		JSONSchema: pattern.JSONSchema,
+		Conflict:   pattern.Conflict,
+		Unit:       pattern.Unit,
+	}
+}
+
+// openStorage opens a collection of a storage directory that no server is
+// using with its configuration. A lazy database only reads the index, the
+// records of a uid are read on first access. It fails when the records are
+// stored with another unit.
+func openStorage(name string, storageDir string, config Collection, lazy bool) (*Database, error) {
+	db := emptyDatabase(name, storageDir, 0, shardCount)
+	// loaded records depend on the type, conflict policy and unit
+	db.config.Store(&config)
+	load := db.Load
+	if lazy {
+		load = db.LoadIndex
+	}
+	if err := load(); err != nil {
+		db.Stop()
+		return nil, err
+	}
+	if err := db.checkUnit(config.Unit); err != nil {
+		db.Stop()
+		return nil, err
+	}
+	db.configure(config, storageOptions{dir: storageDir})
+	return db, nil
+}
+
+// exportStorage writes the records of a collection in a storage directory that
+// no server is using. Uids are read from disk one at a time.
+func exportStorage(storageDir string, config Collection, filter exportFilter, w exportWriter) error {
+	if _, err := os.Stat(path.Join(storageDir, filter.collection)); err != nil {
+		return fmt.Errorf("collection %s not found in %s: %w", filter.collection, storageDir, err)
+	}
+	db, err := openStorage(filter.collection, storageDir, config, true)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+	uids, _ := db.ListUids(filter.uidPrefix, "", 0)
+	for _, uid := range uids {
+		if err := w.write(uid.Uid, db.GetRecordsForUser(uid.Uid, filter.from, filter.to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// responseRecord is a record of a query-user response, typed collections
+// return a value instead of data
+type responseRecord struct {
+	Timestamp int64           `json:"ts"`
+	Data      string          `json:"data"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func (r responseRecord) record() Record {
+	if r.Value != nil {
+		return Record{Timestamp: r.Timestamp, Data: string(r.Value)}
+	}
+	return Record{Timestamp: r.Timestamp, Data: r.Data}
+}
+
+// exportServer writes the records of a collection of a running server, paging
+// through its uids with list-uids and reading each with query-user
+func exportServer(c *client, filter exportFilter, w exportWriter) error {
+	after := ""
+	for {
+		response, err := c.call("list-uids", listUids{
+			Collection: &filter.collection,
+			Prefix:     filter.uidPrefix,
+			After:      after,
+			Limit:      maxListUidsLimit,
+		})
+		if err != nil {
+			return err
+		}
+		var page listUidsResponse
+		if err := json.Unmarshal(response, &page); err != nil {
+			return fmt.Errorf("error unmarshaling list-uids response: %w", err)
+		}
+		for _, uid := range page.Uids {
+			response, err := c.call("query-user", queryUser{
+				Uid:        &uid.Uid,
+				From:       &filter.from,
+				To:         &filter.to,
+				Collection: &filter.collection,
+			})
+			if err != nil {
+				return err
+			}
+			var page struct {
+				Records []responseRecord `json:"records"`
+			}
+			if err := json.Unmarshal(response, &page); err != nil {
+				return fmt.Errorf("error unmarshaling query-user response: %w", err)
+			}
+			records := make([]Record, len(page.Records))
+			for i, record := range page.Records {
+				records[i] = record.record()
+			}
+			if err := w.write(uid.Uid, records); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		after = page.Next
+	}
+}
+
+// importStorage inserts the rows of an export into a collection of a storage
+// directory that no server is using and flushes it. The payloads are
+// validated against the type and JSON schema of the configuration. When ttl
+// is set, expired records are dropped before the flush like the server would.
+func importStorage(storageDir string, collection string, config Collection, ttl int64, format string, r io.Reader) (int, error) {
+	config.TTL = int(ttl)
+	db, err := openStorage(collection, storageDir, config, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Stop()
+	count := 0
+	err = readExport(format, r, func(row exportRow) error {
+		if err := db.Insert(row.Uid, row.Ts, row.Data); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	if ttl > 0 {
+		db.DeleteOld()
+	}
+	return count, db.Flush()
+}
+
+// importServer sends the rows of an export to a running server in insert
+// messages of batchSize records, so they go through the same checks as any
+// other insert
+func importServer(c *client, collection string, format string, r io.Reader, batchSize int) (int, error) {
+	count := 0
+	batch := make([]dataPayload, 0, batchSize)
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		response, err := c.call("insert", batch)
+		if err != nil {
+			return err
+		}
+		var result dataPayloadResponse
+		if err := json.Unmarshal(response, &result); err != nil {
+			return fmt.Errorf("error unmarshaling insert response: %w", err)
+		}
+		rejected, first := 0, -1
+		for i, record := range result.Results {
+			if record.Status == insertRejected {
+				rejected++
+				if first == -1 {
+					first = i
+				}
+			}
+		}
+		if rejected > 0 {
+			return fmt.Errorf("%d records of the batch were refused, the first at %d: %s", rejected, count+first, result.Results[first].Error)
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err := readExport(format, r, func(row exportRow) error {
+		data, err := json.Marshal(row.Data)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, dataPayload{Ts: &insertTimestamp{value: row.Ts}, Uid: &row.Uid, Data: data, Collection: &collection})
+		if len(batch) == batchSize {
+			return send()
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, send()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	storage := t.TempDir()
+	flushTestDatabase(t, storage)
+
+	for _, format := range []string{formatNDJSON, formatCSV, formatColumnar} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newExportWriter(format, &buf, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter := exportFilter{collection: "test", from: 5, to: math.MaxInt64}
+			if err := exportStorage(storage, Collection{}, filter, w); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			imported := t.TempDir()
+			count, err := importStorage(imported, "copy", Collection{}, 0, format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 8 {
+				t.Errorf("Expected 8 records, got %d", count)
+			}
+			db := NewDatabase("copy", imported, 0)
+			defer db.Stop()
+			if stats := db.Stats(); stats.Uids != 2 || stats.Records != 8 || stats.Oldest != 5 {
+				t.Errorf("Expected the records from 5 on, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestExportImportConfig(t *testing.T) {
+	storage := t.TempDir()
+	reg, err := newRegistry(storageOptions{dir: storage}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pattern is read from the collections file
+	if err := reg.create(Collection{Name: "events.*", TTL: 1, Type: typeFloat64, Conflict: conflictAll, Unit: unitMillis}); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("events.a")
+	for _, value := range []string{"1", "2", "3"} {
+		if err := db.Insert("1", 1700000000123, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(t.TempDir(), "events.ndjson")
+	if out, err := executeCommand("export", "-d", storage, "-c", "events.a", "-o", file); err != nil {
+		t.Fatalf("Expected the milliseconds collection to be exported, got %v: %s", err, out)
+	}
+	if data, _ := os.ReadFile(file); strings.Count(string(data), "\n") != 3 {
+		t.Errorf("Expected the 3 records with the same timestamp, got %s", data)
+	}
+
+	// or from the flags
+	imported := t.TempDir()
+	flags := []string{"-t", "events.*:float64", "--conflict", "events.*:all", "--unit", "events.*:ms"}
+	args := append([]string{"import", "-d", imported, "-c", "events.b", "-i", file}, flags...)
+	if out, err := executeCommand(args...); err != nil {
+		t.Fatalf("Expected the records to be imported, got %v: %s", err, out)
+	}
+	config := Collection{Name: "events.*", TTL: 1, Type: typeFloat64, Conflict: conflictAll, Unit: unitMillis}
+	loaded, err := openDatabase("events.b", config, storageOptions{dir: imported})
+	if err != nil {
+		t.Fatalf("Expected the import to be stored in milliseconds, got %v", err)
+	}
+	defer loaded.Stop()
+	if records := loaded.GetRecordsForUser("1", 1700000000123, 1700000000123); len(records) != 3 {
+		t.Errorf("Expected the 3 records with the same timestamp, got %+v", records)
+	}
+
+	// payloads are validated against the type
+	invalid := path.Join(t.TempDir(), "invalid.ndjson")
+	os.WriteFile(invalid, []byte(`{"uid":"1","ts":1700000000124,"data":"warm"}`+"\n"), 0644)
+	args = append([]string{"import", "-d", t.TempDir(), "-c", "events.c", "-i", invalid}, flags...)
+	if _, err := executeCommand(args...); err == nil {
+		t.Error("Expected a payload that isn't a float64 to be refused")
+	}
+}
+
+func TestExportUidPrefix(t *testing.T) {
+	storage := t.TempDir()
+	flushTestDatabase(t, storage)
+	var buf bytes.Buffer
+	w, _ := newExportWriter(formatNDJSON, &buf, false)
+	filter := exportFilter{collection: "test", uidPrefix: "2", from: math.MinInt64, to: math.MaxInt64}
+	if err := exportStorage(storage, Collection{}, filter, w); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("Expected 2 records of uid 2, got %d", lines)
+	}
+	if err := exportStorage(storage, Collection{}, exportFilter{collection: "missing"}, w); err == nil {
+		t.Errorf("Expected an error exporting a missing collection")
+	}
+}
+
+func TestExportFlattenCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newExportWriter(formatCSV, &buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.write("a", []Record{
+		{Timestamp: 1, Data: `{"name":"x","pos":{"lat":1.5,"lng":2},"tags":["t1","t2"]}`},
+		{Timestamp: 2, Data: `{"name":"y,z","ok":true}`},
+	})
+	w.write("b", []Record{{Timestamp: 3, Data: "plain text"}})
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"uid,ts,data,name,ok,pos.lat,pos.lng,tags[0],tags[1]",
+		"a,1,,x,,1.5,2,t1,t2",
+		`a,2,,"y,z",true,,,,`,
+		"b,3,plain text,,,,,,",
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+
+	if err := readExport(formatCSV, &buf, func(row exportRow) error { return nil }); err == nil {
+		t.Errorf("Expected an error importing a flattened csv")
+	}
+	if _, err := newExportWriter(formatNDJSON, &buf, true); err == nil {
+		t.Errorf("Expected an error flattening ndjson")
+	}
+}
+
+func TestColumnarRowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := newExportWriter(formatColumnar, &buf, false)
+	records := make([]Record, columnarRowGroupSize+10)
+	for i := range records {
+		records[i] = Record{Timestamp: int64(1000 - i), Data: "{}"}
+	}
+	w.write("a", records)
+	w.write("b", records[:5])
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	var rows []exportRow
+	err := readExport(formatColumnar, &buf, func(row exportRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(records)+5 {
+		t.Fatalf("Expected %d rows, got %d", len(records)+5, len(rows))
+	}
+	for i, record := range records {
+		if rows[i].Uid != "a" || rows[i].Ts != record.Timestamp {
+			t.Fatalf("Expected a at %d, got %+v", record.Timestamp, rows[i])
+		}
+	}
+	if last := rows[len(rows)-1]; last.Uid != "b" || last.Ts != 996 {
+		t.Errorf("Expected b at 996, got %+v", last)
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Filter is a parsed expression that is evaluated against the JSON payload
+// stored in Record.Data.
+//
+// Grammar:
+//
+//	expr    := and ( "||" and )*
+//	and     := unary ( "&&" unary )*
+//	unary   := "!" unary | primary
+//	primary := "(" expr ")"
+//	         | "exists" path
+//	         | path "in" "[" value ( "," value )* "]"
+//	         | path op value
+//	op      := "==" | "!=" | "<" | "<=" | ">" | ">="
+//	path    := ident ( "." ident | "[" int "]" )*
+//	value   := number | string | true | false | null
+//
+// Examples: `battery < 20`, `status == "ok" && exists location.lat`,
+// `mode in ["eco", "sleep"]`. A comparison against a missing field is false.
+type Filter struct {
+	source string
+	root   filterNode
+}
+
+type filterNode interface {
+	eval(payload any) bool
+}
+
+type pathStep struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+type filterPath []pathStep
+
+func (p filterPath) lookup(payload any) (any, bool) {
+	current := payload
+	for _, step := range p {
+		if step.isIdx {
+			arr, ok := current.([]any)
+			if !ok || step.index < 0 || step.index >= len(arr) {
+				return nil, false
+			}
+			current = arr[step.index]
+			continue
+		}
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[step.key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) eval(payload any) bool { return n.left.eval(payload) && n.right.eval(payload) }
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) eval(payload any) bool { return n.left.eval(payload) || n.right.eval(payload) }
+
+type notNode struct{ inner filterNode }
+
+func (n notNode) eval(payload any) bool { return !n.inner.eval(payload) }
+
+type existsNode struct{ path filterPath }
+
+func (n existsNode) eval(payload any) bool {
+	_, ok := n.path.lookup(payload)
+	return ok
+}
+
+type compareNode struct {
+	path  filterPath
+	op    string
+	value any
+}
+
+func (n compareNode) eval(payload any) bool {
+	actual, ok := n.path.lookup(payload)
+	if !ok {
+		return false
+	}
+	return compareValues(actual, n.op, n.value)
+}
+
+type inNode struct {
+	path   filterPath
+	values []any
+}
+
+func (n inNode) eval(payload any) bool {
+	actual, ok := n.path.lookup(payload)
+	if !ok {
+		return false
+	}
+	for _, v := range n.values {
+		if compareValues(actual, "==", v) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two decoded JSON values. Numbers and strings support
+// ordering, every other type only supports equality. Values of different types
+// are never equal.
+func compareValues(actual any, op string, expected any) bool {
+	switch a := actual.(type) {
+	case float64:
+		if e, ok := expected.(float64); ok {
+			switch op {
+			case "==":
+				return a == e
+			case "!=":
+				return a != e
+			case "<":
+				return a < e
+			case "<=":
+				return a <= e
+			case ">":
+				return a > e
+			case ">=":
+				return a >= e
+			}
+		}
+	case string:
+		if e, ok := expected.(string); ok {
+			switch op {
+			case "==":
+				return a == e
+			case "!=":
+				return a != e
+			case "<":
+				return a < e
+			case "<=":
+				return a <= e
+			case ">":
+				return a > e
+			case ">=":
+				return a >= e
+			}
+		}
+	case bool:
+		if e, ok := expected.(bool); ok {
+			switch op {
+			case "==":
+				return a == e
+			case "!=":
+				return a != e
+			}
+			return false
+		}
+	case nil:
+		if expected == nil {
+			return op == "=="
+		}
+	}
+	return op == "!="
+}
+
+// ParseFilter parses a filter expression
+func ParseFilter(source string) (*Filter, error) {
+	tokens, err := tokenizeFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("filter: unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	return &Filter{source: source, root: root}, nil
+}
+
+// Match reports whether the payload matches the filter. Payloads that are
+// not valid JSON only match expressions that don't require a field.
+func (f *Filter) Match(data string, cache *payloadCache) bool {
+	if f == nil {
+		return true
+	}
+	var payload any
+	if cache != nil {
+		payload = cache.get(data)
+	} else {
+		payload = parsePayload(data)
+	}
+	return f.root.eval(payload)
+}
+
+func (f *Filter) String() string {
+	return f.source
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokPunct
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenizeFilter(source string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+	for i < len(source) {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']' || c == ',' || c == '.':
+			tokens = append(tokens, filterToken{kind: tokPunct, text: string(c), pos: i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(source) || rune(source[i+1]) != c {
+				return nil, fmt.Errorf("filter: expected %c%c at position %d", c, c, i)
+			}
+			tokens = append(tokens, filterToken{kind: tokOp, text: source[i : i+2], pos: i})
+			i += 2
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			if i+1 < len(source) && source[i+1] == '=' {
+				tokens = append(tokens, filterToken{kind: tokOp, text: source[i : i+2], pos: i})
+				i += 2
+				continue
+			}
+			if c == '=' {
+				return nil, fmt.Errorf("filter: expected == at position %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: tokOp, text: string(c), pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(source) && rune(source[end]) != c {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", i)
+			}
+			raw := source[i+1 : end]
+			if c == '\'' {
+				raw = strings.ReplaceAll(raw, `\'`, `'`)
+				raw = strings.ReplaceAll(raw, `"`, `\"`)
+			}
+			text, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at position %d: %w", i, err)
+			}
+			tokens = append(tokens, filterToken{kind: tokString, text: text, pos: i})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(source) && strings.ContainsRune("0123456789.eE+-", rune(source[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: tokNumber, text: source[i:end], pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(source) && (source[end] == '_' || source[end] == '-' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: tokIdent, text: source[i:end], pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("filter: unexpected character %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{kind: tokEOF, text: "end of filter", pos: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.peek()
+	if !p.done() {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) expect(text string) error {
+	t := p.next()
+	if t.text != text || t.kind == tokString {
+		return fmt.Errorf("filter: expected %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if t := p.peek(); t.kind == tokOp && t.text == "!" {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.peek()
+	if t.kind == tokPunct && t.text == "(" {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	if t.kind == tokIdent && t.text == "exists" {
+		p.next()
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return existsNode{path}, nil
+	}
+
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	t = p.next()
+	if t.kind == tokIdent && t.text == "in" {
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		var values []any
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			sep := p.next()
+			if sep.kind == tokPunct && sep.text == "]" {
+				break
+			}
+			if sep.kind != tokPunct || sep.text != "," {
+				return nil, fmt.Errorf("filter: expected \",\" or \"]\", got %q", sep.text)
+			}
+		}
+		return inNode{path: path, values: values}, nil
+	}
+	if t.kind != tokOp || t.text == "&&" || t.text == "||" || t.text == "!" {
+		return nil, fmt.Errorf("filter: expected comparison operator, got %q", t.text)
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{path: path, op: t.text, value: value}, nil
+}
+
+func (p *filterParser) parsePath() (filterPath, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return nil, fmt.Errorf("filter: expected field name, got %q", t.text)
+	}
+	path := filterPath{{key: t.text}}
+	for {
+		t = p.peek()
+		if t.kind != tokPunct || (t.text != "." && t.text != "[") {
+			return path, nil
+		}
+		p.next()
+		if t.text == "." {
+			key := p.next()
+			if key.kind != tokIdent && key.kind != tokNumber {
+				return nil, fmt.Errorf("filter: expected field name after \".\", got %q", key.text)
+			}
+			path = append(path, pathStep{key: key.text})
+			continue
+		}
+		idx := p.next()
+		switch idx.kind {
+		case tokNumber:
+			n, err := strconv.Atoi(idx.text)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid index %q", idx.text)
+			}
+			path = append(path, pathStep{index: n, isIdx: true})
+		case tokString:
+			path = append(path, pathStep{key: idx.text})
+		default:
+			return nil, fmt.Errorf("filter: expected index, got %q", idx.text)
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (any, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return t.text, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid number %q", t.text)
+		}
+		return n, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("filter: expected value, got %q", t.text)
+}
+
+func parsePayload(data string) any {
+	var payload any
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return nil
+	}
+	return payload
+}
+
+// payloadCache is a bounded LRU of decoded payloads keyed by the raw data,
+// so repeated filters over the same records don't unmarshal them again.
+type payloadCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type payloadEntry struct {
+	data    string
+	payload any
+}
+
+func newPayloadCache(capacity int) *payloadCache {
+	return &payloadCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *payloadCache) get(data string) any {
+	c.mu.Lock()
+	if elem, ok := c.items[data]; ok {
+		c.order.MoveToFront(elem)
+		payload := elem.Value.(*payloadEntry).payload
+		c.mu.Unlock()
+		return payload
+	}
+	c.mu.Unlock()
+
+	// decode outside the lock, a concurrent decode of the same payload is harmless
+	payload := parsePayload(data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[data]; ok {
+		return payload
+	}
+	c.items[data] = c.order.PushFront(&payloadEntry{data: data, payload: payload})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*payloadEntry).data)
+	}
+	return payload
+}
+
+func (c *payloadCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	payload := `{"battery": 15, "status": "ok", "charging": false, "note": null, "location": {"lat": 1.5, "lng": 2}, "tags": ["a", "b"]}`
+
+	tests := []struct {
+		name   string
+		filter string
+		want   bool
+	}{
+		{name: "less than", filter: "battery < 20", want: true},
+		{name: "less than false", filter: "battery < 10", want: false},
+		{name: "less or equal", filter: "battery <= 15", want: true},
+		{name: "greater than", filter: "battery > 15", want: false},
+		{name: "greater or equal", filter: "battery >= 15", want: true},
+		{name: "negative number", filter: "battery > -1", want: true},
+		{name: "string equal", filter: `status == "ok"`, want: true},
+		{name: "single quoted string", filter: `status == 'ok'`, want: true},
+		{name: "string not equal", filter: `status != "ok"`, want: false},
+		{name: "bool equal", filter: "charging == false", want: true},
+		{name: "null equal", filter: "note == null", want: true},
+		{name: "nested path", filter: "location.lat > 1", want: true},
+		{name: "array index", filter: `tags[1] == "b"`, want: true},
+		{name: "array index out of range", filter: `tags[5] == "b"`, want: false},
+		{name: "missing field", filter: "speed < 100", want: false},
+		{name: "missing field not equal", filter: "speed != 100", want: false},
+		{name: "type mismatch", filter: `battery == "15"`, want: false},
+		{name: "type mismatch not equal", filter: `battery != "15"`, want: true},
+		{name: "exists", filter: "exists location.lng", want: true},
+		{name: "not exists", filter: "!exists location.alt", want: true},
+		{name: "in", filter: `status in ["warn", "ok"]`, want: true},
+		{name: "in numbers", filter: "battery in [1, 2, 3]", want: false},
+		{name: "and", filter: `battery < 20 && status == "ok"`, want: true},
+		{name: "or", filter: `battery > 20 || status == "ok"`, want: true},
+		{name: "precedence", filter: `battery > 20 && status == "ok" || charging == false`, want: true},
+		{name: "parentheses", filter: `battery > 20 && (status == "ok" || charging == false)`, want: false},
+		{name: "not", filter: `!(battery < 20)`, want: false},
+	}
+
+	cache := newPayloadCache(10)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q) returned error: %v", tt.filter, err)
+			}
+			if got := filter.Match(payload, cache); got != tt.want {
+				t.Errorf("ParseFilter(%q).Match() = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+
+	if cache.len() != 1 {
+		t.Errorf("Expected payload to be decoded once, cache has %d entries", cache.len())
+	}
+}
+
+func TestFilterNonJSONPayload(t *testing.T) {
+	filter, err := ParseFilter("!exists battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Match("not json", nil) {
+		t.Errorf("Expected non JSON payload to match !exists")
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"battery",
+		"battery <",
+		"battery = 1",
+		"battery < 1 &&",
+		"(battery < 1",
+		"battery in [1, 2",
+		`status == "ok`,
+		"battery < 1 battery",
+		"battery & 1",
+		"exists",
+		"battery < 1)",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := ParseFilter(input); err == nil {
+				t.Errorf("ParseFilter(%q) should have failed", input)
+			}
+		})
+	}
+}
+
+func TestPayloadCacheEviction(t *testing.T) {
+	cache := newPayloadCache(2)
+	cache.get(`{"a": 1}`)
+	cache.get(`{"a": 2}`)
+	cache.get(`{"a": 1}`)
+	cache.get(`{"a": 3}`)
+
+	if cache.len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", cache.len())
+	}
+	if _, ok := cache.items[`{"a": 2}`]; ok {
+		t.Errorf("Expected least recently used payload to be evicted")
+	}
+}
+
+func TestFilterRecordsForUser(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+
+	for i := 1; i <= 10; i++ {
+		db.Insert("1", int64(i), fmt.Sprintf(`{"value": %d}`, i))
+	}
+	db.Insert("2", 1, `{"value": 100}`)
+
+	filter, err := ParseFilter("value >= 5 && value < 8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := db.FilterRecords(db.GetRecordsForUser("1", 0, 10), filter)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	if records[0].Timestamp != 5 || records[2].Timestamp != 7 {
+		t.Errorf("Expected records 5 to 7, got %d to %d", records[0].Timestamp, records[2].Timestamp)
+	}
+
+	filter, err = ParseFilter("value > 50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := db.FilterLatestRecords(db.GetAllLatestRecords(10), filter)
+	if len(latest) != 1 || latest["2"] == nil {
+		t.Errorf("Expected only uid 2 to match, got %v", latest)
+	}
+}
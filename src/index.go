@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+// readiness of a database reported by Status
+const (
+	statusReady   = "ready"   // the records of every uid are in memory
+	statusLoading = "loading" // some uids are loaded on first access
+)
+
+// indexEntry is the bookkeeping of a uid kept in the manifest, so the uid
+// can be listed and served before its records are read from disk
+type indexEntry struct {
+	First       int64 `json:"first"`
+	Last        int64 `json:"last"`
+	Records     int   `json:"records"`
+	BytesOnDisk int64 `json:"bytesOnDisk"`
+}
+
+func (s *series) indexEntry() indexEntry {
+	return indexEntry{
+		First:       s.firstTimestamp(),
+		Last:        s.lastTimestamp(),
+		Records:     s.len(),
+		BytesOnDisk: s.bytesOnDisk,
+	}
+}
+
+// NewLazyDatabase creates a database that registers the uids on disk from
+// the index without reading their records. Records are loaded on first
+// access or by WarmUp.
+func NewLazyDatabase(name string, storageDir string, ttl int64) *Database {
+	db := emptyDatabase(name, storageDir, ttl, shardCount)
+	if err := db.LoadIndex(); err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// LoadIndex registers the uids on disk from the index in the manifest. Uids
+// missing from the index, like the ones written before it existed, are
+// loaded right away.
+func (db *Database) LoadIndex() error {
+	if db.storageDir == "" {
+		return nil
+	}
+	log.Println("Loading index from", db.name)
+	dir := path.Join(db.storageDir, db.name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil // Directory doesn't exist yet, that's ok
+	}
+
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	db.manifest = m
+	db.completeDeletions()
+
+	userDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+
+	indexed := 0
+	var missing []string
+	found := make(map[string]bool, len(userDirs))
+	for _, userDir := range userDirs {
+		if !userDir.IsDir() {
+			continue
+		}
+		uid := userDir.Name()
+		found[uid] = true
+
+		entry, ok := db.manifest.Index[uid]
+		if !ok {
+			missing = append(missing, uid)
+			continue
+		}
+
+		sh := db.shardFor(uid)
+		s := &series{bytesOnDisk: entry.BytesOnDisk}
+		s.cold.Store(&entry)
+		sh.uids.Store(uid, s)
+		db.sortedUids.add(uid)
+		if entry.Records > 0 {
+			sh.widen(entry.First, entry.Last)
+		}
+		db.uidCount.Add(1)
+		db.coldUids.Add(1)
+		db.recordCount.Add(int64(entry.Records))
+		db.bytesOnDisk.Add(entry.BytesOnDisk)
+		indexed++
+	}
+
+	db.loadUids(dir, missing)
+	for _, uid := range missing {
+		if s := db.shardFor(uid).get(uid); s != nil {
+			db.manifest.Index[uid] = s.indexEntry()
+		}
+	}
+
+	// uids removed from disk outside of the server
+	stale := 0
+	for uid := range db.manifest.Index {
+		if !found[uid] {
+			delete(db.manifest.Index, uid)
+			stale++
+		}
+	}
+	if len(missing) > 0 || stale > 0 {
+		if err := db.manifest.write(dir); err != nil {
+			log.Println("Error writing manifest:", err)
+		}
+	}
+
+	log.Println("Indexed", indexed, "uids and loaded", len(missing), "uids missing from the index in", db.name)
+	return nil
+}
+
+// hydrate loads the records of a uid registered from the index
+func (db *Database) hydrate(sh *shard, uid string) {
+	if s := sh.get(uid); s == nil || s.cold.Load() == nil {
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if s := sh.get(uid); s != nil && s.cold.Load() != nil {
+		db.hydrateLocked(sh, uid, s)
+	}
+}
+
+// hydrateLocked replaces a series registered from the index with one holding
+// its records and returns it, or nil if the uid has no records on disk. The
+// records are read into a new series so lock-free readers never see a
+// partially loaded one. The caller must hold the lock of the shard.
+func (db *Database) hydrateLocked(sh *shard, uid string, cold *series) *series {
+	s, err := readSeries(path.Join(db.storageDir, db.name, uid), nil, db.storedRecord, db.config.Load().Conflict)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading directory for user %s: %v", uid, err)
+	}
+	if s.len() == 0 {
+		db.removeSeries(sh, uid, cold)
+		if cold.len() > 0 {
+			sh.shrink(cold.firstTimestamp(), cold.lastTimestamp())
+		}
+		return nil
+	}
+	db.storeSeries(sh, uid, s)
+	return s
+}
+
+// WarmUp loads the records of the uids registered from the index in the
+// background. It stops when the database is stopped or the memory limit is
+// reached, the remaining uids are then loaded on first access.
+func (db *Database) WarmUp() {
+	for _, sh := range db.shards {
+		var uids []string
+		sh.each(func(uid string, s *series) bool {
+			if s.cold.Load() != nil {
+				uids = append(uids, uid)
+			}
+			return true
+		})
+		for _, uid := range uids {
+			select {
+			case <-db.stopChan:
+				return
+			default:
+			}
+			if db.budget != nil && db.budget.used.Load() >= db.budget.limit {
+				log.Println("Memory limit reached, stopped warming up", db.name)
+				return
+			}
+			db.hydrate(sh, uid)
+		}
+	}
+	log.Println("Warmed up", db.name)
+}
+
+// Status reports whether the records of every uid are loaded
+func (db *Database) Status() string {
+	if db.coldUids.Load() > 0 {
+		return statusLoading
+	}
+	return statusReady
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func flushTestDatabase(t *testing.T, dir string) {
+	db := NewDatabase("test", dir, 1)
+	createRecords(db, "1", 10)
+	db.Insert("2", 5, "test_5")
+	db.Insert("2", 6, "test_6")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Stop()
+}
+
+func TestLazyLoad(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+
+	db := NewLazyDatabase("test", dir, 1)
+	defer db.Stop()
+	if status := db.Status(); status != statusLoading {
+		t.Errorf("Expected status %s, got %s", statusLoading, status)
+	}
+	stats := db.Stats()
+	if stats.Uids != 2 || stats.Records != 12 || stats.Oldest != 1 || stats.Newest != 10 {
+		t.Errorf("Expected the stats from the index, got %+v", stats)
+	}
+	if stats.MemoryBytes != 0 || stats.BytesOnDisk == 0 {
+		t.Errorf("Expected no records in memory and bytes on disk, got %+v", stats)
+	}
+	uids, _ := db.ListUids("", "", 10)
+	if len(uids) != 2 || uids[1] != (UidStats{Uid: "2", First: 5, Last: 6, Records: 2}) {
+		t.Errorf("Expected the uids from the index, got %v", uids)
+	}
+
+	// the first access loads the uid
+	if records := db.GetRecordsForUser("1", 0, 100); len(records) != 10 {
+		t.Errorf("Expected 10 records, got %d", len(records))
+	}
+	if status := db.Status(); status != statusLoading {
+		t.Errorf("Expected status %s with a uid left, got %s", statusLoading, status)
+	}
+
+	// inserts load the uid before adding the record
+	if err := db.Insert("2", 7, "test_7"); err != nil {
+		t.Fatal(err)
+	}
+	if records := db.GetRecordsForUser("2", 0, 100); len(records) != 3 {
+		t.Errorf("Expected 3 records, got %d", len(records))
+	}
+	if status := db.Status(); status != statusReady {
+		t.Errorf("Expected status %s, got %s", statusReady, status)
+	}
+	if stats := db.Stats(); stats.Records != 13 {
+		t.Errorf("Expected 13 records, got %d", stats.Records)
+	}
+}
+
+func TestLazyLoadWarmUp(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+
+	db := NewLazyDatabase("test", dir, 1)
+	defer db.Stop()
+	db.WarmUp()
+	if status := db.Status(); status != statusReady {
+		t.Errorf("Expected status %s, got %s", statusReady, status)
+	}
+	if record := db.GetLatestRecordForUser("2", 100); record == nil || record.Data != "test_6" {
+		t.Errorf("Expected test_6, got %v", record)
+	}
+	if all := db.GetAllLatestRecords(100); len(all) != 2 || all["1"].Data != "test_10" {
+		t.Errorf("Expected the latest record of both uids, got %v", all)
+	}
+	if stats := db.Stats(); stats.Records != 12 || stats.MemoryBytes == 0 {
+		t.Errorf("Expected 12 records in memory, got %+v", stats)
+	}
+}
+
+func TestLazyLoadWithoutIndex(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+	// data written before the index existed
+	if err := os.Remove(path.Join(dir, "test", manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewLazyDatabase("test", dir, 1)
+	db.Stop()
+	if status := db.Status(); status != statusReady {
+		t.Errorf("Expected uids missing from the index to be loaded, got %s", status)
+	}
+	if stats := db.Stats(); stats.Records != 12 {
+		t.Errorf("Expected 12 records, got %d", stats.Records)
+	}
+
+	m, err := readManifest(path.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Index) != 2 || m.Index["1"].Records != 10 {
+		t.Errorf("Expected the index to be rebuilt, got %v", m.Index)
+	}
+}
+
+func TestLazyLoadDeleteOld(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+	db := NewDatabase("test", dir, 1)
+	db.Insert("recent", time.Now().Unix(), "now")
+	db.Flush()
+	db.Stop()
+
+	lazy := NewLazyDatabase("test", dir, 1)
+	defer lazy.Stop()
+	lazy.DeleteOld()
+	if stats := lazy.Stats(); stats.Uids != 1 || stats.Records != 1 {
+		t.Errorf("Expected only the recent uid, got %+v", stats)
+	}
+	if _, err := os.Stat(path.Join(dir, "test", "1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired uid to be removed from disk, got %v", err)
+	}
+	if status := lazy.Status(); status != statusLoading {
+		t.Errorf("Expected the recent uid not to be loaded, got %s", status)
+	}
+}
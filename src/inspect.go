@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// directory at the root of a storage directory where repair moves the files
+// it can't rewrite, hidden so it's never taken for a collection
+const quarantineDir = ".quarantine"
+
+// problems found in the files of a storage directory
+const (
+	problemUnreadable = "unreadable"
+	problemInvalid    = "invalid json"
+	problemEmpty      = "empty"
+	problemUnsorted   = "not sorted"
+	problemLeftover   = "leftover temporary file"
+)
+
+// storageReport describes a storage directory as inspect, verify and repair see it
+type storageReport struct {
+	Collections []collectionReport
+}
+
+type collectionReport struct {
+	Name     string
+	Uids     []uidReport
+	Problems []fileProblem // problems of the files at the root of the collection
+}
+
+type uidReport struct {
+	Uid      string
+	Files    int
+	Records  int
+	First    int64
+	Last     int64
+	Bytes    int64
+	Problems []fileProblem
+}
+
+// fileProblem is a file that Load would skip or that doesn't hold what Flush writes
+type fileProblem struct {
+	File    string
+	Problem string
+	Detail  string
+	records []Record // the records of files that parse
+}
+
+func (r *storageReport) problems() []fileProblem {
+	var problems []fileProblem
+	for _, c := range r.Collections {
+		problems = append(problems, c.problems()...)
+	}
+	return problems
+}
+
+// problems returns the problems of the collection and of its uids
+func (c *collectionReport) problems() []fileProblem {
+	problems := slices.Clone(c.Problems)
+	for _, u := range c.Uids {
+		problems = append(problems, u.Problems...)
+	}
+	return problems
+}
+
+func (c *collectionReport) totals() uidReport {
+	total := uidReport{}
+	for _, u := range c.Uids {
+		if u.Records > 0 {
+			if total.Records == 0 || u.First < total.First {
+				total.First = u.First
+			}
+			if total.Records == 0 || u.Last > total.Last {
+				total.Last = u.Last
+			}
+		}
+		total.Files += u.Files
+		total.Records += u.Records
+		total.Bytes += u.Bytes
+	}
+	return total
+}
+
+// inspectStorage reads every file of the collections of a storage directory
+// that no server is using, all collections when none are given
+func inspectStorage(storageDir string, collections []string) (*storageReport, error) {
+	if len(collections) == 0 {
+		dirs, err := os.ReadDir(storageDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() && !strings.HasPrefix(dir.Name(), ".") {
+				collections = append(collections, dir.Name())
+			}
+		}
+	}
+	sort.Strings(collections)
+
+	report := &storageReport{}
+	for _, name := range collections {
+		collection, err := inspectCollection(path.Join(storageDir, name))
+		if err != nil {
+			return nil, err
+		}
+		collection.Name = name
+		report.Collections = append(report.Collections, *collection)
+	}
+	return report, nil
+}
+
+func inspectCollection(dir string) (*collectionReport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &collectionReport{}
+	for _, entry := range entries {
+		file := path.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			if entry.Name() == manifestFile {
+				if _, err := readManifest(dir); err != nil {
+					report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemInvalid, Detail: err.Error()})
+				}
+			} else if strings.HasSuffix(entry.Name(), ".tmp") {
+				report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemLeftover})
+			}
+			continue
+		}
+		uid, err := inspectUid(file)
+		if err != nil {
+			return nil, err
+		}
+		uid.Uid = entry.Name()
+		report.Uids = append(report.Uids, *uid)
+	}
+	return report, nil
+}
+
+func inspectUid(dir string) (*uidReport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &uidReport{}
+	for _, entry := range entries {
+		file := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			// evicted chunks are a cache, Load removes them
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemLeftover})
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		report.Files++
+		data, err := os.ReadFile(file)
+		if err != nil {
+			report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemUnreadable, Detail: err.Error()})
+			continue
+		}
+		report.Bytes += int64(len(data))
+		var records []Record
+		if err := json.Unmarshal(data, &records); err != nil {
+			report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemInvalid, Detail: err.Error()})
+			continue
+		}
+		if len(records) == 0 {
+			report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemEmpty})
+			continue
+		}
+		// records with the same timestamp are kept in the order they were
+		// written, the conflict policy resolves them on Load
+		for i := 1; i < len(records); i++ {
+			if records[i].Timestamp < records[i-1].Timestamp {
+				detail := fmt.Sprintf("record %d at %d follows %d", i, records[i].Timestamp, records[i-1].Timestamp)
+				report.Problems = append(report.Problems, fileProblem{File: file, Problem: problemUnsorted, Detail: detail, records: records})
+				break
+			}
+		}
+		for _, record := range records {
+			if report.Records == 0 || record.Timestamp < report.First {
+				report.First = record.Timestamp
+			}
+			if report.Records == 0 || record.Timestamp > report.Last {
+				report.Last = record.Timestamp
+			}
+			report.Records++
+		}
+	}
+	return report, nil
+}
+
+// printInspectReport writes a line per collection followed by a line per uid
+func printInspectReport(w io.Writer, report *storageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tUID\tFILES\tRECORDS\tFIRST\tLAST\tBYTES\tPROBLEMS")
+	for _, c := range report.Collections {
+		total := c.totals()
+		problems := len(c.Problems)
+		for _, u := range c.Uids {
+			problems += len(u.Problems)
+		}
+		fmt.Fprintf(tw, "%s\t%d uids\t%d\t%d\t%d\t%d\t%d\t%d\n", c.Name, len(c.Uids), total.Files, total.Records, total.First, total.Last, total.Bytes, problems)
+		for _, u := range c.Uids {
+			fmt.Fprintf(tw, "\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", u.Uid, u.Files, u.Records, u.First, u.Last, u.Bytes, len(u.Problems))
+		}
+	}
+	return tw.Flush()
+}
+
+// printProblems writes a line per problem and returns their number
+func printProblems(w io.Writer, report *storageReport) int {
+	problems := report.problems()
+	for _, p := range problems {
+		if p.Detail != "" {
+			fmt.Fprintf(w, "%s: %s: %s\n", p.File, p.Problem, p.Detail)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", p.File, p.Problem)
+		}
+	}
+	return len(problems)
+}
+
+// repairStorage fixes the problems found by inspectStorage. Unsorted files
+// are rewritten in order, records with the same timestamp are resolved with
+// the conflict policy the patterns give their collection, like Load does.
+// Empty and leftover files are removed. Files that can't be read are moved
+// to the quarantine directory of the storage directory. With dryRun, the
+// actions are only returned.
+func repairStorage(storageDir string, report *storageReport, conflicts []Collection, dryRun bool) ([]string, error) {
+	var actions []string
+	for _, c := range report.Collections {
+		config, _ := matchCollection(conflicts, c.Name)
+		for _, p := range c.problems() {
+			switch p.Problem {
+			case problemUnsorted:
+				actions = append(actions, "rewrite "+p.File)
+				if dryRun {
+					continue
+				}
+				data, err := json.Marshal(sortRecords(p.records, config.Conflict))
+				if err != nil {
+					return actions, err
+				}
+				if err := writeFileAtomic(p.File, data); err != nil {
+					return actions, err
+				}
+			case problemEmpty, problemLeftover:
+				actions = append(actions, "remove "+p.File)
+				if dryRun {
+					continue
+				}
+				if err := os.Remove(p.File); err != nil {
+					return actions, err
+				}
+			default:
+				relative := strings.TrimPrefix(strings.TrimPrefix(p.File, storageDir), "/")
+				target := path.Join(storageDir, quarantineDir, relative)
+				actions = append(actions, "quarantine "+p.File+" to "+target)
+				if dryRun {
+					continue
+				}
+				if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+					return actions, err
+				}
+				if err := os.Rename(p.File, target); err != nil {
+					return actions, err
+				}
+			}
+		}
+	}
+	return actions, nil
+}
+
+// sortRecords orders records by timestamp, replaying them in the order they
+// were written so records with the same timestamp follow the conflict policy
+func sortRecords(records []Record, conflict string) []Record {
+	s := &series{}
+	for _, record := range records {
+		s.replay(record, conflict)
+	}
+	return s.rangeRecords(s.firstTimestamp(), s.lastTimestamp())
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInspectStorage(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+
+	report, err := inspectStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collections) != 1 || len(report.Collections[0].Uids) != 2 {
+		t.Fatalf("Expected 1 collection with 2 uids, got %+v", report.Collections)
+	}
+	total := report.Collections[0].totals()
+	if total.Files != 2 || total.Records != 12 || total.First != 1 || total.Last != 10 || total.Bytes == 0 {
+		t.Errorf("Expected 2 files and 12 records from 1 to 10, got %+v", total)
+	}
+	if problems := report.problems(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	var buf bytes.Buffer
+	if err := printInspectReport(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 4 {
+		t.Errorf("Expected a header, a collection and 2 uids, got %q", buf.String())
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	dir := t.TempDir()
+	flushTestDatabase(t, dir)
+	uidDir := path.Join(dir, "test", "1")
+	unsorted, _ := json.Marshal([]Record{{Timestamp: 30, Data: "a"}, {Timestamp: 20, Data: "b"}, {Timestamp: 30, Data: "c"}})
+	files := map[string]string{
+		"100.json":     string(unsorted),
+		"200.json":     `[{"ts":1,`,
+		"300.json":     `[]`,
+		"400.json.tmp": `[]`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(path.Join(uidDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := inspectStorage(dir, []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problems []string
+	for _, p := range report.problems() {
+		problems = append(problems, path.Base(p.File)+" "+p.Problem)
+	}
+	expected := []string{"100.json not sorted", "200.json invalid json", "300.json empty", "400.json.tmp leftover temporary file"}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+
+	// a dry run changes nothing
+	actions, err := repairStorage(dir, report, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 4 {
+		t.Errorf("Expected 4 actions, got %v", actions)
+	}
+	if data, _ := os.ReadFile(path.Join(uidDir, "100.json")); string(data) != string(unsorted) {
+		t.Errorf("Expected the dry run not to rewrite files")
+	}
+
+	if _, err := repairStorage(dir, report, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, quarantineDir, "test", "1", "200.json")); err != nil {
+		t.Errorf("Expected the invalid file in quarantine, got %v", err)
+	}
+	report, err = inspectStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := report.problems(); len(problems) != 0 {
+		t.Errorf("Expected no problems after repair, got %v", problems)
+	}
+
+	db := NewDatabase("test", dir, 0)
+	defer db.Stop()
+	records := db.GetRecordsForUser("1", 20, 30)
+	if len(records) != 2 || records[0].Data != "b" || records[1].Data != "c" {
+		t.Errorf("Expected the repaired records, got %v", records)
+	}
+}
+
+func TestVerifyAndRepairConflictAll(t *testing.T) {
+	dir := t.TempDir()
+	collection := Collection{Name: "events", TTL: 1, Conflict: conflictAll}
+	db, err := openDatabase("events", collection, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b", "c"} {
+		db.Insert("1", 10, data)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Stop()
+
+	// records with the same timestamp are healthy
+	report, err := inspectStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := report.problems(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+	if result, err := compactCollection(dir, "events", conflictAll, true); err != nil || len(result.Skipped) != 0 {
+		t.Errorf("Expected no uid to be skipped, got %+v (%v)", result, err)
+	}
+
+	// an unsorted file keeps them in the order they were written
+	unsorted, _ := json.Marshal([]Record{{Timestamp: 30, Data: "d"}, {Timestamp: 20, Data: "e"}, {Timestamp: 30, Data: "f"}, {Timestamp: 20, Data: "g"}})
+	if err := os.WriteFile(path.Join(dir, "events", "1", "100.json"), unsorted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = inspectStorage(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repairStorage(dir, report, []Collection{collection}, false); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := openDatabase("events", collection, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Stop()
+	var data []string
+	for _, record := range loaded.GetRecordsForUser("1", 0, 100) {
+		data = append(data, record.Data)
+	}
+	if strings.Join(data, "") != "abcegdf" {
+		t.Errorf("Expected every record in order, got %v", data)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often the progress of a load is logged
+const loadProgressInterval = 5 * time.Second
+
+// defaultLoadConcurrency is the number of uids read in parallel by Load
+func defaultLoadConcurrency() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// loadProgress counts what a load has read so far and logs it periodically
+type loadProgress struct {
+	name    string
+	total   int
+	start   time.Time
+	uids    atomic.Int64
+	files   atomic.Int64
+	records atomic.Int64
+	bytes   atomic.Int64
+	done    chan struct{}
+}
+
+func newLoadProgress(name string, total int, interval time.Duration) *loadProgress {
+	p := &loadProgress{
+		name:  name,
+		total: total,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log("Loading")
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *loadProgress) add(files int, records int, bytes int64) {
+	p.files.Add(int64(files))
+	p.records.Add(int64(records))
+	p.bytes.Add(bytes)
+}
+
+func (p *loadProgress) log(prefix string) {
+	elapsed := time.Since(p.start).Seconds()
+	records := p.records.Load()
+	log.Printf("%s %s: %d/%d uids, %d files, %d records, %.0f records/s, %.1f MB/s",
+		prefix, p.name, p.uids.Load(), p.total, p.files.Load(), records,
+		float64(records)/elapsed, float64(p.bytes.Load())/(1<<20)/elapsed)
+}
+
+// stop ends the periodic logging and logs the totals
+func (p *loadProgress) stop() {
+	close(p.done)
+	p.log("Loaded")
+}
+
+// readSeries decodes the flushed files of a uid into a new series, records
+// with the same timestamp are replayed with the conflict policy. stored
+// converts the records when it's not nil.
+func readSeries(dir string, progress *loadProgress, stored func(Record) Record, conflict string) (*series, error) {
+	s := &series{}
+	err := readUidFiles(dir, func(records []Record, size int64) {
+		for _, record := range records {
+			if stored != nil {
+				record = stored(record)
+			}
+			// records loaded from disk never need a restore, this can't fail
+			s.replay(record, conflict)
+		}
+		s.bytesOnDisk += size
+		if progress != nil {
+			progress.add(1, len(records), size)
+		}
+	})
+	return s, err
+}
+
+// loadUids reads the flushed files of the uids with a pool of workers. Every
+// uid is decoded into its own series without locking, only storing it in its
+// shard takes the lock of the shard.
+func (db *Database) loadUids(dir string, uids []string) {
+	if len(uids) == 0 {
+		return
+	}
+	progress := newLoadProgress(db.name, len(uids), loadProgressInterval)
+	defer progress.stop()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range max(1, db.loadConcurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := range jobs {
+				s, err := readSeries(path.Join(dir, uid), progress, db.storedRecord, db.config.Load().Conflict)
+				if err != nil {
+					log.Printf("Error reading directory for user %s: %v", uid, err)
+				}
+				progress.uids.Add(1)
+				if s.len() == 0 {
+					continue
+				}
+				sh := db.shardFor(uid)
+				sh.mu.Lock()
+				db.storeSeries(sh, uid, s)
+				sh.mu.Unlock()
+			}
+		}()
+	}
+	for _, uid := range uids {
+		jobs <- uid
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// storeSeries adds a series read from disk to the shard, replacing the one
+// registered from the index if any. The caller must hold the lock of the shard.
+func (db *Database) storeSeries(sh *shard, uid string, s *series) {
+	old := sh.get(uid)
+	if old != nil {
+		db.untrackSeries(old)
+	}
+	sh.uids.Store(uid, s)
+	db.sortedUids.add(uid)
+	db.uidCount.Add(1)
+	db.recordCount.Add(int64(s.len()))
+	db.bytesOnDisk.Add(s.bytesOnDisk)
+	db.trackMemory(s.bytes)
+	if s.len() > 0 {
+		sh.widen(s.firstTimestamp(), s.lastTimestamp())
+	}
+	// the index may be behind the files, its bounds may not hold anymore
+	if old != nil && old.len() > 0 && (s.len() == 0 || s.firstTimestamp() > old.firstTimestamp() || s.lastTimestamp() < old.lastTimestamp()) {
+		sh.shrink(old.firstTimestamp(), old.lastTimestamp())
+	}
+}
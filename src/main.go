@@ -1,64 +1,60 @@
 package main
 
 import (
-	"log"
-	"strings"
+	"fmt"
+	"os"
+	"runtime"
 
 	"github.com/spf13/cobra"
 )
 
-func main() {
-	rootCmd := &cobra.Command{
-		Use:   "start",
-		Short: "Start the server",
-		Long:  `Start the server with specific arguments`,
-	}
-
-	rootCmd.Flags().StringP("secret-key", "s", "", "The secret key for the server")
-	rootCmd.Flags().StringArrayP("collection", "c", []string{}, "The collection names followed by colon and ttl in minutes. Accepts wildcards. Example: -c 'public:60' -c 'group.*:120'")
-	rootCmd.Flags().StringP("storage-dir", "d", "", "The directory to store the data, if not set, data will not be stored on disk")
-	rootCmd.Flags().IntP("storage-interval", "i", 0, "The interval to flush the data to the storage in seconds, if not set, data will not be flushed to the storage")
-
-	rootCmd.Execute()
-
-	secretKey, err := rootCmd.Flags().GetString("secret-key")
-	if err != nil {
-		log.Fatal(err)
-	}
-	collections, err := rootCmd.Flags().GetStringArray("collection")
-	if err != nil {
-		log.Fatal(err)
-	}
-	storageDir, err := rootCmd.Flags().GetString("storage-dir")
-	if err != nil {
-		log.Fatal(err)
-	}
-	storageInterval, err := rootCmd.Flags().GetInt("storage-interval")
-	if err != nil {
-		log.Fatal(err)
-	}
+// build info, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
 
-	if secretKey == "" {
-		log.Fatal("secret-key is not set")
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
 	}
+}
 
-	if len(collections) == 0 {
-		log.Fatal("collection is not set")
-	}
+func newRootCmd() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:   "tsdb",
+		Short: "A time series database served over websockets",
+		// usage is printed for flag errors only, not for errors of the commands
+		SilenceUsage: true,
+	}
+	rootCmd.AddCommand(
+		newServeCmd(),
+		newSnapshotCmd(),
+		newRestoreCmd(),
+		newExportCmd(),
+		newImportCmd(),
+		newInspectCmd(),
+		newVerifyCmd(),
+		newRepairCmd(),
+		newCompactCmd(),
+		newBenchCmd(),
+		newVersionCmd(),
+	)
+	return rootCmd
+}
 
-	// check that collections items have a ttl
-	for _, collection := range collections {
-		parts := strings.Split(collection, ":")
-		if len(parts) != 2 {
-			log.Fatal("collection must have a ttl", collection)
-		}
-	}
-	log.Printf("secret-key: %s", secretKey)
-	log.Printf("collections: %v", collections)
-	log.Printf("storage-dir: %s", storageDir)
-	log.Printf("storage-interval: %d", storageInterval)
+func versionString() string {
+	return fmt.Sprintf("tsdb %s (commit %s, built %s, %s)", version, commit, buildDate, runtime.Version())
+}
 
-	if err := startServer(secretKey, collections, storageDir, storageInterval); err != nil {
-		log.Fatal(err)
+func newVersionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and build info",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Fprintln(cmd.OutOrStdout(), versionString())
+		},
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const manifestFile = "manifest.json"
+
+// manifest is stored at the root of a collection directory and records the
+// state that can't be derived from the uid directories, like deletions
+// that haven't completed on disk yet.
+type manifest struct {
+	// uid -> time of the deletion in unix nanoseconds. Flushed files written
+	// before that time are removed on Load.
+	Tombstones map[string]int64 `json:"tombstones"`
+	// uid -> bounds of the records on disk, used to serve the uids before
+	// their records are loaded. It's a hint, loading a uid corrects it.
+	Index map[string]indexEntry `json:"index,omitempty"`
+	// time unit of the timestamps of the records, seconds when empty
+	Unit string `json:"unit,omitempty"`
+}
+
+func newManifest() *manifest {
+	return &manifest{Tombstones: make(map[string]int64), Index: make(map[string]indexEntry)}
+}
+
+func readManifest(dir string) (*manifest, error) {
+	m := newManifest()
+	data, err := os.ReadFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest in %s: %w", dir, err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error unmarshaling manifest in %s: %w", dir, err)
+	}
+	if m.Tombstones == nil {
+		m.Tombstones = make(map[string]int64)
+	}
+	if m.Index == nil {
+		m.Index = make(map[string]indexEntry)
+	}
+	return m, nil
+}
+
+func (m *manifest) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, manifestFile), data)
+}
+
+// flushFileTime returns the time a flushed file was written in unix
+// nanoseconds. Files written before nanosecond names were used are named
+// after the unix time in seconds.
+func flushFileTime(name string) (int64, bool) {
+	ts, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if ts < 1e12 {
+		ts *= 1e9
+	}
+	return ts, true
+}
+
+// removeFilesBefore removes the flushed files of a uid written at or before
+// the given time and removes the directory when it's left empty
+func removeFilesBefore(dir string, before int64) error {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+	remaining := 0
+	for _, file := range files {
+		// evicted chunks are copies of flushed records
+		if file.Name() == evictedDir {
+			if err := os.RemoveAll(path.Join(dir, file.Name())); err != nil {
+				return fmt.Errorf("error removing evicted chunks in %s: %w", dir, err)
+			}
+			continue
+		}
+		ts, ok := flushFileTime(file.Name())
+		if !ok || ts > before {
+			remaining++
+			continue
+		}
+		if err := os.Remove(path.Join(dir, file.Name())); err != nil {
+			return fmt.Errorf("error removing file %s: %w", file.Name(), err)
+		}
+	}
+	if remaining == 0 {
+		return os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// name of the directory inside a uid directory holding evicted chunks
+const evictedDir = "evicted"
+
+var ErrMemoryLimit = errors.New("memory limit reached")
+
+// memoryBudget limits the memory used by the records of all databases. When
+// the limit is reached the oldest flushed chunks of the databases stored on
+// disk are evicted until the usage drops below the low watermark.
+type memoryBudget struct {
+	limit     int64
+	used      atomic.Int64
+	mu        sync.Mutex // serializes reclaims and protects databases
+	databases []*Database
+}
+
+// the usage a reclaim brings the budget down to, as a percentage of the limit
+const lowWatermarkPercent = 90
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// attach accounts for the memory of the database, which must not be in use yet
+func (b *memoryBudget) attach(db *Database) {
+	b.mu.Lock()
+	db.budget = b
+	b.databases = append(b.databases, db)
+	b.used.Add(db.memoryBytes.Load())
+	b.mu.Unlock()
+	b.reclaim()
+}
+
+// detach stops evicting from the database. Its records must be removed
+// first, which already returned their memory to the budget.
+func (b *memoryBudget) detach(db *Database) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, other := range b.databases {
+		if other == db {
+			b.databases = append(b.databases[:i], b.databases[i+1:]...)
+			return
+		}
+	}
+}
+
+// allow reports whether size more bytes fit in the budget, evicting chunks
+// if needed. Evicting takes the locks of the shards, the caller must not hold
+// any.
+func (b *memoryBudget) allow(size int64) bool {
+	if b.fits(size) {
+		return true
+	}
+	b.reclaim()
+	return b.fits(size)
+}
+
+// fits reports whether size more bytes fit in the budget without evicting
+func (b *memoryBudget) fits(size int64) bool {
+	return b.used.Load()+size <= b.limit
+}
+
+// reclaim evicts the oldest flushed chunks across all databases stored on
+// disk until the usage is below the low watermark
+func (b *memoryBudget) reclaim() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used.Load() <= b.limit {
+		return
+	}
+	target := b.used.Load() - b.limit*lowWatermarkPercent/100
+
+	var candidates []evictionCandidate
+	for _, db := range b.databases {
+		candidates = append(candidates, db.evictionCandidates()...)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].last < candidates[j].last
+	})
+
+	freed := int64(0)
+	evicted := 0
+	for _, candidate := range candidates {
+		if freed >= target {
+			break
+		}
+		bytes := candidate.db.evictChunk(candidate)
+		if bytes > 0 {
+			freed += bytes
+			evicted++
+		}
+	}
+	log.Println("Evicted", evicted, "chunks", freed, "bytes to disk, using", b.used.Load(), "of", b.limit, "bytes")
+}
+
+// evictionCandidate is a chunk that is fully flushed and can be dropped from memory
+type evictionCandidate struct {
+	db    *Database
+	uid   string
+	chunk *chunk
+	last  int64
+}
+
+// evictionCandidates returns the chunks of the database that can be evicted,
+// that is every flushed chunk but the last one of each uid
+func (db *Database) evictionCandidates() []evictionCandidate {
+	if db.storageDir == "" {
+		return nil
+	}
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	var candidates []evictionCandidate
+	for _, sh := range db.shards {
+		sh.mu.RLock()
+		sh.each(func(uid string, s *series) bool {
+			if len(s.chunks) == 0 {
+				return true
+			}
+			flushed := db.flushedGen[uid]
+			for _, c := range s.chunks[:len(s.chunks)-1] {
+				if c.evicted == nil && c.maxGen <= flushed {
+					candidates = append(candidates, evictionCandidate{db: db, uid: uid, chunk: c, last: c.last()})
+				}
+			}
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	return candidates
+}
+
+// evictChunk writes a candidate chunk to disk and returns the bytes freed.
+// The chunk is skipped if it changed since it was selected.
+func (db *Database) evictChunk(candidate evictionCandidate) int64 {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	sh := db.shardFor(candidate.uid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	s := sh.get(candidate.uid)
+	if s == nil || candidate.chunk.maxGen > db.flushedGen[candidate.uid] {
+		return 0
+	}
+	i := s.chunkAfter(candidate.chunk.last())
+	if i >= len(s.chunks)-1 || s.chunks[i] != candidate.chunk {
+		return 0
+	}
+	freed, err := s.evict(candidate.chunk, path.Join(db.storageDir, db.name, candidate.uid, evictedDir))
+	if err != nil {
+		log.Println("Error evicting chunk:", err)
+		return 0
+	}
+	db.trackMemory(-freed)
+	return freed
+}
+
+// trackMemory records a change in the memory used by the records
+func (db *Database) trackMemory(delta int64) {
+	if delta == 0 {
+		return
+	}
+	db.memoryBytes.Add(delta)
+	if db.budget != nil {
+		db.budget.used.Add(delta)
+	}
+}
+
+// memoryLimitError explains why an insert was refused
+func (db *Database) memoryLimitError() error {
+	if db.storageDir == "" {
+		return fmt.Errorf("%w: collection %s is memory-only and no other data can be evicted", ErrMemoryLimit, db.name)
+	}
+	return fmt.Errorf("%w: no flushed data of collection %s can be evicted until the next flush", ErrMemoryLimit, db.name)
+}
+
+// parseByteSize parses sizes like 512MB or 2GB, a plain number is in bytes
+func parseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimitEvictsFlushedChunks(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabase("test", dir, 1)
+	defer db.Stop()
+	budget := newMemoryBudget(1 << 30)
+	budget.attach(db)
+
+	for i := 0; i < 10*chunkSize; i++ {
+		if err := db.Insert("1", int64(i), fmt.Sprintf("test_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := db.Stats().MemoryBytes
+	if used == 0 || budget.used.Load() != used {
+		t.Fatalf("Expected the budget to track %d bytes, got %d", used, budget.used.Load())
+	}
+
+	// nothing is flushed yet, so nothing can be evicted
+	budget.limit = used / 2
+	if err := db.Insert("1", 10*chunkSize, "test"); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("Expected the insert to be refused before a flush, got %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("1", 10*chunkSize, "test"); err != nil {
+		t.Fatalf("Expected the insert to succeed after evicting, got %v", err)
+	}
+	if memory := db.Stats().MemoryBytes; memory > budget.limit {
+		t.Errorf("Expected memory below %d, got %d", budget.limit, memory)
+	}
+	evicted, _ := os.ReadDir(path.Join(dir, "test", "1", evictedDir))
+	if len(evicted) == 0 {
+		t.Errorf("Expected evicted chunks on disk")
+	}
+
+	// range queries page the evicted chunks back in
+	records := db.GetRecordsForUser("1", 0, 10*chunkSize)
+	if len(records) != 10*chunkSize+1 {
+		t.Fatalf("Expected %d records, got %d", 10*chunkSize+1, len(records))
+	}
+	for i, record := range records[:10*chunkSize] {
+		if record.Data != fmt.Sprintf("test_%d", i) {
+			t.Fatalf("Expected test_%d, got %s", i, record.Data)
+		}
+	}
+	if record := db.GetEarliestRecordForUser("1", 0); record == nil || record.Data != "test_0" {
+		t.Errorf("Expected test_0, got %v", record)
+	}
+
+	// evicted chunks are copies of flushed data and are dropped on load, the
+	// last record wasn't flushed
+	loaded := NewDatabase("test", dir, 1)
+	defer loaded.Stop()
+	if stats := loaded.Stats(); stats.Records != 10*chunkSize {
+		t.Errorf("Expected the %d flushed records after load, got %d", 10*chunkSize, stats.Records)
+	}
+	if _, err := os.Stat(path.Join(dir, "test", "1", evictedDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected evicted chunks to be removed on load, got %v", err)
+	}
+}
+
+func TestMemoryLimitMergedInsert(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDatabase("test", Collection{Name: "test", TTL: 1, Conflict: conflictMerge}, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Stop()
+	budget := newMemoryBudget(1 << 30)
+	budget.attach(db)
+	for i := 0; i < 4*chunkSize; i++ {
+		if err := db.Insert("1", int64(i), fmt.Sprintf(`{"value":%d}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reclaiming memory for a merged record takes the lock of its shard
+	budget.limit = budget.used.Load() - 1
+	done := make(chan error)
+	go func() {
+		done <- db.Insert("1", 0, `{"other":1}`)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected the insert to succeed after evicting, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the merged insert not to deadlock")
+	}
+	if record := db.GetEarliestRecordForUser("1", 0); record == nil || record.Data != `{"other":1,"value":0}` {
+		t.Errorf("Expected the merged record, got %+v", record)
+	}
+}
+
+func TestMemoryLimitRefusesMemoryOnlyInserts(t *testing.T) {
+	db := NewDatabase("test", "", 1)
+	defer db.Stop()
+	budget := newMemoryBudget(10 * (recordOverhead + 10))
+	budget.attach(db)
+
+	inserted := 0
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		if err = db.Insert("1", int64(i), "0123456789"); err == nil {
+			inserted++
+		}
+	}
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("Expected a memory limit error, got %v", err)
+	}
+	if inserted != 10 {
+		t.Errorf("Expected 10 records to fit, got %d", inserted)
+	}
+
+	// deleting records frees memory for new ones
+	if _, err := db.DeleteRecords("1", 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("1", 100, "0123456789"); err != nil {
+		t.Errorf("Expected the insert to succeed after deleting, got %v", err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		err      bool
+	}{
+		{"1024", 1024, false},
+		{"512MB", 512 << 20, false},
+		{"2gb", 2 << 30, false},
+		{"1.5 KB", 1536, false},
+		{"10B", 10, false},
+		{"1TB", 1 << 40, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1GB", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("parseByteSize(%q) error = %v, want error %v", tt.input, err, tt.err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseByteSize(%q) = %d, want %d", tt.input, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// name of the file in the storage directory keeping the collections created,
+// updated and dropped at runtime
+const collectionsFile = "collections.json"
+
+// prefix of the directories of dropped collections while they're removed
+const droppedDirPrefix = ".dropped-"
+
+// collectionsMetadata is the content of the collections file. It's merged
+// with the patterns given as flags when the server starts: collections
+// override the flags with the same pattern and dropped removes them.
+type collectionsMetadata struct {
+	Collections []Collection `json:"collections"`       // created or updated at runtime
+	Dropped     []string     `json:"dropped,omitempty"` // patterns given as flags and dropped at runtime
+}
+
+// registry holds the collection patterns and the databases of the
+// collections matching them. Handlers run concurrently, every access to the
+// databases goes through it.
+type registry struct {
+	mu          sync.RWMutex
+	opts        storageOptions
+	flags       map[string]bool // patterns given as flags
+	collections []Collection    // flags merged with the metadata, in configuration order
+	metadata    collectionsMetadata
+	databases   map[string]*Database
+}
+
+// newRegistry merges the patterns given as flags with the collections file
+// of the storage directory and opens the stored collections they match
+func newRegistry(opts storageOptions, flags []Collection) (*registry, error) {
+	r := &registry{
+		opts:      opts,
+		flags:     make(map[string]bool),
+		databases: make(map[string]*Database),
+	}
+	for _, collection := range flags {
+		r.flags[collection.Name] = true
+	}
+	if err := r.readMetadata(); err != nil {
+		return nil, err
+	}
+
+	dropped := make(map[string]bool)
+	for _, pattern := range r.metadata.Dropped {
+		dropped[pattern] = true
+	}
+	overrides := make(map[string]Collection)
+	for _, collection := range r.metadata.Collections {
+		overrides[collection.Name] = collection
+	}
+	for _, collection := range flags {
+		if dropped[collection.Name] {
+			log.Printf("Collection pattern %s was dropped at runtime, ignoring its flag", collection.Name)
+			continue
+		}
+		if override, ok := overrides[collection.Name]; ok {
+			collection = override
+			delete(overrides, collection.Name)
+		}
+		r.collections = append(r.collections, collection)
+	}
+	for _, collection := range r.metadata.Collections {
+		if _, ok := overrides[collection.Name]; ok {
+			r.collections = append(r.collections, collection)
+		}
+	}
+
+	if opts.dir == "" {
+		log.Println("Storage directory is not set, data will not be stored on disk")
+		return r, nil
+	}
+	log.Println("Setting up databases")
+	if err := os.MkdirAll(opts.dir, 0755); err != nil {
+		return nil, err
+	}
+	r.removeDroppedDirs()
+	if err := r.openStored(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *registry) readMetadata() error {
+	if r.opts.dir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path.Join(r.opts.dir, collectionsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &r.metadata); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %w", collectionsFile, err)
+	}
+	for _, collection := range r.metadata.Collections {
+		if err := collection.validate(); err != nil {
+			return fmt.Errorf("invalid collection in %s: %w", collectionsFile, err)
+		}
+	}
+	return nil
+}
+
+// patternFlags configure collection patterns like the flags of serve, for
+// the commands working on a storage directory without a server
+type patternFlags struct {
+	types     []string
+	schemas   []string
+	conflicts []string
+	units     []string
+}
+
+// storagePatterns returns the collection patterns a server would use with a
+// storage directory: the ones the flags configure merged with the
+// collections file, which overrides the flags with the same pattern.
+// Patterns dropped at runtime are left out.
+func storagePatterns(storageDir string, flags patternFlags) ([]Collection, error) {
+	r := &registry{opts: storageOptions{dir: storageDir}}
+	if err := r.readMetadata(); err != nil {
+		return nil, err
+	}
+	var flagged []Collection
+	for _, specs := range [][]string{flags.types, flags.schemas, flags.conflicts, flags.units} {
+		for _, spec := range specs {
+			pattern, _, _ := strings.Cut(spec, ":")
+			if slices.ContainsFunc(flagged, func(c Collection) bool { return c.Name == pattern }) {
+				continue
+			}
+			if err := validatePattern(pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern in %q: %w", spec, err)
+			}
+			flagged = append(flagged, Collection{Name: pattern})
+		}
+	}
+	if err := parseTypes(flags.types, flagged); err != nil {
+		return nil, err
+	}
+	if err := parseSchemas(flags.schemas, flagged); err != nil {
+		return nil, err
+	}
+	if err := parseConflicts(flags.conflicts, flagged); err != nil {
+		return nil, err
+	}
+	if err := parseUnits(flags.units, flagged); err != nil {
+		return nil, err
+	}
+	collections := slices.Clone(r.metadata.Collections)
+	for _, collection := range flagged {
+		if slices.Contains(r.metadata.Dropped, collection.Name) {
+			continue
+		}
+		if !slices.ContainsFunc(collections, func(c Collection) bool { return c.Name == collection.Name }) {
+			collections = append(collections, collection)
+		}
+	}
+	return collections, nil
+}
+
+// writeMetadata persists the runtime changes, the caller must hold mu and
+// only apply the changes once they're written
+func (r *registry) writeMetadata(metadata collectionsMetadata) error {
+	if r.opts.dir == "" {
+		log.Println("Storage directory is not set, collection changes only last until a restart")
+		return nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(r.opts.dir, collectionsFile), data)
+}
+
+// removeDroppedDirs finishes removing the directories of collections and
+// rollup tiers dropped before a crash
+func (r *registry) removeDroppedDirs() {
+	removeDroppedDirs(r.opts.dir)
+	tiers, err := os.ReadDir(path.Join(r.opts.dir, rollupsDir))
+	if err != nil {
+		return
+	}
+	for _, tier := range tiers {
+		if tier.IsDir() {
+			removeDroppedDirs(path.Join(r.opts.dir, rollupsDir, tier.Name()))
+		}
+	}
+}
+
+func removeDroppedDirs(storageDir string) {
+	dirs, err := os.ReadDir(storageDir)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && strings.HasPrefix(dir.Name(), droppedDirPrefix) {
+			if err := os.RemoveAll(path.Join(storageDir, dir.Name())); err != nil {
+				log.Printf("Error removing directory %s: %v", dir.Name(), err)
+			}
+		}
+	}
+}
+
+// openStored opens the stored collections matched by a pattern that aren't
+// open yet, the caller must hold mu unless the registry isn't shared yet
+func (r *registry) openStored() error {
+	opened, err := r.openMatching(r.collections)
+	if err != nil {
+		return err
+	}
+	maps.Copy(r.databases, opened)
+	return nil
+}
+
+// openMatching opens the stored collections that aren't open yet and that
+// the patterns match, without adding them to the registry. When one can't be
+// opened, the ones already opened are closed. The caller must hold mu.
+func (r *registry) openMatching(collections []Collection) (map[string]*Database, error) {
+	opened := make(map[string]*Database)
+	if r.opts.dir == "" {
+		return opened, nil
+	}
+	collectionDirs, err := os.ReadDir(r.opts.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, collectionDir := range collectionDirs {
+		name := collectionDir.Name()
+		if !collectionDir.IsDir() || r.databases[name] != nil {
+			continue
+		}
+		// only the directories of configured collections are loaded
+		if collection, ok := matchCollection(collections, name); ok {
+			db, err := openDatabase(name, collection, r.opts)
+			if err != nil {
+				closeDatabases(opened)
+				return nil, err
+			}
+			opened[name] = db
+		}
+	}
+	return opened, nil
+}
+
+func closeDatabases(databases map[string]*Database) {
+	for _, db := range databases {
+		db.close()
+	}
+}
+
+// get returns the database of a collection, nil when it isn't open
+func (r *registry) get(name string) *Database {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.databases[name]
+}
+
+// getOrOpen returns the database of a collection, opening it when a pattern
+// matches the name
+func (r *registry) getOrOpen(name string) (*Database, error) {
+	if db := r.get(name); db != nil {
+		return db, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if db := r.databases[name]; db != nil {
+		return db, nil
+	}
+	collection, ok := matchCollection(r.collections, name)
+	if !ok {
+		return nil, fmt.Errorf("collection %s not found", name)
+	}
+	db, err := openDatabase(name, collection, r.opts)
+	if err != nil {
+		return nil, err
+	}
+	r.databases[name] = db
+	return db, nil
+}
+
+// all returns the open databases sorted by name
+func (r *registry) all() []*Database {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dbs := make([]*Database, 0, len(r.databases))
+	for _, db := range r.databases {
+		dbs = append(dbs, db)
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].name < dbs[j].name })
+	return dbs
+}
+
+// selectDatabases returns the named databases sorted by name, or all of them
+func (r *registry) selectDatabases(names []string) ([]*Database, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return selectDatabases(r.databases, names)
+}
+
+// patterns returns the configured collection patterns
+func (r *registry) patterns() []Collection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Collection{}, r.collections...)
+}
+
+func (r *registry) find(pattern string) int {
+	for i, collection := range r.collections {
+		if collection.Name == pattern {
+			return i
+		}
+	}
+	return -1
+}
+
+// withCollection returns a copy of the metadata recording a created or
+// updated collection
+func (m collectionsMetadata) withCollection(collection Collection) collectionsMetadata {
+	updated := collectionsMetadata{
+		Collections: slices.Clone(m.Collections),
+		Dropped:     removeString(m.Dropped, collection.Name),
+	}
+	for i, other := range updated.Collections {
+		if other.Name == collection.Name {
+			updated.Collections[i] = collection
+			return updated
+		}
+	}
+	updated.Collections = append(updated.Collections, collection)
+	return updated
+}
+
+// withoutPattern returns a copy of the metadata recording a dropped pattern,
+// a pattern given as a flag is remembered as dropped
+func (m collectionsMetadata) withoutPattern(pattern string, flag bool) collectionsMetadata {
+	updated := collectionsMetadata{
+		Collections: slices.DeleteFunc(slices.Clone(m.Collections), func(other Collection) bool {
+			return other.Name == pattern
+		}),
+		Dropped: slices.Clone(m.Dropped),
+	}
+	if flag {
+		updated.Dropped = append(updated.Dropped, pattern)
+	}
+	return updated
+}
+
+// reconfigure matches the open databases against the patterns again, the
+// caller must hold mu. It returns the databases no pattern matches anymore.
+func (r *registry) reconfigure() []*Database {
+	var unmatched []*Database
+	for name, db := range r.databases {
+		collection, ok := matchCollection(r.collections, name)
+		if !ok {
+			unmatched = append(unmatched, db)
+			continue
+		}
+		db.configure(collection, r.opts)
+	}
+	return unmatched
+}
+
+// checkUnits refuses patterns that would change the time unit of an open
+// collection with records, the caller must hold mu
+func (r *registry) checkUnits(collections []Collection) error {
+	for name, db := range r.databases {
+		collection, ok := matchCollection(collections, name)
+		current := unitName(db.config.Load().Unit)
+		if ok && unitName(collection.Unit) != current && db.uidCount.Load() > 0 {
+			return fmt.Errorf("collection %s has records with %s timestamps, its unit can't change", name, current)
+		}
+	}
+	return nil
+}
+
+// create adds a collection pattern and opens the stored collections it matches
+func (r *registry) create(collection Collection) error {
+	if err := collection.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.find(collection.Name) >= 0 {
+		return fmt.Errorf("collection pattern %s already exists", collection.Name)
+	}
+	collections := append(slices.Clone(r.collections), collection)
+	if err := r.checkUnits(collections); err != nil {
+		return err
+	}
+	// stored collections are opened before the pattern is saved, so one
+	// stored with another unit doesn't keep the server from starting again
+	opened, err := r.openMatching(collections)
+	if err != nil {
+		return err
+	}
+	metadata := r.metadata.withCollection(collection)
+	if err := r.writeMetadata(metadata); err != nil {
+		closeDatabases(opened)
+		return err
+	}
+	r.collections, r.metadata = collections, metadata
+	// collections that are open may match the new pattern better
+	r.reconfigure()
+	maps.Copy(r.databases, opened)
+	log.Printf("Created collection pattern %s", collection.Name)
+	return nil
+}
+
+// update changes the ttl and limits of a collection pattern and of the open
+// collections matching it, and opens the stored collections it matches
+func (r *registry) update(pattern string, fn func(*Collection)) (Collection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(pattern)
+	if i < 0 {
+		return Collection{}, fmt.Errorf("collection pattern %s not found", pattern)
+	}
+	collection := r.collections[i]
+	fn(&collection)
+	if err := collection.validate(); err != nil {
+		return Collection{}, err
+	}
+	collections := slices.Clone(r.collections)
+	collections[i] = collection
+	if err := r.checkUnits(collections); err != nil {
+		return Collection{}, err
+	}
+	opened, err := r.openMatching(collections)
+	if err != nil {
+		return Collection{}, err
+	}
+	metadata := r.metadata.withCollection(collection)
+	if err := r.writeMetadata(metadata); err != nil {
+		closeDatabases(opened)
+		return Collection{}, err
+	}
+	r.collections, r.metadata = collections, metadata
+	r.reconfigure()
+	maps.Copy(r.databases, opened)
+	log.Printf("Updated collection pattern %s", pattern)
+	return collection, nil
+}
+
+// drop removes a collection with its records in memory and on disk
+func (r *registry) drop(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	db := r.databases[name]
+	if db == nil {
+		return fmt.Errorf("collection %s not found", name)
+	}
+	return r.dropLocked(db)
+}
+
+// dropPattern removes a collection pattern and drops the collections that no
+// other pattern matches. It returns the names of the dropped collections.
+func (r *registry) dropPattern(pattern string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(pattern)
+	if i < 0 {
+		return nil, fmt.Errorf("collection pattern %s not found", pattern)
+	}
+	metadata := r.metadata.withoutPattern(pattern, r.flags[pattern])
+	if err := r.writeMetadata(metadata); err != nil {
+		return nil, err
+	}
+	r.collections = slices.Delete(slices.Clone(r.collections), i, i+1)
+	r.metadata = metadata
+	log.Printf("Dropped collection pattern %s", pattern)
+
+	dropped := []string{}
+	for _, db := range r.reconfigure() {
+		if err := r.dropLocked(db); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, db.name)
+	}
+	sort.Strings(dropped)
+	return dropped, nil
+}
+
+func (r *registry) dropLocked(db *Database) error {
+	delete(r.databases, db.name)
+	log.Printf("Dropping collection %s", db.name)
+	return db.Drop()
+}
+
+// removeString returns a copy of values without value
+func removeString(values []string, value string) []string {
+	return slices.DeleteFunc(slices.Clone(values), func(other string) bool {
+		return other == value
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestRegistryRuntimeChanges(t *testing.T) {
+	dir := t.TempDir()
+	opts := storageOptions{dir: dir}
+	flags := []Collection{{Name: "users.*", TTL: 1}, {Name: "logs", TTL: 2}}
+	reg, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.create(Collection{Name: "tenant.**", TTL: 3, MaxUids: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.create(Collection{Name: "tenant.**", TTL: 3}); err == nil {
+		t.Errorf("Expected an error creating an existing pattern")
+	}
+	if err := reg.create(Collection{Name: "bad..pattern", TTL: 3}); err == nil {
+		t.Errorf("Expected an error creating an invalid pattern")
+	}
+	db, err := reg.getOrOpen("tenant.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := db.config.Load(); config.Name != "tenant.**" || config.TTL != 3 || config.MaxUids != 10 {
+		t.Errorf("Expected the created pattern, got %+v", config)
+	}
+
+	// updates apply to the open collections
+	if _, err := reg.update("users.*", func(c *Collection) { c.TTL = 5 }); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := reg.getOrOpen("users.bob")
+	if ttl := users.config.Load().TTL; ttl != 5 {
+		t.Errorf("Expected ttl 5, got %d", ttl)
+	}
+	if _, err := reg.update("missing", func(c *Collection) {}); err == nil {
+		t.Errorf("Expected an error updating a missing pattern")
+	}
+	if _, err := reg.update("users.*", func(c *Collection) { c.TTL = -1 }); err == nil {
+		t.Errorf("Expected an error for a negative ttl")
+	}
+
+	// dropping a pattern given as a flag
+	if _, err := reg.dropPattern("logs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.getOrOpen("logs"); err == nil {
+		t.Errorf("Expected logs not to be accepted after dropping its pattern")
+	}
+
+	// the changes are merged with the flags on restart
+	restarted, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Collection{{Name: "users.*", TTL: 5}, {Name: "tenant.**", TTL: 3, MaxUids: 10}}
+	if patterns := restarted.patterns(); fmt.Sprint(patterns) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, patterns)
+	}
+
+	// creating a dropped pattern again brings it back
+	if err := restarted.create(Collection{Name: "logs", TTL: 7}); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err = newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patterns := restarted.patterns(); len(patterns) != 3 || fmt.Sprint(patterns[1]) != fmt.Sprint(Collection{Name: "logs", TTL: 7}) {
+		t.Errorf("Expected logs with ttl 7, got %v", patterns)
+	}
+}
+
+func TestRegistryFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	opts := storageOptions{dir: dir}
+	flags := []Collection{{Name: "users.*", TTL: 1}, {Name: "logs", TTL: 2}}
+	reg, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.create(Collection{Name: "tenant.**", TTL: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the file makes every write fail
+	file := path.Join(dir, collectionsFile)
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.create(Collection{Name: "metrics", TTL: 4}); err == nil {
+		t.Error("Expected the create to fail")
+	}
+	if _, err := reg.update("users.*", func(c *Collection) { c.TTL = 5 }); err == nil {
+		t.Error("Expected the update to fail")
+	}
+	if _, err := reg.dropPattern("logs"); err == nil {
+		t.Error("Expected the drop to fail")
+	}
+	expected := []Collection{{Name: "users.*", TTL: 1}, {Name: "logs", TTL: 2}, {Name: "tenant.**", TTL: 3}}
+	if patterns := reg.patterns(); fmt.Sprint(patterns) != fmt.Sprint(expected) {
+		t.Errorf("Expected the failed changes not to apply, got %v", patterns)
+	}
+
+	// the next write only saves its own change
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.update("tenant.**", func(c *Collection) { c.TTL = 6 }); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[2].TTL = 6
+	if patterns := restarted.patterns(); fmt.Sprint(patterns) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, patterns)
+	}
+}
+
+func TestOpenDatabaseLoadError(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(path.Join(dir, "logs"), 0755)
+	if err := os.WriteFile(path.Join(dir, "logs", manifestFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDatabase("logs", Collection{Name: "logs"}, storageOptions{dir: dir}); err == nil {
+		t.Error("Expected the unreadable manifest to be reported")
+	}
+	if _, err := openDatabase("logs", Collection{Name: "logs"}, storageOptions{dir: dir, lazy: true}); err == nil {
+		t.Error("Expected the unreadable manifest to be reported by a lazy load")
+	}
+}
+
+func TestRegistryCreateMatchesBetter(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "**", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("users.admin")
+	if err := reg.create(Collection{Name: "users.admin", TTL: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if config := db.config.Load(); config.Name != "users.admin" || config.TTL != 2 {
+		t.Errorf("Expected the open collection to use the new pattern, got %+v", config)
+	}
+	// the collection still matches ** when its pattern is dropped
+	dropped, err := reg.dropPattern("users.admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 0 || reg.get("users.admin") == nil {
+		t.Errorf("Expected users.admin to be kept, dropped %v", dropped)
+	}
+}
+
+func TestDropCollection(t *testing.T) {
+	dir := t.TempDir()
+	budget := newMemoryBudget(1 << 30)
+	reg, err := newRegistry(storageOptions{dir: dir, budget: budget}, []Collection{{Name: "users.*", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := reg.getOrOpen("users.a")
+	b, _ := reg.getOrOpen("users.b")
+	createRecords(a, "1", 100)
+	createRecords(b, "1", 10)
+	a.Flush()
+	b.Flush()
+
+	if err := reg.drop("users.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "users.a")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be removed, got %v", err)
+	}
+	if used, expected := budget.used.Load(), b.memoryBytes.Load(); used != expected {
+		t.Errorf("Expected the budget to only account for users.b, got %d instead of %d", used, expected)
+	}
+	if err := a.Insert("1", 1, "late"); !errors.Is(err, ErrCollectionDropped) {
+		t.Errorf("Expected inserts into a dropped collection to fail, got %v", err)
+	}
+	a.Flush()
+	if _, err := os.Stat(path.Join(dir, "users.a")); !os.IsNotExist(err) {
+		t.Errorf("Expected a flush not to write the dropped collection, got %v", err)
+	}
+	if err := reg.drop("users.a"); err == nil {
+		t.Errorf("Expected an error dropping a missing collection")
+	}
+
+	// the pattern still accepts the name, as a new empty collection
+	again, err := reg.getOrOpen("users.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := again.Stats().Uids; uids != 0 {
+		t.Errorf("Expected an empty collection, got %d uids", uids)
+	}
+
+	dropped, err := reg.dropPattern("users.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(dropped) != "[users.a users.b]" {
+		t.Errorf("Expected both collections to be dropped, got %v", dropped)
+	}
+	if _, err := os.Stat(path.Join(dir, "users.b")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory of users.b to be removed, got %v", err)
+	}
+
+	// leftovers of a drop interrupted by a crash are removed on start
+	leftover := path.Join(dir, droppedDirPrefix+"users.c-1")
+	os.MkdirAll(path.Join(leftover, "1"), 0755)
+	if _, err := newRegistry(storageOptions{dir: dir}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Expected the leftover directory to be removed, got %v", err)
+	}
+}
+
+func TestCollectionLimits(t *testing.T) {
+	db := NewDatabase("test", "", 1)
+	defer db.Stop()
+	db.config.Store(&Collection{MaxUids: 2, MaxRecordsPerUid: 3})
+	for i := range 3 {
+		if err := db.Insert("a", int64(i), "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Insert("a", 10, "{}"); !errors.Is(err, ErrCollectionLimit) {
+		t.Errorf("Expected the records limit, got %v", err)
+	}
+	// writes to an existing timestamp don't add a record
+	for _, conflict := range []string{conflictLast, conflictFirst, conflictMerge} {
+		db.config.Store(&Collection{MaxUids: 2, MaxRecordsPerUid: 3, Conflict: conflict})
+		if err := db.Insert("a", 1, `{"v":1}`); err != nil {
+			t.Errorf("Expected a write to an existing timestamp with %s, got %v", conflict, err)
+		}
+	}
+	db.config.Store(&Collection{MaxUids: 2, MaxRecordsPerUid: 3, Conflict: conflictAll})
+	if err := db.Insert("a", 1, "{}"); !errors.Is(err, ErrCollectionLimit) {
+		t.Errorf("Expected the records limit for a record kept next to another, got %v", err)
+	}
+	db.config.Store(&Collection{MaxUids: 2, MaxRecordsPerUid: 3})
+	if err := db.Insert("b", 1, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("c", 1, "{}"); !errors.Is(err, ErrCollectionLimit) {
+		t.Errorf("Expected the uids limit, got %v", err)
+	}
+
+	// limits are changed at runtime
+	db.config.Store(&Collection{})
+	if err := db.Insert("c", 1, "{}"); err != nil {
+		t.Errorf("Expected no limit, got %v", err)
+	}
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "*", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				name := fmt.Sprintf("c%d", (i+j)%5)
+				if db, err := reg.getOrOpen(name); err == nil {
+					db.Insert("1", int64(j), "{}")
+				}
+				reg.all()
+				if j%10 == 0 {
+					reg.drop(name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
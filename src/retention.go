@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// runEvery calls fn right away and then every interval until stop is closed,
+// a nil stop runs it for the life of the process
+func runEvery(interval time.Duration, stop <-chan struct{}, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fn()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// expireRecords deletes the uids whose records are older than the ttl of
+// their collection. It doesn't depend on storage, memory-only collections
+// expire the same way.
+func expireRecords(dbs []*Database) {
+	for _, db := range dbs {
+		db.DeleteOld()
+	}
+}
+
+// flushDatabases writes the collections to disk, the flushed chunks can be
+// evicted afterwards
+func flushDatabases(dbs []*Database, budget *memoryBudget) {
+	log.Println("Flushing data to disk")
+	for _, db := range dbs {
+		if err := db.Flush(); err != nil {
+			log.Printf("Error flushing collection %s: %v", db.name, err)
+		}
+	}
+	if budget != nil {
+		budget.reclaim()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	var calls atomic.Int32
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runEvery(time.Millisecond, stop, func() { calls.Add(1) })
+		close(done)
+	}()
+	for calls.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected runEvery to return when stopped")
+	}
+}
+
+func TestMemoryOnlyRetention(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "users.*", TTL: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := reg.getOrOpen("users.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	db.Insert("old", now-2*60*60, "{}")
+	db.Insert("new", now-30*60, "{}")
+	db.Insert("new", now, "{}")
+
+	expireRecords(reg.all())
+	if uids := db.Stats().Uids; uids != 2 {
+		t.Errorf("Expected 2 uids within the ttl, got %d", uids)
+	}
+
+	// ttl changes apply to the next run
+	if _, err := reg.update("users.*", func(c *Collection) { c.TTL = 1 }); err != nil {
+		t.Fatal(err)
+	}
+	expireRecords(reg.all())
+	if uids := db.Stats().Uids; uids != 1 {
+		t.Errorf("Expected 1 uid after expiring, got %d", uids)
+	}
+	if records := db.GetRecordsForUser("new", 0, now); len(records) != 2 {
+		t.Errorf("Expected 2 records of new, got %d", len(records))
+	}
+	if records := db.GetRecordsForUser("old", 0, now); len(records) != 0 {
+		t.Errorf("Expected the records of old to be deleted, got %d", len(records))
+	}
+
+	// nothing is written without a storage directory
+	flushDatabases(reg.all(), nil)
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files, got %d", len(entries))
+	}
+}
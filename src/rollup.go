@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directory of the storage directory holding the rollup tiers, one
+// directory per resolution with the collections inside
+const rollupsDir = ".rollups"
+
+// Rollup is a downsampling tier of a collection. Every record of the tier
+// summarizes the numeric fields of the records of a uid within a bucket of
+// resolution seconds, and the tier expires like a collection with its own ttl.
+type Rollup struct {
+	Resolution int64 `json:"resolution"` // seconds
+	TTL        int   `json:"ttl"`        // hours
+}
+
+// rollupTier is the series of a rollup, kept in a database of its own
+type rollupTier struct {
+	resolution int64
+	db         *Database
+	locks      [shardCount]sync.Mutex // serialize the updates of a bucket, striped by uid
+}
+
+// aggregate summarizes the values of a field within a bucket
+type aggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count int64   `json:"count"`
+	Avg   float64 `json:"avg"`
+}
+
+// numericField is a number found in a payload, at the path of object keys
+type numericField struct {
+	path  []string
+	value float64
+}
+
+// parseRollup parses a rollup flag of the form pattern:resolution:ttl, like
+// metrics.*:1m:7d
+func parseRollup(spec string) (string, Rollup, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return "", Rollup{}, fmt.Errorf("invalid rollup %q: expected pattern:resolution:ttl", spec)
+	}
+	resolution, err := parseInterval(parts[1])
+	if err != nil || resolution < time.Second || resolution%time.Second != 0 {
+		return "", Rollup{}, fmt.Errorf("invalid rollup %q: resolution %q must be a whole number of seconds, like 1m", spec, parts[1])
+	}
+	ttl, err := parseInterval(parts[2])
+	if err != nil || ttl < time.Hour || ttl%time.Hour != 0 {
+		return "", Rollup{}, fmt.Errorf("invalid rollup %q: ttl %q must be a whole number of hours, like 7d", spec, parts[2])
+	}
+	return parts[0], Rollup{Resolution: int64(resolution / time.Second), TTL: int(ttl / time.Hour)}, nil
+}
+
+// parseRollups adds the rollup flags to the collection patterns they name
+func parseRollups(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, rollup, err := parseRollup(spec)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid rollup %q: collection pattern %q is not configured", spec, pattern)
+		}
+		collections[i].Rollups = append(collections[i].Rollups, rollup)
+		if err := collections[i].validate(); err != nil {
+			return fmt.Errorf("invalid rollup %q: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+// parseInterval parses a duration like time.ParseDuration, with d, w and y
+// (365 days) units on top. Units can't be mixed with them.
+func parseInterval(text string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if number, ok := strings.CutSuffix(text, suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", text)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(text)
+}
+
+func validateRollups(rollups []Rollup) error {
+	seen := make(map[int64]bool)
+	for _, rollup := range rollups {
+		if rollup.Resolution <= 0 {
+			return fmt.Errorf("rollup resolution %d must be positive", rollup.Resolution)
+		}
+		if rollup.TTL <= 0 {
+			return fmt.Errorf("rollup ttl %d must be positive", rollup.TTL)
+		}
+		if seen[rollup.Resolution] {
+			return fmt.Errorf("rollup resolution %d is configured twice", rollup.Resolution)
+		}
+		seen[rollup.Resolution] = true
+	}
+	return nil
+}
+
+// rollupStorageDir returns the storage directory of the tiers of a resolution
+func rollupStorageDir(storageDir string, resolution int64) string {
+	if storageDir == "" {
+		return ""
+	}
+	return path.Join(storageDir, rollupsDir, strconv.FormatInt(resolution, 10))
+}
+
+// rollupTiers returns the tiers of the database sorted by resolution
+func (db *Database) rollupTiers() []*rollupTier {
+	if tiers := db.rollups.Load(); tiers != nil {
+		return *tiers
+	}
+	return nil
+}
+
+// setRollups opens the tiers that were added and drops the ones that were
+// removed, with their records
+func (db *Database) setRollups(rollups []Rollup, opts storageOptions) {
+	db.rollupMu.Lock()
+	defer db.rollupMu.Unlock()
+	if db.dropped.Load() {
+		return
+	}
+	current := make(map[int64]*rollupTier)
+	for _, tier := range db.rollupTiers() {
+		current[tier.resolution] = tier
+	}
+	tiers := make([]*rollupTier, 0, len(rollups))
+	for _, rollup := range rollups {
+		config := Collection{Name: db.name, TTL: rollup.TTL, Unit: db.config.Load().Unit}
+		if tier := current[rollup.Resolution]; tier != nil {
+			tier.db.configure(config, opts)
+			delete(current, rollup.Resolution)
+			tiers = append(tiers, tier)
+			continue
+		}
+		tierOpts := opts
+		tierOpts.dir = rollupStorageDir(opts.dir, rollup.Resolution)
+		tierDb, err := openDatabase(db.name, config, tierOpts)
+		if err != nil {
+			log.Printf("Error opening rollup %ds of collection %s: %v", rollup.Resolution, db.name, err)
+			continue
+		}
+		tiers = append(tiers, &rollupTier{resolution: rollup.Resolution, db: tierDb})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].resolution < tiers[j].resolution })
+	db.rollups.Store(&tiers)
+
+	for _, tier := range current {
+		log.Printf("Dropping rollup %ds of collection %s", tier.resolution, db.name)
+		if err := tier.db.Drop(); err != nil {
+			log.Printf("Error dropping rollup %ds of collection %s: %v", tier.resolution, db.name, err)
+		}
+	}
+}
+
+// dropRollups drops every tier, the database must be marked dropped first
+func (db *Database) dropRollups() {
+	db.rollupMu.Lock()
+	tiers := db.rollups.Swap(nil)
+	db.rollupMu.Unlock()
+	if tiers == nil {
+		return
+	}
+	for _, tier := range *tiers {
+		if err := tier.db.Drop(); err != nil {
+			log.Printf("Error dropping rollup %ds of collection %s: %v", tier.resolution, db.name, err)
+		}
+	}
+}
+
+// updateRollups adds the numeric fields of an inserted record to the buckets
+// of every tier, retracting the fields of the record it overwrote or was
+// merged into, so the fields a merge kept are counted once. Counts and sums
+// follow the records stored, minimums and maximums may still include
+// overwritten values. Deleted records are retracted by retractRollups.
+func (db *Database) updateRollups(uid string, outcome insertOutcome) {
+	tiers := db.rollupTiers()
+	if len(tiers) == 0 || outcome.status == insertIgnored {
+		return
+	}
+	added := numericFields(outcome.record.payload())
+	var retracted []numericField
+	if outcome.replaced != nil {
+		retracted = numericFields(outcome.replaced.payload())
+	}
+	if len(added) == 0 && len(retracted) == 0 {
+		return
+	}
+	for _, tier := range tiers {
+		if err := tier.update(uid, outcome.record.Timestamp, added, retracted); err != nil {
+			log.Printf("Error updating rollup %ds of collection %s: %v", tier.resolution, db.name, err)
+		}
+	}
+}
+
+// retractRollups retracts the numeric fields of deleted records from the
+// buckets of every tier, updating each bucket once
+func (db *Database) retractRollups(uid string, records []Record) {
+	tiers := db.rollupTiers()
+	if len(tiers) == 0 || len(records) == 0 {
+		return
+	}
+	fields := make([][]numericField, len(records))
+	for i, record := range records {
+		fields[i] = numericFields(record.payload())
+	}
+	for _, tier := range tiers {
+		buckets := make(map[int64][]numericField)
+		for i, record := range records {
+			if len(fields[i]) > 0 {
+				bucket := tier.bucket(record.Timestamp)
+				buckets[bucket] = append(buckets[bucket], fields[i]...)
+			}
+		}
+		for bucket, retracted := range buckets {
+			if err := tier.update(uid, bucket, nil, retracted); err != nil {
+				log.Printf("Error updating rollup %ds of collection %s: %v", tier.resolution, db.name, err)
+			}
+		}
+	}
+}
+
+// bucket returns the start of the bucket of a timestamp, in the unit of the
+// collection
+func (tier *rollupTier) bucket(ts int64) int64 {
+	width := tier.resolution * unitsPerSecond(tier.db.config.Load().Unit)
+	return ts - ((ts%width)+width)%width
+}
+
+// update retracts the fields of overwritten or deleted records from the
+// summary record of their bucket and merges the added fields into it. A summary left
+// without fields is removed.
+func (tier *rollupTier) update(uid string, ts int64, added []numericField, retracted []numericField) error {
+	bucket := tier.bucket(ts)
+	lock := &tier.locks[uidHash(uid)%shardCount]
+	lock.Lock()
+	defer lock.Unlock()
+
+	summary := make(map[string]any)
+	if records := tier.db.GetRecordsForUser(uid, bucket, bucket); len(records) > 0 {
+		if err := json.Unmarshal([]byte(records[0].Data), &summary); err != nil {
+			summary = make(map[string]any)
+		}
+	}
+	for _, field := range retracted {
+		retractField(summary, field.path, field.value)
+	}
+	for _, field := range added {
+		node := summary
+		for _, key := range field.path[:len(field.path)-1] {
+			child, ok := node[key].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[key] = child
+			}
+			node = child
+		}
+		last := field.path[len(field.path)-1]
+		current, _ := node[last].(map[string]any)
+		node[last] = mergeAggregate(current, field.value)
+	}
+	if len(summary) == 0 {
+		_, err := tier.db.DeleteRecords(uid, bucket, bucket)
+		return err
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return tier.db.Insert(uid, bucket, string(data))
+}
+
+// retractField removes a value from the aggregate of its field in a summary.
+// A field left without values is removed, with the objects it leaves empty.
+func retractField(node map[string]any, path []string, value float64) {
+	if len(path) > 1 {
+		child, ok := node[path[0]].(map[string]any)
+		if !ok {
+			return
+		}
+		retractField(child, path[1:], value)
+		if len(child) == 0 {
+			delete(node, path[0])
+		}
+		return
+	}
+	current, ok := node[path[0]].(map[string]any)
+	if !ok {
+		return
+	}
+	if count, _ := current["count"].(float64); count <= 1 {
+		delete(node, path[0])
+		return
+	}
+	retractAggregate(current, value)
+}
+
+// mergeAggregate adds a value to the aggregate read from a summary record
+func mergeAggregate(current map[string]any, value float64) aggregate {
+	result := aggregate{Min: value, Max: value, Sum: value, Count: 1}
+	count, ok := current["count"].(float64)
+	if ok && count > 0 {
+		lowest, _ := current["min"].(float64)
+		highest, _ := current["max"].(float64)
+		sum, _ := current["sum"].(float64)
+		result = aggregate{
+			Min:   min(lowest, value),
+			Max:   max(highest, value),
+			Sum:   sum + value,
+			Count: int64(count) + 1,
+		}
+	}
+	result.Avg = result.Sum / float64(result.Count)
+	return result
+}
+
+// retractAggregate removes a value from the aggregate read from a summary
+// record, in place. The minimum and maximum can't be recomputed without the
+// records, they stay as they are.
+func retractAggregate(current map[string]any, value float64) {
+	sum, _ := current["sum"].(float64)
+	count, _ := current["count"].(float64)
+	current["sum"] = sum - value
+	current["count"] = count - 1
+	current["avg"] = (sum - value) / (count - 1)
+}
+
+// numericFields returns the numbers of a JSON object payload, nested objects
+// included, or the number of a numeric payload as the value field. Arrays
+// and other payloads have no fields.
+func numericFields(data string) []numericField {
+	var payload any
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return nil
+	}
+	if number, ok := payload.(float64); ok {
+		return []numericField{{path: []string{"value"}, value: number}}
+	}
+	var fields []numericField
+	var walk func(prefix []string, value any)
+	walk = func(prefix []string, value any) {
+		switch v := value.(type) {
+		case float64:
+			fields = append(fields, numericField{path: append([]string{}, prefix...), value: v})
+		case map[string]any:
+			for key, child := range v {
+				walk(append(prefix, key), child)
+			}
+		}
+	}
+	walk(nil, payload)
+	return fields
+}
+
+// GetRollupRecords returns the records of a uid at the coarsest tier whose
+// resolution is at most the given one, from the bucket holding from. The raw
+// records are returned with a resolution of 0 when no tier is fine enough.
+func (db *Database) GetRollupRecords(uid string, from int64, to int64, resolution int64) ([]Record, int64) {
+	var chosen *rollupTier
+	for _, tier := range db.rollupTiers() {
+		if tier.resolution <= resolution {
+			chosen = tier
+		}
+	}
+	if chosen == nil {
+		return db.GetRecordsForUser(uid, from, to), 0
+	}
+	return chosen.db.GetRecordsForUser(uid, chosen.bucket(from), to), chosen.resolution
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRollup(t *testing.T) {
+	tests := []struct {
+		spec    string
+		pattern string
+		want    Rollup
+		wantErr bool
+	}{
+		{"metrics.*:1m:7d", "metrics.*", Rollup{Resolution: 60, TTL: 168}, false},
+		{"metrics:1h:1y", "metrics", Rollup{Resolution: 3600, TTL: 8760}, false},
+		{"metrics:30s:2w", "metrics", Rollup{Resolution: 30, TTL: 336}, false},
+		{"metrics:1m", "", Rollup{}, true},
+		{"metrics:0s:1d", "", Rollup{}, true},
+		{"metrics:1500ms:1d", "", Rollup{}, true},
+		{"metrics:1m:30m", "", Rollup{}, true},
+		{"metrics:abc:1d", "", Rollup{}, true},
+		{"metrics:1m:xd", "", Rollup{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			pattern, got, err := parseRollup(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if pattern != tt.pattern || got != tt.want {
+				t.Errorf("Expected %s %+v, got %s %+v", tt.pattern, tt.want, pattern, got)
+			}
+		})
+	}
+}
+
+func TestParseRollups(t *testing.T) {
+	collections := []Collection{{Name: "metrics.*", TTL: 1}}
+	if err := parseRollups([]string{"metrics.*:1m:7d", "metrics.*:1h:1y"}, collections); err != nil {
+		t.Fatal(err)
+	}
+	if len(collections[0].Rollups) != 2 {
+		t.Errorf("Expected 2 rollups, got %v", collections[0].Rollups)
+	}
+	if err := parseRollups([]string{"logs:1m:7d"}, collections); err == nil {
+		t.Errorf("Expected an error for a pattern that isn't configured")
+	}
+	if err := parseRollups([]string{"metrics.*:60s:1d"}, collections); err == nil {
+		t.Errorf("Expected an error for a resolution configured twice")
+	}
+}
+
+func rollupAggregates(t *testing.T, record Record) map[string]any {
+	t.Helper()
+	var summary map[string]any
+	if err := json.Unmarshal([]byte(record.Data), &summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestRollupAggregates(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{
+		Name:    "metrics.*",
+		TTL:     1,
+		Rollups: []Rollup{{Resolution: 3600, TTL: 24}, {Resolution: 60, TTL: 24}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics.a")
+	db.Insert("1", 120, `{"temp": 10, "pos": {"lat": 1}, "name": "a"}`)
+	db.Insert("1", 150, `{"temp": 20, "pos": {"lat": 3}, "tags": [1, 2]}`)
+	db.Insert("1", 179, `{"temp": 30}`)
+	db.Insert("1", 180, `{"temp": 40}`)
+	db.Insert("1", 200, `not json`)
+
+	records, resolution := db.GetRollupRecords("1", 130, 3600, 60)
+	if resolution != 60 || len(records) != 2 {
+		t.Fatalf("Expected 2 buckets of 60 seconds, got %d of %d", len(records), resolution)
+	}
+	if records[0].Timestamp != 120 || records[1].Timestamp != 180 {
+		t.Errorf("Expected buckets 120 and 180, got %d and %d", records[0].Timestamp, records[1].Timestamp)
+	}
+	summary := rollupAggregates(t, records[0])
+	expected := `map[pos:map[lat:map[avg:2 count:2 max:3 min:1 sum:4]] temp:map[avg:20 count:3 max:30 min:10 sum:60]]`
+	if fmt.Sprint(summary) != expected {
+		t.Errorf("Expected %s, got %v", expected, summary)
+	}
+
+	records, resolution = db.GetRollupRecords("1", 0, 3600, 7200)
+	if resolution != 3600 || len(records) != 1 {
+		t.Fatalf("Expected 1 bucket of an hour, got %d of %d", len(records), resolution)
+	}
+	if temp := rollupAggregates(t, records[0])["temp"]; fmt.Sprint(temp) != "map[avg:25 count:4 max:40 min:10 sum:100]" {
+		t.Errorf("Expected the hour to summarize every temp, got %v", temp)
+	}
+
+	// finer than every tier returns the raw records
+	records, resolution = db.GetRollupRecords("1", 0, 3600, 30)
+	if resolution != 0 || len(records) != 5 {
+		t.Errorf("Expected the 5 raw records, got %d of %d", len(records), resolution)
+	}
+}
+
+func TestRollupOverwrites(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "metrics", TTL: 1, Rollups: []Rollup{{Resolution: 60, TTL: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics")
+	db.Insert("1", 120, `{"temp": 10, "pos": {"lat": 1}}`)
+	db.Insert("1", 130, `{"temp": 20}`)
+	// the overwritten values leave the count and sum, not the min
+	db.Insert("1", 120, `{"temp": 30}`)
+	records, _ := db.GetRollupRecords("1", 120, 120, 60)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(records))
+	}
+	expected := `map[temp:map[avg:25 count:2 max:30 min:10 sum:50]]`
+	if summary := rollupAggregates(t, records[0]); fmt.Sprint(summary) != expected {
+		t.Errorf("Expected %s, got %v", expected, summary)
+	}
+
+	// a bucket left without values is removed
+	db.Insert("1", 240, `{"temp": 10}`)
+	db.Insert("1", 240, `"off"`)
+	if records, _ := db.GetRollupRecords("1", 240, 240, 60); len(records) != 0 {
+		t.Errorf("Expected the bucket to be removed, got %+v", records)
+	}
+}
+
+func TestRollupDeletedRecords(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "metrics", TTL: 1, Rollups: []Rollup{{Resolution: 60, TTL: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics")
+	db.Insert("1", 120, `{"temp": 10}`)
+	db.Insert("1", 130, `{"temp": 20, "hum": 50}`)
+	db.Insert("1", 140, `{"temp": 30}`)
+	db.Insert("1", 200, `{"temp": 40}`)
+	// the deleted values leave the count and sum of their bucket
+	if deleted, err := db.DeleteRecords("1", 125, 185); err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 deleted records, got %d (%v)", deleted, err)
+	}
+	records, _ := db.GetRollupRecords("1", 120, 180, 60)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", len(records))
+	}
+	if summary := rollupAggregates(t, records[0]); fmt.Sprint(summary) != `map[temp:map[avg:10 count:1 max:30 min:10 sum:10]]` {
+		t.Errorf("Expected only the value of 120 in the bucket, got %v", summary)
+	}
+	if summary := rollupAggregates(t, records[1]); fmt.Sprint(summary) != `map[temp:map[avg:40 count:1 max:40 min:40 sum:40]]` {
+		t.Errorf("Expected the bucket of 180 to be kept, got %v", summary)
+	}
+
+	// a bucket left without values is removed
+	if _, err := db.DeleteRecords("1", 180, 240); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := db.GetRollupRecords("1", 180, 180, 60); len(records) != 0 {
+		t.Errorf("Expected the bucket to be removed, got %+v", records)
+	}
+}
+
+func TestRollupMergedInserts(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "metrics", TTL: 1, Conflict: conflictMerge, Rollups: []Rollup{{Resolution: 60, TTL: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics")
+	db.Insert("1", 120, `{"temp": 10, "hum": 50}`)
+	// partial updates of the record only count the fields they change
+	db.Insert("1", 120, `{"temp": 20}`)
+	db.Insert("1", 120, `{"wind": 5}`)
+	db.Insert("1", 130, `{"temp": 30}`)
+	records, _ := db.GetRollupRecords("1", 120, 120, 60)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(records))
+	}
+	expected := `map[hum:map[avg:50 count:1 max:50 min:50 sum:50] temp:map[avg:25 count:2 max:30 min:20 sum:50] wind:map[avg:5 count:1 max:5 min:5 sum:5]]`
+	if summary := rollupAggregates(t, records[0]); fmt.Sprint(summary) != expected {
+		t.Errorf("Expected %s, got %v", expected, summary)
+	}
+}
+
+func TestRollupConcurrentInserts(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "metrics", TTL: 1, Rollups: []Rollup{{Resolution: 3600, TTL: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				db.Insert("1", int64(i*50+j), `{"value": 1}`)
+			}
+		}()
+	}
+	wg.Wait()
+	records, _ := db.GetRollupRecords("1", 0, 3600, 3600)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(records))
+	}
+	if value := rollupAggregates(t, records[0])["value"].(map[string]any); value["count"] != float64(400) {
+		t.Errorf("Expected 400 values, got %v", value["count"])
+	}
+}
+
+func TestRollupStorage(t *testing.T) {
+	dir := t.TempDir()
+	opts := storageOptions{dir: dir}
+	flags := []Collection{{Name: "metrics", TTL: 24, Rollups: []Rollup{{Resolution: 60, TTL: 1}, {Resolution: 3600, TTL: 24}}}}
+	reg, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("metrics")
+	now := time.Now().Unix()
+	db.Insert("old", now-3*60*60, `{"value": 1}`)
+	db.Insert("new", now, `{"value": 2}`)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, rollupsDir, "60", "metrics", "new")); err != nil {
+		t.Errorf("Expected the tier to be flushed, got %v", err)
+	}
+
+	// tiers expire with their own ttl
+	db.DeleteOld()
+	if records, _ := db.GetRollupRecords("old", 0, now, 60); len(records) != 0 {
+		t.Errorf("Expected the minute tier of old to expire, got %d records", len(records))
+	}
+	if records, _ := db.GetRollupRecords("old", 0, now, 3600); len(records) != 1 {
+		t.Errorf("Expected the hour tier of old to be kept, got %d records", len(records))
+	}
+	db.Flush()
+
+	// tiers are loaded again on restart
+	restarted, err := newRegistry(opts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = restarted.get("metrics")
+	if records, resolution := db.GetRollupRecords("new", 0, now, 60); resolution != 60 || len(records) != 1 {
+		t.Errorf("Expected the minute tier of new, got %d records of %d", len(records), resolution)
+	}
+
+	// removing a tier drops its records
+	if _, err := restarted.update("metrics", func(c *Collection) { c.Rollups = c.Rollups[1:] }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, rollupsDir, "60", "metrics")); !os.IsNotExist(err) {
+		t.Errorf("Expected the minute tier to be removed, got %v", err)
+	}
+	if records, resolution := db.GetRollupRecords("new", 0, now, 60); resolution != 0 || len(records) != 1 {
+		t.Errorf("Expected the raw records without the minute tier, got %d records of %d", len(records), resolution)
+	}
+
+	// dropping the collection drops its tiers
+	if err := restarted.drop("metrics"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, rollupsDir, "3600", "metrics")); !os.IsNotExist(err) {
+		t.Errorf("Expected the hour tier to be removed, got %v", err)
+	}
+}
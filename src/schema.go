@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema. The keywords supported are type,
+// enum, const, properties, required, additionalProperties, items, minItems,
+// maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength,
+// maxLength and pattern. Other keywords are ignored, like the specification
+// asks for unknown ones.
+type jsonSchema struct {
+	never                bool     // the false schema
+	types                []string // any type when empty
+	enum                 []any
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema // nil allows any property
+	items                *jsonSchema
+	minItems, maxItems   *int
+	minimum, maximum     *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+}
+
+// compileSchema parses a JSON Schema
+func compileSchema(data json.RawMessage) (*jsonSchema, error) {
+	var schema any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	compiled, err := compileSchemaValue(schema, "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	return compiled, nil
+}
+
+func compileSchemaValue(value any, at string) (*jsonSchema, error) {
+	switch v := value.(type) {
+	case bool:
+		return &jsonSchema{never: !v}, nil
+	case map[string]any:
+		return compileSchemaObject(v, at)
+	}
+	return nil, fmt.Errorf("%s: a schema must be an object or a boolean", at)
+}
+
+func compileSchemaObject(object map[string]any, at string) (*jsonSchema, error) {
+	schema := &jsonSchema{}
+	var err error
+	switch types := object["type"].(type) {
+	case nil:
+	case string:
+		schema.types = []string{types}
+	case []any:
+		for _, typ := range types {
+			name, ok := typ.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: type must be a string or a list of strings", at)
+			}
+			schema.types = append(schema.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: type must be a string or a list of strings", at)
+	}
+	for _, typ := range schema.types {
+		switch typ {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", at, typ)
+		}
+	}
+	if enum, ok := object["enum"]; ok {
+		values, ok := enum.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: enum must be a list", at)
+		}
+		schema.enum = values
+	}
+	if value, ok := object["const"]; ok {
+		schema.enum = []any{value}
+	}
+	if properties, ok := object["properties"]; ok {
+		fields, ok := properties.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: properties must be an object", at)
+		}
+		schema.properties = make(map[string]*jsonSchema, len(fields))
+		for name, field := range fields {
+			if schema.properties[name], err = compileSchemaValue(field, at+"."+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if required, ok := object["required"]; ok {
+		names, ok := required.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: required must be a list of strings", at)
+		}
+		for _, name := range names {
+			field, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: required must be a list of strings", at)
+			}
+			schema.required = append(schema.required, field)
+		}
+	}
+	if additional, ok := object["additionalProperties"]; ok {
+		if schema.additionalProperties, err = compileSchemaValue(additional, at+".additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if items, ok := object["items"]; ok {
+		if schema.items, err = compileSchemaValue(items, at+"[]"); err != nil {
+			return nil, err
+		}
+	}
+	numbers := map[string]**float64{
+		"minimum":          &schema.minimum,
+		"maximum":          &schema.maximum,
+		"exclusiveMinimum": &schema.exclusiveMinimum,
+		"exclusiveMaximum": &schema.exclusiveMaximum,
+	}
+	for keyword, target := range numbers {
+		if value, ok := object[keyword]; ok {
+			number, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s must be a number", at, keyword)
+			}
+			*target = &number
+		}
+	}
+	counts := map[string]**int{
+		"minItems":  &schema.minItems,
+		"maxItems":  &schema.maxItems,
+		"minLength": &schema.minLength,
+		"maxLength": &schema.maxLength,
+	}
+	for keyword, target := range counts {
+		if value, ok := object[keyword]; ok {
+			number, ok := value.(float64)
+			if !ok || number < 0 || number != math.Trunc(number) {
+				return nil, fmt.Errorf("%s: %s must be a non-negative integer", at, keyword)
+			}
+			count := int(number)
+			*target = &count
+		}
+	}
+	if pattern, ok := object["pattern"]; ok {
+		text, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: pattern must be a string", at)
+		}
+		if schema.pattern, err = regexp.Compile(text); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %w", at, err)
+		}
+	}
+	return schema, nil
+}
+
+// validate returns the first part of the value that doesn't match the schema
+func (s *jsonSchema) validate(value any, at string) error {
+	if s.never {
+		return fmt.Errorf("%s is not allowed", at)
+	}
+	if len(s.types) > 0 && !s.matchesType(value) {
+		return fmt.Errorf("%s: expected %s, got %s", at, strings.Join(s.types, " or "), jsonType(value))
+	}
+	if s.enum != nil && !s.inEnum(value) {
+		return fmt.Errorf("%s: %s is not one of the allowed values", at, jsonText(value))
+	}
+	switch v := value.(type) {
+	case float64:
+		return s.validateNumber(v, at)
+	case string:
+		return s.validateString(v, at)
+	case []any:
+		return s.validateArray(v, at)
+	case map[string]any:
+		return s.validateObject(v, at)
+	}
+	return nil
+}
+
+func (s *jsonSchema) matchesType(value any) bool {
+	actual := jsonType(value)
+	for _, typ := range s.types {
+		if typ == actual || typ == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) inEnum(value any) bool {
+	for _, allowed := range s.enum {
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) validateNumber(v float64, at string) error {
+	text := strconv.FormatFloat(v, 'g', -1, 64)
+	if s.minimum != nil && v < *s.minimum {
+		return fmt.Errorf("%s: %s is less than the minimum %g", at, text, *s.minimum)
+	}
+	if s.maximum != nil && v > *s.maximum {
+		return fmt.Errorf("%s: %s is greater than the maximum %g", at, text, *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+		return fmt.Errorf("%s: %s must be greater than %g", at, text, *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+		return fmt.Errorf("%s: %s must be less than %g", at, text, *s.exclusiveMaximum)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateString(v string, at string) error {
+	length := utf8.RuneCountInString(v)
+	if s.minLength != nil && length < *s.minLength {
+		return fmt.Errorf("%s: shorter than %d characters", at, *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return fmt.Errorf("%s: longer than %d characters", at, *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return fmt.Errorf("%s: %q doesn't match %s", at, v, s.pattern)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(v []any, at string) error {
+	if s.minItems != nil && len(v) < *s.minItems {
+		return fmt.Errorf("%s: fewer than %d items", at, *s.minItems)
+	}
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		return fmt.Errorf("%s: more than %d items", at, *s.maxItems)
+	}
+	if s.items != nil {
+		for i, item := range v {
+			if err := s.items.validate(item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(v map[string]any, at string) error {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", at, name)
+		}
+	}
+	// sorted so the same payload always reports the same error
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property := s.properties[name]
+		if property == nil {
+			property = s.additionalProperties
+		}
+		if property == nil {
+			continue
+		}
+		if err := property.validate(v[name], at+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonType returns the JSON Schema type of a decoded value
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// readSchemaFlag returns the JSON Schema of a flag, given inline or as @file
+func readSchemaFlag(text string) (json.RawMessage, error) {
+	if file, ok := strings.CutPrefix(text, "@"); ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return json.RawMessage(text), nil
+}
+
+// parseSchemas sets the JSON schemas of the collection patterns named by the
+// schema flags, of the form pattern:schema
+func parseSchemas(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, text, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("invalid schema %q: expected pattern:schema", spec)
+		}
+		schema, err := readSchemaFlag(text)
+		if err != nil {
+			return fmt.Errorf("invalid schema for %q: %w", pattern, err)
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid schema for %q: collection pattern is not configured", pattern)
+		}
+		if _, err := compileSchema(schema); err != nil {
+			return fmt.Errorf("invalid schema for %q: %w", pattern, err)
+		}
+		// compacted so collections.json stays on one line
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, schema); err != nil {
+			return err
+		}
+		collections[i].JSONSchema = compact.Bytes()
+	}
+	return nil
+}
+
+// validatePayload checks a payload against the JSON schema of the collection
+func validatePayload(schema *jsonSchema, data string) error {
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return fmt.Errorf("%w: not JSON: %s", ErrInvalidPayload, err)
+	}
+	if err := schema.validate(value, "$"); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPayload, err)
+	}
+	return nil
+}
+
+// validateRecord returns the record of a payload, checked against the type
+// and the JSON schema of the collection. The outcome is counted when the
+// collection has either.
+func (db *Database) validateRecord(ts int64, data string) (Record, error) {
+	config := db.config.Load()
+	schema := db.schema.Load()
+	record, err := config.encodeRecord(ts, data)
+	if err == nil && schema != nil {
+		err = validatePayload(schema, data)
+	}
+	if config.Type == "" && schema == nil {
+		return record, err
+	}
+	if err != nil {
+		db.metrics.invalid.Add(1)
+		return Record{}, err
+	}
+	db.metrics.valid.Add(1)
+	return record, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCompileSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"object", `{"type":"object","properties":{"lat":{"type":"number"}},"required":["lat"]}`, false},
+		{"boolean", `true`, false},
+		{"unknown keywords", `{"title":"gps","$id":"gps"}`, false},
+		{"not JSON", `{`, true},
+		{"not an object", `"object"`, true},
+		{"unknown type", `{"type":"decimal"}`, true},
+		{"required not a list", `{"required":"lat"}`, true},
+		{"negative min length", `{"minLength":-1}`, true},
+		{"invalid pattern", `{"pattern":"("}`, true},
+		{"invalid nested schema", `{"properties":{"lat":{"type":1}}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileSchema([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	gps := `{"type":"object","required":["lat","lon"],"additionalProperties":false,"properties":{
+		"lat":{"type":"number","minimum":-90,"maximum":90},
+		"lon":{"type":"number","minimum":-180,"maximum":180},
+		"speed":{"type":"integer","exclusiveMinimum":-1},
+		"kind":{"enum":["car","bike"]},
+		"plate":{"type":"string","pattern":"^[A-Z0-9]+$","maxLength":8},
+		"tags":{"type":"array","items":{"type":"string"},"maxItems":2},
+		"note":{"type":["string","null"]}}}`
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"valid", `{"lat":1.5,"lon":2,"speed":3,"kind":"car","plate":"AB12","tags":["a"],"note":null}`, ""},
+		{"integer as a number", `{"lat":1,"lon":2}`, ""},
+		{"missing required", `{"lat":1.5}`, `$: missing required property "lon"`},
+		{"additional property", `{"lat":1.5,"lon":2,"alt":3}`, `$.alt is not allowed`},
+		{"wrong type", `{"lat":"north","lon":2}`, `$.lat: expected number, got string`},
+		{"number as an integer", `{"lat":1,"lon":2,"speed":1.5}`, `$.speed: expected integer, got number`},
+		{"above maximum", `{"lat":91,"lon":2}`, `$.lat: 91 is greater than the maximum 90`},
+		{"exclusive minimum", `{"lat":1,"lon":2,"speed":-1}`, `$.speed: -1 must be greater than -1`},
+		{"not in enum", `{"lat":1,"lon":2,"kind":"boat"}`, `$.kind: "boat" is not one of the allowed values`},
+		{"pattern", `{"lat":1,"lon":2,"plate":"ab"}`, `$.plate: "ab" doesn't match ^[A-Z0-9]+$`},
+		{"max length", `{"lat":1,"lon":2,"plate":"ABCDEFGHI"}`, `$.plate: longer than 8 characters`},
+		{"item type", `{"lat":1,"lon":2,"tags":["a",1]}`, `$.tags[1]: expected string, got integer`},
+		{"max items", `{"lat":1,"lon":2,"tags":["a","b","c"]}`, `$.tags: more than 2 items`},
+		{"not an object", `[1,2]`, `$: expected object, got array`},
+		{"not JSON", `lat=1`, `not JSON`},
+	}
+	schema, err := compileSchema([]byte(gps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePayload(schema, tt.data)
+			if tt.error == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidPayload) || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("Expected an invalid payload with %q, got %v", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestParseSchemas(t *testing.T) {
+	file := path.Join(t.TempDir(), "gps.json")
+	if err := os.WriteFile(file, []byte("{\n  \"type\": \"object\"\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	collections := []Collection{{Name: "events.*", TTL: 1}, {Name: "gps.*", TTL: 1}}
+	err := parseSchemas([]string{`events.*:{"required": ["kind"]}`, "gps.*:@" + file}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(collections[0].JSONSchema) != `{"required":["kind"]}` {
+		t.Errorf("Expected the compacted inline schema, got %s", collections[0].JSONSchema)
+	}
+	if string(collections[1].JSONSchema) != `{"type":"object"}` {
+		t.Errorf("Expected the schema of the file, got %s", collections[1].JSONSchema)
+	}
+
+	for _, spec := range []string{`other:{}`, `events.*:{`, `events.*`, "events.*:@" + file + ".missing"} {
+		if err := parseSchemas([]string{spec}, collections); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "events", TTL: 1, JSONSchema: []byte(`{"required":["kind"]}`)}, {Name: "raw", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("events")
+	if err := db.Insert("1", 1, `{"kind":"start"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("1", 2, `{"type":"stop"}`); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("Expected a payload without kind to be refused, got %v", err)
+	}
+	if records := db.GetRecordsForUser("1", 0, 10); len(records) != 1 {
+		t.Errorf("Expected the refused record not to be stored, got %d records", len(records))
+	}
+
+	// schemas can be removed at runtime
+	if _, err := reg.update("events", func(c *Collection) {
+		c.JSONSchema = nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("1", 2, `{"type":"stop"}`); err != nil {
+		t.Errorf("Expected the payload to be accepted without a schema, got %v", err)
+	}
+	if inserted, valid, invalid := db.metrics.inserted.Load(), db.metrics.valid.Load(), db.metrics.invalid.Load(); inserted != 2 || valid != 1 || invalid != 1 {
+		t.Errorf("Expected 2 inserted, 1 valid and 1 invalid, got %d, %d and %d", inserted, valid, invalid)
+	}
+
+	raw, _ := reg.getOrOpen("raw")
+	if err := raw.Insert("1", 1, "anything"); err != nil {
+		t.Fatal(err)
+	}
+	if valid, invalid := raw.metrics.valid.Load(), raw.metrics.invalid.Load(); valid != 0 || invalid != 0 {
+		t.Errorf("Expected no validation without a type or schema, got %d valid and %d invalid", valid, invalid)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maximum number of records in a chunk, a full chunk is split in two when
+// an out of order record has to go in the middle of it
+const chunkSize = 256
+
+// estimated memory used by a record besides its payload
+const recordOverhead = int64(unsafe.Sizeof(Record{}))
+
+func recordSize(record Record) int64 {
+	if record.typed() {
+		return recordOverhead
+	}
+	return recordOverhead + int64(len(record.Data))
+}
+
+// chunk is a time ordered run of records. The chunks of a series don't
+// overlap, every record of a chunk is older than the records of the next one
+// or has the same timestamp, when the collection keeps them all.
+type chunk struct {
+	records []Record
+	maxGen  uint64        // highest generation written to the chunk
+	bytes   int64         // estimated memory used by the records
+	evicted *evictedChunk // set while the records only live on disk
+}
+
+// evictedChunk describes a chunk whose records were written to disk to
+// free memory. The bounds are kept so lookups can still find the chunk.
+type evictedChunk struct {
+	file  string
+	first int64
+	last  int64
+	count int
+}
+
+func (c *chunk) len() int {
+	if c.evicted != nil {
+		return c.evicted.count
+	}
+	return len(c.records)
+}
+
+func (c *chunk) first() int64 {
+	if c.evicted != nil {
+		return c.evicted.first
+	}
+	return c.records[0].Timestamp
+}
+
+func (c *chunk) last() int64 {
+	if c.evicted != nil {
+		return c.evicted.last
+	}
+	return c.records[len(c.records)-1].Timestamp
+}
+
+// view returns the records of the chunk, reading them from disk when the
+// chunk is evicted. The chunk itself stays evicted.
+func (c *chunk) view() []Record {
+	if c.evicted == nil {
+		return c.records
+	}
+	records, err := c.load()
+	if err != nil {
+		log.Println("Error paging in chunk:", err)
+		return nil
+	}
+	return records
+}
+
+func (c *chunk) load() ([]Record, error) {
+	data, err := os.ReadFile(c.evicted.file)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("error unmarshaling data from %s: %w", c.evicted.file, err)
+	}
+	return records, nil
+}
+
+// earliestIndex performs a binary search to find the index of the earliest record
+// that has a timestamp >= minTimestamp.
+//
+// Edge cases:
+//  1. If minTimestamp is less than all records' timestamps, returns 0 (first record)
+//     since all records will be >= minTimestamp
+//  2. If minTimestamp is greater than all records' timestamps, returns -1 since no records
+//     will be >= minTimestamp
+//  3. If there are no records, returns -1
+//  4. If multiple records have the same timestamp >= minTimestamp, returns the leftmost/earliest one
+func earliestIndex(records []Record, minTimestamp int64) int {
+	left, right := 0, len(records)-1
+	earliestIndex := -1
+	for left <= right {
+		mid := (left + right) / 2
+		if records[mid].Timestamp >= minTimestamp {
+			earliestIndex = mid
+			right = mid - 1
+		} else {
+			left = mid + 1
+		}
+	}
+	return earliestIndex
+}
+
+// latestIndex performs a binary search to find the index of the latest record
+// that has a timestamp <= maxTimestamp.
+//
+// Edge cases:
+//  1. If maxTimestamp is greater than all records' timestamps, returns the last record's index
+//     since it will be the latest record <= maxTimestamp
+//  2. If maxTimestamp is less than the first record's timestamp, returns -1 since no records
+//     will be <= maxTimestamp
+//  3. If there are no records, returns -1
+//  4. If multiple records have the same timestamp <= maxTimestamp, returns the rightmost/latest one
+func latestIndex(records []Record, maxTimestamp int64) int {
+	left, right := 0, len(records)-1
+	latestIndex := -1
+	for left <= right {
+		mid := (left + right) / 2
+		if records[mid].Timestamp <= maxTimestamp {
+			latestIndex = mid
+			left = mid + 1
+		} else {
+			right = mid - 1
+		}
+	}
+	return latestIndex
+}
+
+// series holds the records of a single uid as time ordered chunks. It is
+// protected by the lock of the shard it belongs to, except for latest which
+// can be read without locking.
+//
+// Chunks other than the last one can be evicted to disk. Lookups read
+// evicted chunks from disk without bringing them back, writes restore them.
+//
+// A series registered from the index has no chunks until it's hydrated,
+// its bounds come from the index entry until then.
+type series struct {
+	chunks      []*chunk
+	count       int                        // number of records across all chunks
+	bytes       int64                      // estimated memory used by the chunks in memory
+	lastGen     uint64                     // generation of the latest write to the uid
+	bytesOnDisk int64                      // size of the flushed files of the uid
+	latest      atomic.Pointer[Record]     // copy of the last record, replaced on every change
+	cold        atomic.Pointer[indexEntry] // set while the records are only on disk
+	evictions   uint64                     // number of chunks evicted, names their files
+}
+
+// insert adds the record maintaining chronological order. A record with the
+// same timestamp is replaced. It returns true if the record was added.
+func (s *series) insert(record Record) (bool, error) {
+	replaced, err := s.put(record, false)
+	return replaced == nil && err == nil, err
+}
+
+// put inserts the record like insert and returns the record it replaced, if
+// any. With keepAll the record is added after the records with the same
+// timestamp instead of replacing them.
+//
+// Records newer than the last one are appended to the last chunk, or to a
+// new chunk when it's full. Older records are placed in the chunk covering
+// their timestamp, so the cost of an out of order insert is bounded by the
+// chunk size instead of the length of the series.
+func (s *series) put(record Record, keepAll bool) (*Record, error) {
+	s.lastGen = max(s.lastGen, record.gen)
+	size := recordSize(record)
+
+	// fast path for in-order data, the last chunk is never evicted
+	n := len(s.chunks)
+	if n == 0 || s.chunks[n-1].last() < record.Timestamp || keepAll && s.chunks[n-1].last() == record.Timestamp {
+		if n == 0 || len(s.chunks[n-1].records) >= chunkSize {
+			s.chunks = append(s.chunks, &chunk{})
+			n++
+		}
+		last := s.chunks[n-1]
+		last.records = append(last.records, record)
+		last.maxGen = max(last.maxGen, record.gen)
+		last.bytes += size
+		s.bytes += size
+		s.count++
+		s.publishLatest()
+		return nil, nil
+	}
+
+	// with keepAll the record goes before the first record with a later
+	// timestamp, the last record is later so this can't overflow
+	ts := record.Timestamp
+	if keepAll {
+		ts++
+	}
+
+	// the first chunk whose last record is not older than the record
+	i := s.chunkAfter(ts)
+	c := s.chunks[i]
+	// records falling in the gap between two chunks go at the end of the
+	// previous chunk when it has room, it's cheaper than the front of the next
+	if record.Timestamp < c.first() && i > 0 {
+		if prev := s.chunks[i-1]; prev.evicted == nil && len(prev.records) < chunkSize {
+			i--
+			c = prev
+		}
+	}
+	if c.evicted != nil {
+		if err := s.restore(c); err != nil {
+			return nil, err
+		}
+	}
+
+	index := earliestIndex(c.records, ts)
+	if index == -1 {
+		index = len(c.records)
+	}
+	c.maxGen = max(c.maxGen, record.gen)
+	if !keepAll && index < len(c.records) && c.records[index].Timestamp == record.Timestamp {
+		replaced := c.records[index]
+		delta := size - recordSize(replaced)
+		c.bytes += delta
+		s.bytes += delta
+		c.records[index] = record
+		if i == n-1 && index == len(c.records)-1 {
+			s.publishLatest()
+		}
+		return &replaced, nil
+	}
+
+	c.records = append(c.records, Record{})
+	copy(c.records[index+1:], c.records[index:])
+	c.records[index] = record
+	c.bytes += size
+	s.bytes += size
+	s.count++
+	if len(c.records) > chunkSize {
+		s.split(i)
+	}
+	return nil, nil
+}
+
+// split divides a full chunk in two halves
+func (s *series) split(i int) {
+	c := s.chunks[i]
+	half := len(c.records) / 2
+	tail := &chunk{
+		records: append(make([]Record, 0, chunkSize), c.records[half:]...),
+		maxGen:  c.maxGen,
+	}
+	c.records = c.records[:half]
+	for _, record := range tail.records {
+		tail.bytes += recordSize(record)
+	}
+	c.bytes -= tail.bytes
+	s.chunks = append(s.chunks, nil)
+	copy(s.chunks[i+2:], s.chunks[i+1:])
+	s.chunks[i+1] = tail
+}
+
+// evict writes the records of the chunk to a file in dir and drops them from
+// memory. It returns the number of bytes freed. Chunks can have the same
+// bounds, the files are numbered in the order of the evictions.
+func (s *series) evict(c *chunk, dir string) (int64, error) {
+	if c.evicted != nil || c == s.chunks[len(s.chunks)-1] {
+		return 0, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	jsonData, err := json.Marshal(c.records)
+	if err != nil {
+		return 0, err
+	}
+	s.evictions++
+	filename := path.Join(dir, fmt.Sprintf("%d_%d_%d.json", c.first(), c.last(), s.evictions))
+	if err := writeFileAtomic(filename, jsonData); err != nil {
+		return 0, err
+	}
+	c.evicted = &evictedChunk{
+		file:  filename,
+		first: c.first(),
+		last:  c.last(),
+		count: len(c.records),
+	}
+	c.records = nil
+	s.bytes -= c.bytes
+	return c.bytes, nil
+}
+
+// restore brings the records of an evicted chunk back into memory
+func (s *series) restore(c *chunk) error {
+	records, err := c.load()
+	if err != nil {
+		return fmt.Errorf("error restoring evicted chunk: %w", err)
+	}
+	os.Remove(c.evicted.file)
+	c.records = records
+	c.evicted = nil
+	s.bytes += c.bytes
+	return nil
+}
+
+// chunkAfter returns the index of the first chunk whose last record has a
+// timestamp >= ts, or len(chunks) if there is none
+func (s *series) chunkAfter(ts int64) int {
+	return sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].last() >= ts
+	})
+}
+
+// chunkBefore returns the index of the last chunk whose first record has a
+// timestamp <= ts, or -1 if there is none
+func (s *series) chunkBefore(ts int64) int {
+	return sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].first() > ts
+	}) - 1
+}
+
+// publishLatest stores a copy of the last record for lock-free readers
+func (s *series) publishLatest() {
+	if s.count == 0 {
+		s.latest.Store(nil)
+		return
+	}
+	record := s.last()
+	s.latest.Store(&record)
+}
+
+// latestBefore returns a copy of the latest record with a timestamp <= maxTimestamp
+func (s *series) latestBefore(maxTimestamp int64) *Record {
+	i := s.chunkBefore(maxTimestamp)
+	if i == -1 {
+		return nil
+	}
+	records := s.chunks[i].view()
+	index := latestIndex(records, maxTimestamp)
+	if index == -1 {
+		return nil
+	}
+	record := records[index]
+	return &record
+}
+
+// earliestAfter returns a copy of the earliest record with a timestamp >= minTimestamp
+func (s *series) earliestAfter(minTimestamp int64) *Record {
+	i := s.chunkAfter(minTimestamp)
+	if i == len(s.chunks) {
+		return nil
+	}
+	records := s.chunks[i].view()
+	index := earliestIndex(records, minTimestamp)
+	if index == -1 {
+		return nil
+	}
+	record := records[index]
+	return &record
+}
+
+// rangeRecords returns a copy of the records with from <= timestamp <= to
+func (s *series) rangeRecords(from int64, to int64) []Record {
+	first := s.chunkAfter(from)
+	last := s.chunkBefore(to)
+	if first > last {
+		return []Record{}
+	}
+
+	// size the result up front, most chunks are copied whole
+	size := 0
+	for i := first; i <= last; i++ {
+		size += s.chunks[i].len()
+	}
+	result := make([]Record, 0, size)
+	for i := first; i <= last; i++ {
+		records := s.chunks[i].view()
+		if i == last {
+			records = records[:latestIndex(records, to)+1]
+		}
+		if i == first {
+			if start := earliestIndex(records, from); start != -1 {
+				records = records[start:]
+			} else {
+				records = nil
+			}
+		}
+		result = append(result, records...)
+	}
+	return result
+}
+
+// deleteRange removes the records with from <= timestamp <= to and returns
+// how many were removed
+func (s *series) deleteRange(from int64, to int64) (int, error) {
+	deleted := 0
+	start := s.chunkAfter(from)
+	end := start
+	for ; end < len(s.chunks) && s.chunks[end].first() <= to; end++ {
+		c := s.chunks[end]
+		if c.evicted != nil {
+			if err := s.restore(c); err != nil {
+				return deleted, err
+			}
+		}
+		startIndex := earliestIndex(c.records, from)
+		endIndex := latestIndex(c.records, to)
+		if startIndex == -1 || endIndex == -1 || startIndex > endIndex {
+			continue
+		}
+		deleted += endIndex - startIndex + 1
+		for _, record := range c.records[startIndex : endIndex+1] {
+			c.bytes -= recordSize(record)
+			s.bytes -= recordSize(record)
+		}
+		c.records = append(c.records[:startIndex], c.records[endIndex+1:]...)
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	// drop the chunks left empty
+	kept := s.chunks[:start]
+	for _, c := range s.chunks[start:end] {
+		if len(c.records) > 0 {
+			kept = append(kept, c)
+		}
+	}
+	kept = append(kept, s.chunks[end:]...)
+	clear(s.chunks[len(kept):])
+	s.chunks = kept
+	s.count -= deleted
+
+	// the last chunk must stay in memory
+	if n := len(s.chunks); n > 0 && s.chunks[n-1].evicted != nil {
+		if err := s.restore(s.chunks[n-1]); err != nil {
+			return deleted, err
+		}
+	}
+	s.publishLatest()
+	return deleted, nil
+}
+
+// at returns a copy of the last record with the timestamp
+func (s *series) at(ts int64) *Record {
+	i := s.chunkBefore(ts)
+	if i == -1 {
+		return nil
+	}
+	records := s.chunks[i].view()
+	index := latestIndex(records, ts)
+	if index == -1 || records[index].Timestamp != ts {
+		return nil
+	}
+	record := records[index]
+	return &record
+}
+
+// removeGen removes the record with the timestamp written at the generation
+// and returns whether it was found. Records of chunks restored from disk
+// have lost their generation and are never found.
+func (s *series) removeGen(ts int64, gen uint64) (bool, error) {
+	for i := s.chunkAfter(ts); i < len(s.chunks) && s.chunks[i].first() <= ts; i++ {
+		c := s.chunks[i]
+		if c.evicted != nil {
+			continue
+		}
+		for j := earliestIndex(c.records, ts); j != -1 && j < len(c.records) && c.records[j].Timestamp == ts; j++ {
+			if c.records[j].gen != gen {
+				continue
+			}
+			size := recordSize(c.records[j])
+			c.records = slices.Delete(c.records, j, j+1)
+			c.bytes -= size
+			s.bytes -= size
+			s.count--
+			if len(c.records) == 0 {
+				s.chunks = slices.Delete(s.chunks, i, i+1)
+			}
+			// the last chunk must stay in memory
+			if n := len(s.chunks); n > 0 && s.chunks[n-1].evicted != nil {
+				if err := s.restore(s.chunks[n-1]); err != nil {
+					return true, err
+				}
+			}
+			s.publishLatest()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writtenSince returns the records written after the given generation.
+// Evicted chunks are always flushed, so they are skipped.
+func (s *series) writtenSince(gen uint64) []Record {
+	var records []Record
+	for _, c := range s.chunks {
+		if c.maxGen <= gen || c.evicted != nil {
+			continue
+		}
+		for _, record := range c.records {
+			if record.gen > gen {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+func (s *series) len() int {
+	if entry := s.cold.Load(); entry != nil {
+		return entry.Records
+	}
+	return s.count
+}
+
+func (s *series) firstTimestamp() int64 {
+	if entry := s.cold.Load(); entry != nil {
+		return entry.First
+	}
+	return s.chunks[0].first()
+}
+
+func (s *series) lastTimestamp() int64 {
+	if entry := s.cold.Load(); entry != nil {
+		return entry.Last
+	}
+	return s.last().Timestamp
+}
+
+func (s *series) last() Record {
+	c := s.chunks[len(s.chunks)-1]
+	return c.records[len(c.records)-1]
+}
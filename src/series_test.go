@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSeriesInsertOrder(t *testing.T) {
+	s := &series{}
+	for _, ts := range []int64{5, 1, 3, 2, 4, 6} {
+		if added, _ := s.insert(Record{Timestamp: ts, Data: fmt.Sprintf("v%d", ts)}); !added {
+			t.Errorf("Expected record %d to be added", ts)
+		}
+	}
+	if added, _ := s.insert(Record{Timestamp: 3, Data: "replaced"}); added {
+		t.Errorf("Expected record with an existing timestamp to be replaced")
+	}
+
+	records := s.rangeRecords(0, 10)
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Timestamp != int64(i+1) {
+			t.Errorf("Expected timestamp %d at %d, got %d", i+1, i, record.Timestamp)
+		}
+	}
+	if records[2].Data != "replaced" {
+		t.Errorf("Expected replaced record, got %s", records[2].Data)
+	}
+}
+
+func TestSeriesLatest(t *testing.T) {
+	s := &series{}
+	s.insert(Record{Timestamp: 2, Data: "b"})
+	s.insert(Record{Timestamp: 1, Data: "a"})
+	if latest := s.latest.Load(); latest == nil || latest.Data != "b" {
+		t.Fatalf("Expected latest to be b, got %v", latest)
+	}
+
+	s.insert(Record{Timestamp: 2, Data: "b2"})
+	if latest := s.latest.Load(); latest.Data != "b2" {
+		t.Errorf("Expected latest to be replaced, got %s", latest.Data)
+	}
+
+	s.insert(Record{Timestamp: 3, Data: "c"})
+	s.deleteRange(3, 3)
+	if latest := s.latest.Load(); latest.Data != "b2" {
+		t.Errorf("Expected latest to be b2 after deleting c, got %s", latest.Data)
+	}
+
+	s.deleteRange(0, 10)
+	if latest := s.latest.Load(); latest != nil {
+		t.Errorf("Expected no latest record, got %v", latest)
+	}
+}
+
+func TestSeriesWrittenSince(t *testing.T) {
+	s := &series{}
+	s.insert(Record{Timestamp: 1, gen: 0})
+	s.insert(Record{Timestamp: 2, gen: 5})
+	s.insert(Record{Timestamp: 3, gen: 7})
+
+	if s.lastGen != 7 {
+		t.Errorf("Expected last generation 7, got %d", s.lastGen)
+	}
+	records := s.writtenSince(5)
+	if len(records) != 1 || records[0].Timestamp != 3 {
+		t.Errorf("Expected only record 3, got %v", records)
+	}
+}
+
+func TestSeriesChunks(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := &series{}
+	expected := make(map[int64]string)
+	for i := 0; i < 5000; i++ {
+		ts := rng.Int63n(4000)
+		data := fmt.Sprintf("v%d", i)
+		s.insert(Record{Timestamp: ts, Data: data})
+		expected[ts] = data
+	}
+
+	if s.len() != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), s.len())
+	}
+	if len(s.chunks) < 2 {
+		t.Fatalf("Expected records to be spread over several chunks, got %d", len(s.chunks))
+	}
+	for i, c := range s.chunks {
+		if len(c.records) == 0 || len(c.records) > chunkSize {
+			t.Errorf("Chunk %d has %d records", i, len(c.records))
+		}
+		if i > 0 && s.chunks[i-1].last() >= c.first() {
+			t.Errorf("Chunk %d overlaps the previous chunk", i)
+		}
+	}
+
+	records := s.rangeRecords(math.MinInt64, math.MaxInt64)
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records in range, got %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		if i > 0 && records[i-1].Timestamp >= record.Timestamp {
+			t.Fatalf("Records out of order at %d", i)
+		}
+		if expected[record.Timestamp] != record.Data {
+			t.Errorf("Expected %s at %d, got %s", expected[record.Timestamp], record.Timestamp, record.Data)
+		}
+	}
+
+	for _, ts := range []int64{-1, 0, 1000, 2500, 3999, 5000} {
+		latest := s.latestBefore(ts)
+		earliest := s.earliestAfter(ts)
+		var wantLatest, wantEarliest *Record
+		for i := range records {
+			if records[i].Timestamp <= ts {
+				wantLatest = &records[i]
+			}
+			if records[i].Timestamp >= ts && wantEarliest == nil {
+				wantEarliest = &records[i]
+			}
+		}
+		if (latest == nil) != (wantLatest == nil) || (latest != nil && latest.Timestamp != wantLatest.Timestamp) {
+			t.Errorf("latestBefore(%d) = %v, want %v", ts, latest, wantLatest)
+		}
+		if (earliest == nil) != (wantEarliest == nil) || (earliest != nil && earliest.Timestamp != wantEarliest.Timestamp) {
+			t.Errorf("earliestAfter(%d) = %v, want %v", ts, earliest, wantEarliest)
+		}
+	}
+
+	// delete a range spanning several chunks
+	want := 0
+	for ts := range expected {
+		if ts >= 500 && ts <= 3000 {
+			want++
+		}
+	}
+	if deleted, _ := s.deleteRange(500, 3000); deleted != want {
+		t.Errorf("Expected %d deleted records, got %d", want, deleted)
+	}
+	if got := s.rangeRecords(500, 3000); len(got) != 0 {
+		t.Errorf("Expected no records left in the deleted range, got %d", len(got))
+	}
+	if s.len() != len(expected)-want {
+		t.Errorf("Expected %d records, got %d", len(expected)-want, s.len())
+	}
+}
+
+func TestSeriesEvict(t *testing.T) {
+	dir := t.TempDir()
+	s := &series{}
+	for i := 0; i < 3*chunkSize; i++ {
+		s.insert(Record{Timestamp: int64(i), Data: fmt.Sprintf("v%d", i)})
+	}
+	if len(s.chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(s.chunks))
+	}
+
+	before := s.bytes
+	freed, err := s.evict(s.chunks[0], dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed == 0 || s.bytes != before-freed {
+		t.Errorf("Expected %d bytes to be freed, got %d", before-s.bytes, freed)
+	}
+	if freed, _ := s.evict(s.chunks[2], dir); freed != 0 {
+		t.Errorf("Expected the last chunk not to be evicted")
+	}
+	if s.len() != 3*chunkSize || s.firstTimestamp() != 0 {
+		t.Errorf("Expected the evicted chunk to be counted, got %d records from %d", s.len(), s.firstTimestamp())
+	}
+
+	// lookups page the chunk in without restoring it
+	if records := s.rangeRecords(10, 300); len(records) != 291 || records[0].Data != "v10" {
+		t.Errorf("Expected 291 records from v10, got %d", len(records))
+	}
+	if record := s.latestBefore(100); record == nil || record.Data != "v100" {
+		t.Errorf("Expected v100, got %v", record)
+	}
+	if record := s.earliestAfter(-5); record == nil || record.Data != "v0" {
+		t.Errorf("Expected v0, got %v", record)
+	}
+	if s.chunks[0].evicted == nil {
+		t.Errorf("Expected the chunk to stay evicted after lookups")
+	}
+
+	// writes restore it
+	if _, err := s.insert(Record{Timestamp: 5, Data: "replaced"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.chunks[0].evicted != nil || s.bytes != before+int64(len("replaced")-len("v5")) {
+		t.Errorf("Expected the chunk to be restored")
+	}
+	if records := s.rangeRecords(5, 5); len(records) != 1 || records[0].Data != "replaced" {
+		t.Errorf("Expected the replaced record, got %v", records)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expected the evicted file to be removed, got %d files", len(files))
+	}
+
+	// deletions restore evicted chunks too
+	s.evict(s.chunks[1], dir)
+	if deleted, err := s.deleteRange(0, 2*chunkSize-1); err != nil || deleted != 2*chunkSize {
+		t.Errorf("Expected %d deleted records, got %d (%v)", 2*chunkSize, deleted, err)
+	}
+	if s.len() != chunkSize || s.firstTimestamp() != 2*chunkSize {
+		t.Errorf("Expected %d records left, got %d", chunkSize, s.len())
+	}
+}
+
+func TestSeriesEvictSameBounds(t *testing.T) {
+	dir := t.TempDir()
+	s := &series{}
+	for i := 0; i < 3*chunkSize; i++ {
+		s.put(Record{Timestamp: 5, Data: fmt.Sprintf("v%d", i)}, true)
+	}
+	if len(s.chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(s.chunks))
+	}
+	// both chunks go from 5 to 5
+	s.evict(s.chunks[0], dir)
+	s.evict(s.chunks[1], dir)
+	records := s.rangeRecords(5, 5)
+	if len(records) != 3*chunkSize {
+		t.Fatalf("Expected %d records, got %d", 3*chunkSize, len(records))
+	}
+	for i, record := range records {
+		if record.Data != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Expected v%d, got %s", i, record.Data)
+		}
+	}
+}
+
+func benchmarkSeriesInsert(b *testing.B, timestamps func(n int) []int64) {
+	ts := timestamps(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	s := &series{}
+	for i := 0; i < b.N; i++ {
+		s.insert(Record{Timestamp: ts[i], Data: "{}"})
+	}
+}
+
+func BenchmarkSeriesInsert(b *testing.B) {
+	b.Run("in-order", func(b *testing.B) {
+		benchmarkSeriesInsert(b, func(n int) []int64 {
+			ts := make([]int64, n)
+			for i := range ts {
+				ts[i] = int64(i)
+			}
+			return ts
+		})
+	})
+	b.Run("slightly-late", func(b *testing.B) {
+		// every tenth record arrives up to 50 positions late
+		rng := rand.New(rand.NewSource(1))
+		benchmarkSeriesInsert(b, func(n int) []int64 {
+			ts := make([]int64, n)
+			for i := range ts {
+				ts[i] = int64(i)
+				if i%10 == 0 {
+					ts[i] -= int64(rng.Intn(50)) + 1
+				}
+			}
+			return ts
+		})
+	})
+	b.Run("random", func(b *testing.B) {
+		rng := rand.New(rand.NewSource(1))
+		benchmarkSeriesInsert(b, func(n int) []int64 {
+			ts := make([]int64, n)
+			for i := range ts {
+				ts[i] = rng.Int63n(int64(n) * 10)
+			}
+			return ts
+		})
+	})
+}
+
+func BenchmarkSeriesRange(b *testing.B) {
+	s := &series{}
+	for i := 0; i < 1000000; i++ {
+		s.insert(Record{Timestamp: int64(i), Data: "{}"})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := int64(i % 999000)
+		s.rangeRecords(from, from+100)
+		s.latestBefore(from)
+	}
+}
@@ -6,108 +6,118 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-type Collection struct {
-	Name string
-	TTL  int
-}
+// maximum number of uids returned by a single list-uids request
+const maxListUidsLimit = 1000
 
-// Two cases:
-// 1. collection:ttl
-// 2. collection.*:ttl
-// error if missing :ttl or more than one .*
-func NewCollection(name string) Collection {
-	parts := strings.Split(name, ":")
-	if len(parts) != 2 {
-		// panic
-		panic("invalid collection name: " + name)
-	}
-	// check if there is more than one .*
-	if strings.Count(parts[0], ".") > 1 {
-		// panic
-		panic("invalid collection name: " + name)
-	}
-	ttl, err := strconv.Atoi(parts[1])
-	if err != nil {
-		// panic
-		panic("invalid collection name: " + name)
-	}
-	if ttl < 0 {
-		// panic
-		panic("invalid collection name: " + name)
-	}
-	return Collection{
-		Name: parts[0],
-		TTL:  ttl,
+// parseOptionalFilter parses the filter of a query, an empty filter matches everything
+func parseOptionalFilter(source string) (*Filter, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
 	}
+	return ParseFilter(source)
 }
 
-func (c Collection) IsCollection(other string) bool {
-	parts1 := strings.Split(other, ".")
-	parts2 := strings.Split(c.Name, ".")
-	if len(parts1) != len(parts2) {
-		return false
-	}
-	return parts1[0] == parts2[0]
+// storageOptions configures how databases are loaded and kept in memory
+type storageOptions struct {
+	dir             string
+	budget          *memoryBudget // shared by all databases, nil when memory is not limited
+	lazy            bool          // only read the index and load the records in the background
+	loadConcurrency int           // number of uids read in parallel, 0 for the default
 }
 
-func setupDatabases(storageDir string, collections []Collection) map[string]*Database {
-	databases := make(map[string]*Database)
-
-	if storageDir == "" {
-		log.Println("Storage directory is not set, data will not be stored on disk")
-		return databases
+// openDatabase creates the database of a collection matched by a configured
+// pattern. It fails when the stored records can't be read or have another
+// time unit.
+func openDatabase(name string, collection Collection, opts storageOptions) (*Database, error) {
+	db := emptyDatabase(name, opts.dir, int64(collection.TTL), shardCount)
+	// loaded records depend on the type, conflict policy and unit of the collection
+	db.config.Store(&collection)
+	if opts.loadConcurrency > 0 {
+		db.loadConcurrency = opts.loadConcurrency
 	}
-
-	log.Println("Setting up databases")
-	// check if .data directory exists
-	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-		os.Mkdir(storageDir, 0755)
+	load := db.Load
+	if opts.lazy {
+		load = db.LoadIndex
 	}
-	collectionDirs, err := os.ReadDir(storageDir)
-	if err != nil {
-		log.Fatal(err)
+	if err := load(); err != nil {
+		db.Stop()
+		return nil, err
 	}
+	if err := db.checkUnit(collection.Unit); err != nil {
+		db.Stop()
+		return nil, err
+	}
+	if opts.budget != nil {
+		opts.budget.attach(db)
+	}
+	if opts.lazy {
+		go db.WarmUp()
+	}
+	db.configure(collection, opts)
+	return db, nil
+}
 
-	for _, collectionDir := range collectionDirs {
-		if !collectionDir.IsDir() {
-			continue
-		}
-
-		// check if the collection is in the collections array
-		found := false
-		for _, collection := range collections {
-			if collection.IsCollection(collectionDir.Name()) {
-				databases[collectionDir.Name()] = NewDatabase(collectionDir.Name(), storageDir, int64(collection.TTL))
-				found = true
-				break
-			}
+// selectDatabases returns the named databases sorted by name, or all of them
+// when no names are given
+func selectDatabases(databases map[string]*Database, names []string) ([]*Database, error) {
+	if len(names) == 0 {
+		for name := range databases {
+			names = append(names, name)
 		}
-		if !found {
-			continue
+	}
+	sort.Strings(names)
+	selected := make([]*Database, 0, len(names))
+	for _, name := range names {
+		db := databases[name]
+		if db == nil {
+			return nil, fmt.Errorf("collection %s not found", name)
 		}
+		selected = append(selected, db)
 	}
-	return databases
+	return selected, nil
 }
 
-func startServer(secretKey string, colls []string, storageDir string, storageInterval int) error {
+// serverOptions are the settings of the server besides its secret key and collections
+type serverOptions struct {
+	storageDir        string
+	storageInterval   int   // seconds between flushes, 0 to never flush
+	retentionInterval int   // seconds between deletions of expired records, 0 to never delete them
+	maxMemory         int64 // bytes, 0 for no limit
+	writeIdWindow     int   // seconds the results of inserts with a write id are kept, 0 to ignore write ids
+	maxWriteIds       int   // write ids kept at most
+	lazyLoad          bool
+	loadConcurrency   int
+	snapshotDir       string
+}
 
-	collections := make([]Collection, len(colls))
-	for i, coll := range colls {
-		collections[i] = NewCollection(coll)
+func startServer(secretKey string, collections []Collection, options serverOptions) error {
+
+	var budget *memoryBudget
+	if options.maxMemory > 0 {
+		budget = newMemoryBudget(options.maxMemory)
 	}
 
-	databases := setupDatabases(storageDir, collections)
-	for _, db := range databases {
+	opts := storageOptions{
+		dir:             options.storageDir,
+		budget:          budget,
+		lazy:            options.lazyLoad,
+		loadConcurrency: options.loadConcurrency,
+	}
+	reg, err := newRegistry(opts, collections)
+	if err != nil {
+		return err
+	}
+	for _, db := range reg.all() {
 		defer db.Stop()
 	}
+	ids := newWriteIds(time.Duration(options.writeIdWindow)*time.Second, options.maxWriteIds)
 
 	onWebSocketMessage := func(w http.ResponseWriter, r *http.Request, callback callback) {
 		log.Println("WebSocket connection received")
@@ -160,35 +170,11 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 	}
 
 	handleInsert := func(id string, message []byte) ([]byte, error) {
-		var messages []dataPayload
-		if err := json.Unmarshal(message, &messages); err != nil {
+		request, err := parseInsertRequest(message)
+		if err != nil {
 			return nil, err
 		}
-		for _, msg := range messages {
-			// all these are required!
-			if msg.Ts == nil || msg.Uid == nil || msg.Data == nil || msg.Collection == nil {
-				return nil, errors.New("invalid message")
-			}
-			// check if the collection is already in the databases
-			if db := databases[*msg.Collection]; db != nil {
-				db.Insert(*msg.Uid, *msg.Ts, *msg.Data)
-			} else {
-				found := false
-				// check if the collection is not in the databases, yet
-				for _, collection := range collections {
-					if collection.IsCollection(*msg.Collection) {
-						databases[*msg.Collection] = NewDatabase(*msg.Collection, storageDir, int64(collection.TTL))
-						databases[*msg.Collection].Insert(*msg.Uid, *msg.Ts, *msg.Data)
-						found = true
-						break
-					}
-				}
-				if !found {
-					return nil, fmt.Errorf("collection %s not found", *msg.Collection)
-				}
-			}
-		}
-		return json.Marshal(dataPayloadResponse{Id: id})
+		return json.Marshal(dataPayloadResponse{Id: id, Results: insertRecords(reg, ids, request)})
 	}
 
 	handleQuery := func(id string, message []byte) ([]byte, error) {
@@ -202,7 +188,14 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 		if queryMessage.Collection == nil {
 			return nil, errors.New("collection is required")
 		}
-		if db := databases[*queryMessage.Collection]; db != nil {
+		if err := validateTimeFormat(queryMessage.TimeFormat); err != nil {
+			return nil, err
+		}
+		filter, err := parseOptionalFilter(queryMessage.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if db := reg.get(*queryMessage.Collection); db != nil {
 			var response map[string]*Record
 			if queryMessage.Uid != "" {
 				response = map[string]*Record{
@@ -211,7 +204,8 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 			} else {
 				response = db.GetAllLatestRecords(*queryMessage.Ts)
 			}
-			return json.Marshal(queryResponse{Id: id, Records: response})
+			response = db.FilterLatestRecords(response, filter)
+			return json.Marshal(queryResponse{Id: id, Records: db.renderLatest(response, queryMessage.TimeFormat)})
 		}
 		return json.Marshal(queryResponse{Id: id, Records: map[string]*Record{}})
 	}
@@ -233,9 +227,28 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 		if queryUserMessage.Collection == nil {
 			return nil, errors.New("collection is required")
 		}
-		if db := databases[*queryUserMessage.Collection]; db != nil {
-			response := db.GetRecordsForUser(*queryUserMessage.Uid, *queryUserMessage.From, *queryUserMessage.To)
-			return json.Marshal(queryUserResponse{Id: id, Records: response})
+		filter, err := parseOptionalFilter(queryUserMessage.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if queryUserMessage.Resolution < 0 {
+			return nil, errors.New("resolution can't be negative")
+		}
+		if err := validateTimeFormat(queryUserMessage.TimeFormat); err != nil {
+			return nil, err
+		}
+		if db := reg.get(*queryUserMessage.Collection); db != nil {
+			response, resolution := db.GetRollupRecords(*queryUserMessage.Uid, *queryUserMessage.From, *queryUserMessage.To, queryUserMessage.Resolution)
+			response = db.FilterRecords(response, filter)
+			// summaries of rollups are JSON objects whatever the type
+			if resolution == 0 {
+				return json.Marshal(queryUserResponse{Id: id, Records: db.renderRecords(response, queryUserMessage.TimeFormat)})
+			}
+			var summaries any = response
+			if queryUserMessage.TimeFormat == timeFormatRFC3339 {
+				summaries = formatRecords(response, db.config.Load().Unit, false)
+			}
+			return json.Marshal(queryUserResponse{Id: id, Records: summaries, Resolution: resolution})
 		}
 		return json.Marshal(queryUserResponse{Id: id, Records: []Record{}})
 	}
@@ -249,18 +262,203 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 			return nil, errors.New("uid is required")
 		}
 		if queryMessage.Collection == "" {
-			for _, db := range databases {
+			for _, db := range reg.all() {
 				db.Delete(*queryMessage.Uid)
 			}
 			return json.Marshal(dataPayloadResponse{Id: id})
 		}
-		if db := databases[queryMessage.Collection]; db != nil {
+		if db := reg.get(queryMessage.Collection); db != nil {
 			db.Delete(*queryMessage.Uid)
 			return json.Marshal(dataPayloadResponse{Id: id})
 		}
 		return json.Marshal(dataPayloadResponse{Id: id})
 	}
 
+	handleDeleteRecords := func(id string, message []byte) ([]byte, error) {
+		var queryMessage queryDeleteRecords
+		if err := json.Unmarshal(message, &queryMessage); err != nil {
+			return nil, err
+		}
+		if queryMessage.Uid == nil {
+			return nil, errors.New("uid is required")
+		}
+		if queryMessage.Collection == nil {
+			return nil, errors.New("collection is required")
+		}
+		var from, to int64
+		if queryMessage.Ts != nil {
+			from, to = *queryMessage.Ts, *queryMessage.Ts
+		} else {
+			if queryMessage.From == nil {
+				return nil, errors.New("from is required")
+			}
+			if queryMessage.To == nil {
+				return nil, errors.New("to is required")
+			}
+			from, to = *queryMessage.From, *queryMessage.To
+		}
+		if db := reg.get(*queryMessage.Collection); db != nil {
+			deleted, err := db.DeleteRecords(*queryMessage.Uid, from, to)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(deleteRecordsResponse{Id: id, Deleted: deleted})
+		}
+		return json.Marshal(deleteRecordsResponse{Id: id})
+	}
+
+	handleListCollections := func(id string) ([]byte, error) {
+		dbs := reg.all()
+		response := make([]collectionInfo, 0, len(dbs))
+		for _, db := range dbs {
+			stats := db.Stats()
+			config := db.config.Load()
+			info := collectionInfo{
+				Name:             db.name,
+				Pattern:          config.Name,
+				TTL:              int64(config.TTL),
+				MaxUids:          config.MaxUids,
+				MaxRecordsPerUid: config.MaxRecordsPerUid,
+				Rollups:          config.Rollups,
+				Type:             config.Type,
+				Schema:           config.Schema,
+				JSONSchema:       config.JSONSchema,
+				Conflict:         config.Conflict,
+				MaxPast:          config.MaxPast,
+				MaxFuture:        config.MaxFuture,
+				Skew:             config.Skew,
+				Unit:             config.Unit,
+				Uids:             stats.Uids,
+				Records:          stats.Records,
+				BytesOnDisk:      stats.BytesOnDisk,
+				MemoryBytes:      stats.MemoryBytes,
+				Status:           db.Status(),
+			}
+			if stats.Records > 0 {
+				info.Oldest = &stats.Oldest
+				info.Newest = &stats.Newest
+			}
+			response = append(response, info)
+		}
+		return json.Marshal(listCollectionsResponse{Id: id, Collections: response, Patterns: reg.patterns()})
+	}
+
+	handleMetrics := func(id string) ([]byte, error) {
+		dbs := reg.all()
+		response := make([]collectionMetricsInfo, 0, len(dbs))
+		for _, db := range dbs {
+			response = append(response, collectionMetricsInfo{
+				Name:     db.name,
+				Inserted: db.metrics.inserted.Load(),
+				Valid:    db.metrics.valid.Load(),
+				Invalid:  db.metrics.invalid.Load(),
+
+				Clamped:    db.metrics.clamped.Load(),
+				OutOfRange: db.metrics.outOfRange.Load(),
+			})
+		}
+		return json.Marshal(metricsResponse{Id: id, Collections: response})
+	}
+
+	handleCreateCollection := func(id string, message []byte) ([]byte, error) {
+		var createMessage collectionRequest
+		if err := json.Unmarshal(message, &createMessage); err != nil {
+			return nil, err
+		}
+		if createMessage.Pattern == nil {
+			return nil, errors.New("pattern is required")
+		}
+		if createMessage.TTL == nil {
+			return nil, errors.New("ttl is required")
+		}
+		collection := Collection{Name: *createMessage.Pattern}
+		createMessage.apply(&collection)
+		if err := reg.create(collection); err != nil {
+			return nil, err
+		}
+		return json.Marshal(collectionResponse{Id: id, Collection: collection})
+	}
+
+	handleUpdateCollection := func(id string, message []byte) ([]byte, error) {
+		var updateMessage collectionRequest
+		if err := json.Unmarshal(message, &updateMessage); err != nil {
+			return nil, err
+		}
+		if updateMessage.Pattern == nil {
+			return nil, errors.New("pattern is required")
+		}
+		collection, err := reg.update(*updateMessage.Pattern, updateMessage.apply)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(collectionResponse{Id: id, Collection: collection})
+	}
+
+	handleDropCollection := func(id string, message []byte) ([]byte, error) {
+		var dropMessage dropCollectionRequest
+		if err := json.Unmarshal(message, &dropMessage); err != nil {
+			return nil, err
+		}
+		if (dropMessage.Collection == "") == (dropMessage.Pattern == "") {
+			return nil, errors.New("either collection or pattern is required")
+		}
+		if dropMessage.Pattern != "" {
+			dropped, err := reg.dropPattern(dropMessage.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(dropCollectionResponse{Id: id, Dropped: dropped})
+		}
+		if err := reg.drop(dropMessage.Collection); err != nil {
+			return nil, err
+		}
+		return json.Marshal(dropCollectionResponse{Id: id, Dropped: []string{dropMessage.Collection}})
+	}
+
+	handleListUids := func(id string, message []byte) ([]byte, error) {
+		var listMessage listUids
+		if err := json.Unmarshal(message, &listMessage); err != nil {
+			return nil, err
+		}
+		if listMessage.Collection == nil {
+			return nil, errors.New("collection is required")
+		}
+		if listMessage.Limit <= 0 || listMessage.Limit > maxListUidsLimit {
+			listMessage.Limit = maxListUidsLimit
+		}
+		if db := reg.get(*listMessage.Collection); db != nil {
+			uids, next := db.ListUids(listMessage.Prefix, listMessage.After, listMessage.Limit)
+			return json.Marshal(listUidsResponse{Id: id, Uids: uids, Next: next})
+		}
+		return json.Marshal(listUidsResponse{Id: id, Uids: []UidStats{}})
+	}
+
+	handleStatus := func(id string) ([]byte, error) {
+		status := statusReady
+		for _, db := range reg.all() {
+			if db.Status() != statusReady {
+				status = db.Status()
+			}
+		}
+		return json.Marshal(statusResponse{Id: id, Status: status})
+	}
+
+	handleSnapshot := func(id string, message []byte) ([]byte, error) {
+		var snapshotMessage snapshotRequest
+		if err := json.Unmarshal(message, &snapshotMessage); err != nil {
+			return nil, err
+		}
+		dbs, err := reg.selectDatabases(snapshotMessage.Collections)
+		if err != nil {
+			return nil, err
+		}
+		file, checksum, info, err := createSnapshot(options.snapshotDir, dbs)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(snapshotResponse{Id: id, File: file, Checksum: checksum, Collections: info.Collections})
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			w.WriteHeader(http.StatusNotFound)
@@ -280,23 +478,47 @@ func startServer(secretKey string, colls []string, storageDir string, storageInt
 			if *message.MessageType == "delete-user" {
 				return handleDeleteUser(*message.Id, []byte(*message.Data))
 			}
+			if *message.MessageType == "delete-records" {
+				return handleDeleteRecords(*message.Id, []byte(*message.Data))
+			}
+			if *message.MessageType == "list-collections" {
+				return handleListCollections(*message.Id)
+			}
+			if *message.MessageType == "metrics" {
+				return handleMetrics(*message.Id)
+			}
+			if *message.MessageType == "list-uids" {
+				return handleListUids(*message.Id, []byte(*message.Data))
+			}
+			if *message.MessageType == "status" {
+				return handleStatus(*message.Id)
+			}
+			if *message.MessageType == "snapshot" {
+				return handleSnapshot(*message.Id, []byte(*message.Data))
+			}
+			if *message.MessageType == "create-collection" {
+				return handleCreateCollection(*message.Id, []byte(*message.Data))
+			}
+			if *message.MessageType == "update-collection" {
+				return handleUpdateCollection(*message.Id, []byte(*message.Data))
+			}
+			if *message.MessageType == "drop-collection" {
+				return handleDropCollection(*message.Id, []byte(*message.Data))
+			}
 			return nil, errors.New("invalid message type")
 		})
 	})
 
-	if storageInterval > 0 {
-		// timer to flush to disk every one minute
-		go func() {
-			for {
-				log.Println("Flushing data to disk")
-				for _, db := range databases {
-					db.DeleteOld()
-					db.Flush()
-				}
-
-				<-time.After(time.Duration(storageInterval) * time.Second)
-			}
-		}()
+	// retention runs whether or not the collections are stored on disk
+	if options.retentionInterval > 0 {
+		go runEvery(time.Duration(options.retentionInterval)*time.Second, nil, func() {
+			expireRecords(reg.all())
+		})
+	}
+	if options.storageDir != "" && options.storageInterval > 0 {
+		go runEvery(time.Duration(options.storageInterval)*time.Second, nil, func() {
+			flushDatabases(reg.all(), budget)
+		})
 	}
 	log.Println("Listening on port 1985")
 	return http.ListenAndServe("0.0.0.0:1985", nil)
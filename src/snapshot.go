@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// version of the snapshot archive layout
+const snapshotVersion = 1
+
+// name of the archive entry describing the snapshot, written last
+const snapshotInfoFile = "snapshot.json"
+
+// snapshotInfo describes the content of a snapshot archive. Every uid is an
+// entry named <collection>/<uid>.ndjson holding one record per line.
+type snapshotInfo struct {
+	Version     int                  `json:"version"`
+	CreatedAt   int64                `json:"createdAt"`
+	Collections []snapshotCollection `json:"collections"`
+	Checksums   map[string]string    `json:"checksums"` // entry name -> sha256
+}
+
+type snapshotCollection struct {
+	Name     string `json:"name"`
+	TTL      int64  `json:"ttl"`
+	Unit     string `json:"unit,omitempty"`     // time unit of the timestamps, seconds when not set
+	Conflict string `json:"conflict,omitempty"` // conflict policy the records were stored with
+	Uids     int    `json:"uids"`
+	Records  int    `json:"records"`
+}
+
+// snapshot calls fn with a copy of the records of every uid, in lexical
+// order. The uids are copied one at a time under the read lock of their
+// shard, so writes only wait for the copy of one uid and only its records are
+// held in memory. Evicted chunks and uids that aren't loaded are read from
+// disk, holding flushMu keeps their files from changing meanwhile. Every uid
+// is consistent, uids written during the snapshot may be copied before or
+// after the writes.
+func (db *Database) snapshot(fn func(uid string, records []Record) error) error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	uids, _ := db.sortedUids.page("", "", 0)
+	for _, uid := range uids {
+		records, err := db.snapshotUid(uid)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if err := fn(uid, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotUid returns a copy of the records of a uid, the caller must hold
+// flushMu
+func (db *Database) snapshotUid(uid string) ([]Record, error) {
+	sh := db.shardFor(uid)
+	sh.mu.RLock()
+	s := sh.get(uid)
+	if s == nil {
+		sh.mu.RUnlock()
+		return nil, nil
+	}
+	if s.cold.Load() == nil {
+		records := make([]Record, 0, s.len())
+		for _, c := range s.chunks {
+			records = append(records, c.view()...)
+		}
+		sh.mu.RUnlock()
+		return records, nil
+	}
+	sh.mu.RUnlock()
+
+	s, err := readSeries(path.Join(db.storageDir, db.name, uid), nil, nil, db.config.Load().Conflict)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading user %s: %w", uid, err)
+	}
+	if s.len() == 0 {
+		return nil, nil
+	}
+	return s.rangeRecords(s.firstTimestamp(), s.lastTimestamp()), nil
+}
+
+// writeSnapshot writes a gzipped tar archive of the databases to w
+func writeSnapshot(w io.Writer, dbs []*Database) (*snapshotInfo, error) {
+	info := &snapshotInfo{
+		Version:     snapshotVersion,
+		CreatedAt:   time.Now().Unix(),
+		Collections: []snapshotCollection{},
+		Checksums:   make(map[string]string),
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, db := range dbs {
+		config := db.config.Load()
+		collection := snapshotCollection{Name: db.name, TTL: int64(config.TTL), Unit: unitName(config.Unit), Conflict: config.Conflict}
+		err := db.snapshot(func(uid string, records []Record) error {
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			for _, record := range records {
+				if err := encoder.Encode(record); err != nil {
+					return err
+				}
+			}
+			name := db.name + "/" + uid + ".ndjson"
+			if err := writeTarEntry(tw, name, buf.Bytes()); err != nil {
+				return err
+			}
+			sum := sha256.Sum256(buf.Bytes())
+			info.Checksums[name] = hex.EncodeToString(sum[:])
+			collection.Uids++
+			collection.Records += len(records)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing snapshot of %s: %w", db.name, err)
+		}
+		info.Collections = append(info.Collections, collection)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(tw, snapshotInfoFile, data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// createSnapshot writes a snapshot of the databases to a new archive in dir
+// and its sha256 to a .sha256 file next to it. It returns the archive path
+// and checksum.
+func createSnapshot(dir string, dbs []*Database) (string, string, *snapshotInfo, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	filename := path.Join(dir, fmt.Sprintf("snapshot-%s.tar.gz", time.Now().UTC().Format("20060102T150405.000000000Z")))
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error creating file %s: %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	hash := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(file, hash))
+	info, err := writeSnapshot(buffered, dbs)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return "", "", nil, fmt.Errorf("error renaming file %s: %w", tmp, err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	sidecar := fmt.Sprintf("%s  %s\n", checksum, path.Base(filename))
+	if err := os.WriteFile(filename+".sha256", []byte(sidecar), 0644); err != nil {
+		return "", "", nil, fmt.Errorf("error writing checksum of %s: %w", filename, err)
+	}
+	log.Println("Wrote snapshot", filename)
+	return filename, checksum, info, nil
+}
+
+// readSnapshot calls fn with the records of every uid in the archive. Entries
+// are read in the order they were written, the info is returned at the end.
+func readSnapshot(filename string, fn func(collection string, uid string, records []Record) error) (*snapshotInfo, error) {
+	return readSnapshotEntries(filename, func(name string, data []byte) error {
+		collection, uid, ok := strings.Cut(strings.TrimSuffix(name, ".ndjson"), "/")
+		if !ok {
+			return fmt.Errorf("unexpected entry %s in archive", name)
+		}
+		records, err := decodeRecords(data)
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %w", name, err)
+		}
+		return fn(collection, uid, records)
+	})
+}
+
+// readSnapshotEntries calls fn with the name and content of every uid entry
+func readSnapshotEntries(filename string, fn func(name string, data []byte) error) (*snapshotInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %s: %w", filename, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var info *snapshotInfo
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive %s: %w", filename, err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from archive: %w", header.Name, err)
+		}
+		if header.Name == snapshotInfoFile {
+			info = &snapshotInfo{}
+			if err := json.Unmarshal(data, info); err != nil {
+				return nil, fmt.Errorf("error unmarshaling %s: %w", snapshotInfoFile, err)
+			}
+			continue
+		}
+		if err := fn(header.Name, data); err != nil {
+			return nil, err
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("archive %s has no %s", filename, snapshotInfoFile)
+	}
+	if info.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", info.Version)
+	}
+	return info, nil
+}
+
+func decodeRecords(data []byte) ([]Record, error) {
+	var records []Record
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// verifySnapshot checks the archive against the .sha256 file next to it, when
+// there is one, and every entry against the checksums of the snapshot info
+func verifySnapshot(filename string) (*snapshotInfo, error) {
+	if sidecar, err := os.ReadFile(filename + ".sha256"); err == nil {
+		expected, _, _ := strings.Cut(string(sidecar), " ")
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != strings.TrimSpace(expected) {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filename, expected, actual)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	checksums := make(map[string]string)
+	info, err := readSnapshotEntries(filename, func(name string, data []byte) error {
+		sum := sha256.Sum256(data)
+		checksums[name] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(checksums) != len(info.Checksums) {
+		return nil, fmt.Errorf("archive has %d entries, expected %d", len(checksums), len(info.Checksums))
+	}
+	for name, expected := range info.Checksums {
+		if checksums[name] != expected {
+			return nil, fmt.Errorf("checksum mismatch for entry %s", name)
+		}
+	}
+	return info, nil
+}
+
+// restoredDatabase returns an empty database to restore a collection of an
+// archive into, with the unit and conflict policy its records were stored with
+func restoredDatabase(name string, storageDir string, collection snapshotCollection) *Database {
+	db := emptyDatabase(name, storageDir, 0, shardCount)
+	db.config.Store(&Collection{Name: name, Unit: collection.Unit, Conflict: collection.Conflict})
+	db.manifest.Unit = unitName(collection.Unit)
+	return db
+}
+
+// restoreOptions select and rename what restoreSnapshot writes
+type restoreOptions struct {
+	collections map[string]bool   // the collections to restore, all when empty
+	rename      map[string]string // archive name -> restored name
+	from        int64
+	to          int64
+}
+
+// restoreSnapshot verifies the archive and writes its collections to an
+// empty storage directory in the format Load reads
+func restoreSnapshot(filename string, storageDir string, opts restoreOptions) (*snapshotInfo, error) {
+	if files, err := os.ReadDir(storageDir); err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("storage directory %s is not empty", storageDir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	verified, err := verifySnapshot(filename)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]snapshotCollection)
+	for _, collection := range verified.Collections {
+		stored[collection.Name] = collection
+	}
+
+	// collections are written one at a time, entries of a collection are contiguous
+	var db *Database
+	flush := func() error {
+		if db == nil {
+			return nil
+		}
+		defer db.Stop()
+		return db.Flush()
+	}
+	info, err := readSnapshot(filename, func(collection string, uid string, records []Record) error {
+		if len(opts.collections) > 0 && !opts.collections[collection] {
+			return nil
+		}
+		name := collection
+		if renamed, ok := opts.rename[collection]; ok {
+			name = renamed
+		}
+		if db == nil || db.name != name {
+			if err := flush(); err != nil {
+				return err
+			}
+			db = restoredDatabase(name, storageDir, stored[collection])
+		}
+		for _, record := range records {
+			if record.Timestamp < opts.from || record.Timestamp > opts.to {
+				continue
+			}
+			if err := db.Insert(uid, record.Timestamp, record.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	storage := t.TempDir()
+	flushTestDatabase(t, storage)
+	// uids that aren't loaded are read from disk
+	lazy := NewLazyDatabase("test", storage, 1)
+	defer lazy.Stop()
+	lazy.Insert("3", 100, "memory only")
+
+	other := NewDatabase("other", "", 2)
+	defer other.Stop()
+	createRecords(other, "a", 5)
+
+	file, checksum, info, err := createSnapshot(t.TempDir(), []*Database{lazy, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum == "" || len(info.Collections) != 2 {
+		t.Fatalf("Expected a checksum and 2 collections, got %s and %v", checksum, info.Collections)
+	}
+	if c := info.Collections[0]; c.Name != "test" || c.Uids != 3 || c.Records != 13 || c.TTL != 1 {
+		t.Errorf("Expected 3 uids and 13 records in test, got %+v", c)
+	}
+	if lazy.Status() != statusLoading {
+		t.Errorf("Expected the snapshot not to load the uids")
+	}
+
+	restored := t.TempDir()
+	_, err = restoreSnapshot(file, restored, restoreOptions{
+		rename: map[string]string{"test": "renamed"},
+		from:   3,
+		to:     100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDatabase("renamed", restored, 1)
+	defer db.Stop()
+	if stats := db.Stats(); stats.Uids != 3 || stats.Records != 8+2+1 || stats.Oldest != 3 {
+		t.Errorf("Expected the records from 3 on, got %+v", stats)
+	}
+	if record := db.GetLatestRecordForUser("3", math.MaxInt64); record == nil || record.Data != "memory only" {
+		t.Errorf("Expected the record inserted after loading, got %v", record)
+	}
+	restoredOther := NewDatabase("other", restored, 1)
+	defer restoredOther.Stop()
+	if records := restoredOther.Stats().Records; records != 3 {
+		t.Errorf("Expected 3 records in other, got %d", records)
+	}
+
+	// only the selected collections
+	selected := t.TempDir()
+	if _, err := restoreSnapshot(file, selected, restoreOptions{collections: map[string]bool{"other": true}, from: math.MinInt64, to: math.MaxInt64}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(selected, "test")); !os.IsNotExist(err) {
+		t.Errorf("Expected test not to be restored, got %v", err)
+	}
+
+	// the storage directory must be empty
+	if _, err := restoreSnapshot(file, restored, restoreOptions{}); err == nil {
+		t.Errorf("Expected an error restoring into a storage directory with data")
+	}
+}
+
+func TestSnapshotRestoreUnitAndConflict(t *testing.T) {
+	config := Collection{Name: "events", TTL: 1, Unit: unitMillis, Conflict: conflictAll}
+	db, err := openDatabase("events", config, storageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Stop()
+	for _, data := range []string{"a", "b", "c"} {
+		if err := db.Insert("1", 1700000000123, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, _, info, err := createSnapshot(t.TempDir(), []*Database{db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := info.Collections[0]; c.Unit != unitMillis || c.Conflict != conflictAll {
+		t.Errorf("Expected the unit and conflict policy in the archive, got %+v", c)
+	}
+
+	restored := t.TempDir()
+	if _, err := restoreSnapshot(file, restored, restoreOptions{from: math.MinInt64, to: math.MaxInt64}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := openDatabase("events", config, storageOptions{dir: restored})
+	if err != nil {
+		t.Fatalf("Expected the restored collection to open with milliseconds, got %v", err)
+	}
+	defer loaded.Stop()
+	if records := loaded.GetRecordsForUser("1", 1700000000123, 1700000000123); len(records) != 3 {
+		t.Errorf("Expected the 3 records with the same timestamp, got %+v", records)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	db := NewDatabase("test", "", 1)
+	defer db.Stop()
+	createRecords(db, "1", 100)
+	file, _, _, err := createSnapshot(t.TempDir(), []*Database{db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySnapshot(file); err != nil {
+		t.Fatalf("Expected the snapshot to verify, got %v", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySnapshot(file); err == nil {
+		t.Errorf("Expected a checksum error for a corrupted archive")
+	}
+	if _, err := restoreSnapshot(file, t.TempDir(), restoreOptions{}); err == nil {
+		t.Errorf("Expected restore to refuse a corrupted archive")
+	}
+}
+
+func TestSnapshotEvictedChunks(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+	budget := newMemoryBudget(1 << 30)
+	budget.attach(db)
+	createRecords(db, "1", 4*chunkSize)
+	createRecords(db, "2", 10)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	budget.limit = budget.used.Load() / 2
+	budget.reclaim()
+	if db.shardFor("1").get("1").chunks[0].evicted == nil {
+		t.Fatal("Expected the first chunk to be evicted")
+	}
+
+	var uids []string
+	_, _, info, err := createSnapshot(t.TempDir(), []*Database{db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.snapshot(func(uid string, records []Record) error {
+		uids = append(uids, uid)
+		return nil
+	})
+	if info.Collections[0].Records != 4*chunkSize+10 {
+		t.Errorf("Expected the evicted records in the snapshot, got %d records", info.Collections[0].Records)
+	}
+	if fmt.Sprint(uids) != "[1 2]" {
+		t.Errorf("Expected the uids in order, got %v", uids)
+	}
+}
+
+func TestSnapshotDuringWrites(t *testing.T) {
+	db := NewDatabase("test", t.TempDir(), 1)
+	defer db.Stop()
+	createRecords(db, "1", 1000)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				// timestamps are reused so the uids don't grow while they're archived
+				db.Insert(fmt.Sprintf("%d", i%10), int64(2000+i%1000), "{}")
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		_, _, info, err := createSnapshot(t.TempDir(), []*Database{db})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Collections[0].Records < 1000 {
+			t.Errorf("Expected at least 1000 records, got %d", info.Collections[0].Records)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what an insert gets when its timestamp is beyond the time limits of its
+// collection
+const (
+	skewReject = "reject" // the record is rejected, the default
+	skewClamp  = "clamp"  // the timestamp is moved to the limit
+)
+
+var ErrTimestampOutOfRange = errors.New("timestamp out of range")
+
+// insertTimestamp is the timestamp of an inserted record, a number or "now"
+// for the time of the server. An insert without one gets the time of the
+// server too.
+type insertTimestamp struct {
+	value int64
+	now   bool
+}
+
+func (t *insertTimestamp) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte(`"now"`)) {
+		*t = insertTimestamp{now: true}
+		return nil
+	}
+	var value int64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New(`ts must be an integer or "now"`)
+	}
+	*t = insertTimestamp{value: value}
+	return nil
+}
+
+func (t insertTimestamp) MarshalJSON() ([]byte, error) {
+	if t.now {
+		return []byte(`"now"`), nil
+	}
+	return strconv.AppendInt(nil, t.value, 10), nil
+}
+
+// parseTimeLimit parses a time limit flag of the form
+// pattern:past:future[:clamp|reject], like devices.*:7d:5m:clamp. A limit of
+// 0 doesn't limit that side.
+func parseTimeLimit(spec string) (string, int64, int64, string, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", 0, 0, "", fmt.Errorf("invalid time limit %q: expected pattern:past:future or pattern:past:future:policy", spec)
+	}
+	limits := make([]int64, 2)
+	for i, text := range parts[1:3] {
+		limit, err := parseInterval(text)
+		if err != nil || limit < 0 || limit%time.Second != 0 {
+			return "", 0, 0, "", fmt.Errorf("invalid time limit %q: %q must be a non-negative whole number of seconds, like 5m", spec, text)
+		}
+		limits[i] = int64(limit / time.Second)
+	}
+	skew := ""
+	if len(parts) == 4 {
+		skew = parts[3]
+		if err := validateSkew(skew); err != nil {
+			return "", 0, 0, "", fmt.Errorf("invalid time limit %q: %w", spec, err)
+		}
+	}
+	return parts[0], limits[0], limits[1], skew, nil
+}
+
+// parseTimeLimits sets the time limits of the collection patterns named by
+// the time limit flags
+func parseTimeLimits(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, past, future, skew, err := parseTimeLimit(spec)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid time limit %q: collection pattern %q is not configured", spec, pattern)
+		}
+		collections[i].MaxPast, collections[i].MaxFuture, collections[i].Skew = past, future, skew
+	}
+	return nil
+}
+
+func validateSkew(skew string) error {
+	switch skew {
+	case "", skewReject, skewClamp:
+		return nil
+	}
+	return fmt.Errorf("unknown skew policy %q, expected %s or %s", skew, skewReject, skewClamp)
+}
+
+// now returns the time of the server as a timestamp of the collection
+func (db *Database) now() int64 {
+	return unixTimestamp(time.Now(), db.config.Load().Unit)
+}
+
+// checkTimestamp applies the time limits of the collection to the timestamp
+// of an insert. It returns the timestamp to store and whether it was clamped.
+func (db *Database) checkTimestamp(ts int64) (int64, bool, error) {
+	config := db.config.Load()
+	if config.MaxPast == 0 && config.MaxFuture == 0 {
+		return ts, false, nil
+	}
+	now := db.now()
+	perSecond := unitsPerSecond(config.Unit)
+	maxPast, maxFuture := config.MaxPast*perSecond, config.MaxFuture*perSecond
+	var limit int64
+	var err error
+	switch {
+	case maxFuture > 0 && ts > now+maxFuture:
+		limit = now + maxFuture
+		err = fmt.Errorf("%w: %d is more than %ds in the future", ErrTimestampOutOfRange, ts, config.MaxFuture)
+	case maxPast > 0 && ts < now-maxPast:
+		limit = now - maxPast
+		err = fmt.Errorf("%w: %d is more than %ds in the past", ErrTimestampOutOfRange, ts, config.MaxPast)
+	default:
+		return ts, false, nil
+	}
+	if config.Skew == skewClamp {
+		db.metrics.clamped.Add(1)
+		return limit, true, nil
+	}
+	db.metrics.outOfRange.Add(1)
+	return 0, false, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseTimeLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		past    int64
+		future  int64
+		skew    string
+		wantErr bool
+	}{
+		{"devices.*:7d:5m", 7 * 24 * 3600, 300, "", false},
+		{"devices.*:0:30s:clamp", 0, 30, skewClamp, false},
+		{"devices.*:1h:0:reject", 3600, 0, skewReject, false},
+		{"devices.*:7d", 0, 0, "", true},
+		{"devices.*:7d:5m:drop", 0, 0, "", true},
+		{"devices.*:-1h:5m", 0, 0, "", true},
+		{"devices.*:7d:1500ms", 0, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			pattern, past, future, skew, err := parseTimeLimit(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (pattern != "devices.*" || past != tt.past || future != tt.future || skew != tt.skew) {
+				t.Errorf("Expected %d, %d and %q, got %s, %d, %d and %q", tt.past, tt.future, tt.skew, pattern, past, future, skew)
+			}
+		})
+	}
+}
+
+func TestInsertTimestampJSON(t *testing.T) {
+	var records []dataPayload
+	if err := json.Unmarshal([]byte(`[{"ts":5},{"ts":"now"},{}]`), &records); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Ts.value != 5 || records[0].Ts.now || !records[1].Ts.now || records[2].Ts != nil {
+		t.Errorf("Expected 5, now and no timestamp, got %+v, %+v and %+v", records[0].Ts, records[1].Ts, records[2].Ts)
+	}
+	if err := json.Unmarshal([]byte(`[{"ts":"later"}]`), &records); err == nil {
+		t.Error(`Expected a timestamp other than "now" to be refused`)
+	}
+}
+
+func TestTimeLimits(t *testing.T) {
+	collections := []Collection{
+		{Name: "strict", TTL: 1, MaxPast: 3600, MaxFuture: 60},
+		{Name: "clamped", TTL: 1, MaxFuture: 60, Skew: skewClamp},
+	}
+	reg, err := newRegistry(storageOptions{}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, _ := reg.getOrOpen("strict")
+	clamped, _ := reg.getOrOpen("clamped")
+	now := strict.now()
+	results := insertBatch(reg, nil, insertPayloads(t, fmt.Sprintf(`[
+		{"ts":%d,"uid":"1","data":"a","collection":"strict"},
+		{"ts":%d,"uid":"1","data":"b","collection":"strict"},
+		{"ts":%d,"uid":"1","data":"c","collection":"strict"},
+		{"ts":%d,"uid":"1","data":"d","collection":"clamped"},
+		{"ts":"now","uid":"2","data":"e","collection":"clamped"},
+		{"uid":"3","data":"f","collection":"clamped"}
+	]`, now, now+3600, now-7200, now+3600)))
+	if statuses := resultStatuses(results); statuses != "accepted,rejected,rejected,accepted,accepted,accepted" {
+		t.Fatalf("Expected the records beyond the limits of strict to be rejected, got %s", statuses)
+	}
+	if !strings.Contains(results[1].Error, "future") || !strings.Contains(results[2].Error, "past") {
+		t.Errorf("Expected the reasons of the rejections, got %+v", results)
+	}
+	if results[0].Ts != nil || results[0].Clamped {
+		t.Errorf("Expected the timestamp of the client to be kept, got %+v", results[0])
+	}
+	if !results[3].Clamped || results[3].Ts == nil || *results[3].Ts < now+60 || *results[3].Ts > now+61 {
+		t.Errorf("Expected the timestamp to be clamped to 60s in the future, got %+v", results[3])
+	}
+	for _, result := range results[4:] {
+		if result.Clamped || result.Ts == nil || *result.Ts < now || *result.Ts > now+1 {
+			t.Errorf("Expected the server to stamp the record, got %+v", result)
+		}
+	}
+	if latest := clamped.GetLatestRecordForUser("1", now+3600); latest == nil || latest.Timestamp != *results[3].Ts {
+		t.Errorf("Expected the record to be stored with the clamped timestamp, got %+v", latest)
+	}
+	if strict.metrics.outOfRange.Load() != 2 || clamped.metrics.clamped.Load() != 1 {
+		t.Errorf("Expected 2 records out of range and 1 clamped, got %d and %d", strict.metrics.outOfRange.Load(), clamped.metrics.clamped.Load())
+	}
+	if err := strict.Insert("1", now+3600, "g"); !errors.Is(err, ErrTimestampOutOfRange) {
+		t.Errorf("Expected the limits to apply to every insert, got %v", err)
+	}
+}
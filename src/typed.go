@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// types of typed collections, string is only allowed for schema fields
+const (
+	typeFloat64 = "float64"
+	typeInt64   = "int64"
+	typeBool    = "bool"
+	typeObject  = "object"
+	typeString  = "string"
+)
+
+// Records of scalar typed collections keep their value in Record.value and
+// one of these constants in Record.Data, so they don't allocate a payload.
+// Payloads of other records can't start with a NUL byte.
+const (
+	tagFloat64 = "\x00float64"
+	tagInt64   = "\x00int64"
+	tagBool    = "\x00bool"
+)
+
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// typedRecord is a record of a typed collection as returned by queries, with
+// its value as native JSON
+type typedRecord struct {
+	Timestamp int64           `json:"ts"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// parseType parses a type flag of the form pattern:type, where type is
+// float64, int64, bool or a schema of comma separated name=type fields
+func parseType(spec string) (string, string, map[string]string, error) {
+	pattern, typ, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", "", nil, fmt.Errorf("invalid type %q: expected pattern:type", spec)
+	}
+	var schema map[string]string
+	if strings.Contains(typ, "=") {
+		schema = make(map[string]string)
+		for _, field := range strings.Split(typ, ",") {
+			name, fieldType, _ := strings.Cut(field, "=")
+			if _, ok := schema[name]; ok {
+				return "", "", nil, fmt.Errorf("invalid type %q: field %q is declared twice", spec, name)
+			}
+			schema[name] = fieldType
+		}
+		typ = typeObject
+	}
+	if err := validateType(typ, schema); err != nil {
+		return "", "", nil, fmt.Errorf("invalid type %q: %w", spec, err)
+	}
+	return pattern, typ, schema, nil
+}
+
+// parseTypes sets the types of the collection patterns named by the type flags
+func parseTypes(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, typ, schema, err := parseType(spec)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid type %q: collection pattern %q is not configured", spec, pattern)
+		}
+		if collections[i].Type != "" {
+			return fmt.Errorf("invalid type %q: collection pattern %q already has a type", spec, pattern)
+		}
+		collections[i].Type, collections[i].Schema = typ, schema
+	}
+	return nil
+}
+
+func validateType(typ string, schema map[string]string) error {
+	switch typ {
+	case "", typeFloat64, typeInt64, typeBool:
+		if len(schema) > 0 {
+			return fmt.Errorf("a schema needs the %s type", typeObject)
+		}
+		return nil
+	case typeObject:
+		if len(schema) == 0 {
+			return errors.New("the object type needs a schema")
+		}
+		for name, fieldType := range schema {
+			if name == "" {
+				return errors.New("schema fields need a name")
+			}
+			switch fieldType {
+			case typeFloat64, typeInt64, typeBool, typeString:
+			default:
+				return fmt.Errorf("field %q has an unknown type %q", name, fieldType)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown type %q, expected %s, %s, %s or %s", typ, typeFloat64, typeInt64, typeBool, typeObject)
+}
+
+// decodeJSON decodes a single JSON value keeping numbers as json.Number
+func decodeJSON(data string) (any, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the value")
+	}
+	return value, nil
+}
+
+// encodeRecord validates a payload against the type of the collection and
+// returns the record storing it. Scalars are stored in the record itself,
+// objects as compact JSON with their fields sorted.
+func (c *Collection) encodeRecord(ts int64, data string) (Record, error) {
+	record := Record{Timestamp: ts, Data: data}
+	if c.Type == "" {
+		if strings.HasPrefix(data, "\x00") {
+			return Record{}, fmt.Errorf("%w: payloads can't start with a NUL byte", ErrInvalidPayload)
+		}
+		return record, nil
+	}
+	value, err := decodeJSON(data)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %s", ErrInvalidPayload, err)
+	}
+	if c.Type == typeObject {
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return Record{}, fmt.Errorf("%w: expected an object", ErrInvalidPayload)
+		}
+		for name := range fields {
+			if _, ok := c.Schema[name]; !ok {
+				return Record{}, fmt.Errorf("%w: field %q is not in the schema", ErrInvalidPayload, name)
+			}
+		}
+		for name, fieldType := range c.Schema {
+			field, ok := fields[name]
+			if !ok {
+				return Record{}, fmt.Errorf("%w: field %q is missing", ErrInvalidPayload, name)
+			}
+			if _, err := scalarBits(fieldType, field); err != nil {
+				return Record{}, fmt.Errorf("%w: field %q: %s", ErrInvalidPayload, name, err)
+			}
+		}
+		compact, err := json.Marshal(fields)
+		if err != nil {
+			return Record{}, err
+		}
+		record.Data = string(compact)
+		return record, nil
+	}
+	bits, err := scalarBits(c.Type, value)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %s", ErrInvalidPayload, err)
+	}
+	record.value = bits
+	switch c.Type {
+	case typeFloat64:
+		record.Data = tagFloat64
+	case typeInt64:
+		record.Data = tagInt64
+	case typeBool:
+		record.Data = tagBool
+	}
+	return record, nil
+}
+
+// scalarBits checks a decoded value has the type and returns its bits
+func scalarBits(typ string, value any) (uint64, error) {
+	switch typ {
+	case typeFloat64:
+		if number, ok := value.(json.Number); ok {
+			if f, err := number.Float64(); err == nil {
+				return math.Float64bits(f), nil
+			}
+		}
+	case typeInt64:
+		if number, ok := value.(json.Number); ok {
+			if i, err := strconv.ParseInt(number.String(), 10, 64); err == nil {
+				return uint64(i), nil
+			}
+		}
+	case typeBool:
+		if b, ok := value.(bool); ok {
+			if b {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case typeString:
+		if _, ok := value.(string); ok {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("expected %s, got %s", typ, jsonText(value))
+}
+
+func jsonText(value any) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// typed returns whether the record stores a scalar value instead of a payload
+func (r Record) typed() bool {
+	return len(r.Data) > 0 && r.Data[0] == 0
+}
+
+// payload returns the payload of the record, the JSON text of the value of
+// typed records
+func (r Record) payload() string {
+	switch r.Data {
+	case tagFloat64:
+		return strconv.FormatFloat(math.Float64frombits(r.value), 'g', -1, 64)
+	case tagInt64:
+		return strconv.FormatInt(int64(r.value), 10)
+	case tagBool:
+		return strconv.FormatBool(r.value == 1)
+	}
+	return r.Data
+}
+
+// MarshalJSON writes typed records with their value as text in data, files
+// and archives hold the same records whatever the type of the collection
+func (r Record) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	// payloads are written as they were inserted
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(struct {
+		Timestamp int64  `json:"ts"`
+		Data      string `json:"data"`
+	}{r.Timestamp, r.payload()})
+	// Encode ends the value with a newline
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), err
+}
+
+// storedRecord returns the record read from disk as it's kept in memory,
+// payloads of scalar typed collections are decoded into the record
+func (db *Database) storedRecord(record Record) Record {
+	config := db.config.Load()
+	if config.Type == "" || config.Type == typeObject || record.typed() {
+		return record
+	}
+	typed, err := config.encodeRecord(record.Timestamp, record.Data)
+	if err != nil {
+		return record
+	}
+	typed.gen = record.gen
+	return typed
+}
+
+// renderValue returns the payload of a record of a typed collection as JSON,
+// payloads stored before the collection had a type may not be
+func renderValue(record Record) json.RawMessage {
+	payload := record.payload()
+	if record.typed() || json.Valid([]byte(payload)) {
+		return json.RawMessage(payload)
+	}
+	quoted, _ := json.Marshal(payload)
+	return quoted
+}
+
+// renderRecords returns the records as a query response, with native values
+// for typed collections and RFC 3339 timestamps when the format asks for them
+func (db *Database) renderRecords(records []Record, format string) any {
+	config := db.config.Load()
+	if format == timeFormatRFC3339 {
+		return formatRecords(records, config.Unit, config.Type != "")
+	}
+	if config.Type == "" {
+		return records
+	}
+	rendered := make([]typedRecord, len(records))
+	for i, record := range records {
+		rendered[i] = typedRecord{Timestamp: record.Timestamp, Value: renderValue(record)}
+	}
+	return rendered
+}
+
+// renderLatest returns the latest records of uids as a query response, with
+// native values for typed collections and RFC 3339 timestamps when the format
+// asks for them
+func (db *Database) renderLatest(records map[string]*Record, format string) any {
+	config := db.config.Load()
+	if format == timeFormatRFC3339 {
+		formatted := make(map[string]*formattedRecord, len(records))
+		for uid, record := range records {
+			formatted[uid] = nil
+			if record != nil {
+				formatted[uid] = formatRecord(*record, config.Unit, config.Type != "")
+			}
+		}
+		return formatted
+	}
+	if config.Type == "" {
+		return records
+	}
+	rendered := make(map[string]*typedRecord, len(records))
+	for uid, record := range records {
+		if record == nil {
+			rendered[uid] = nil
+			continue
+		}
+		rendered[uid] = &typedRecord{Timestamp: record.Timestamp, Value: renderValue(*record)}
+	}
+	return rendered
+}
+
+// payloadText returns the payload of an insert, given either as a JSON string
+// or as any other JSON value
+func payloadText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", errors.New("data is required")
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "", err
+		}
+		return text, nil
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		spec    string
+		typ     string
+		schema  string
+		wantErr bool
+	}{
+		{"sensors.*:float64", typeFloat64, "map[]", false},
+		{"counters:int64", typeInt64, "map[]", false},
+		{"gps.*:lat=float64,lon=float64,moving=bool,name=string", typeObject, "map[lat:float64 lon:float64 moving:bool name:string]", false},
+		{"sensors", "", "", true},
+		{"sensors:float32", "", "", true},
+		{"gps:lat=float64,lat=int64", "", "", true},
+		{"gps:lat=decimal", "", "", true},
+		{"gps:=float64", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, typ, schema, err := parseType(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (typ != tt.typ || fmtSchema(schema) != tt.schema) {
+				t.Errorf("Expected %s %s, got %s %v", tt.typ, tt.schema, typ, schema)
+			}
+		})
+	}
+}
+
+func fmtSchema(schema map[string]string) string {
+	if schema == nil {
+		return "map[]"
+	}
+	data, _ := json.Marshal(schema)
+	replacer := strings.NewReplacer(`{`, `map[`, `}`, `]`, `"`, ``, `,`, ` `)
+	return replacer.Replace(string(data))
+}
+
+func TestEncodeRecord(t *testing.T) {
+	float := &Collection{Type: typeFloat64}
+	integer := &Collection{Type: typeInt64}
+	boolean := &Collection{Type: typeBool}
+	object := &Collection{Type: typeObject, Schema: map[string]string{"lat": typeFloat64, "n": typeInt64, "on": typeBool, "name": typeString}}
+	opaque := &Collection{}
+	tests := []struct {
+		name       string
+		collection *Collection
+		data       string
+		payload    string
+		wantErr    bool
+	}{
+		{"float", float, "21.5", "21.5", false},
+		{"float from an integer", float, "21", "21", false},
+		{"float with exponent", float, "1e21", "1e+21", false},
+		{"float as a string", float, `"21.5"`, "", true},
+		{"float with trailing data", float, "21.5 22", "", true},
+		{"int", integer, "-9007199254740993", "-9007199254740993", false},
+		{"int with a fraction", integer, "3.5", "", true},
+		{"bool", boolean, "true", "true", false},
+		{"bool from a number", boolean, "1", "", true},
+		{"object", object, `{ "on": false, "lat": 1.5, "name": "a", "n": 2 }`, `{"lat":1.5,"n":2,"name":"a","on":false}`, false},
+		{"object missing a field", object, `{"lat": 1.5, "n": 2, "name": "a"}`, "", true},
+		{"object with an extra field", object, `{"lat": 1.5, "n": 2, "name": "a", "on": true, "x": 1}`, "", true},
+		{"object with a wrong field type", object, `{"lat": "north", "n": 2, "name": "a", "on": true}`, "", true},
+		{"object from an array", object, `[1]`, "", true},
+		{"opaque", opaque, "anything", "anything", false},
+		{"opaque with a NUL byte", opaque, "\x00float64", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := tt.collection.encodeRecord(1, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidPayload) {
+					t.Errorf("Expected ErrInvalidPayload, got %v", err)
+				}
+				return
+			}
+			if payload := record.payload(); payload != tt.payload {
+				t.Errorf("Expected payload %s, got %s", tt.payload, payload)
+			}
+		})
+	}
+}
+
+func TestPayloadText(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{`"{\"a\":1}"`, `{"a":1}`, false},
+		{`21.5`, `21.5`, false},
+		{`{"a":1}`, `{"a":1}`, false},
+		{`null`, ``, true},
+		{``, ``, true},
+	}
+	for _, tt := range tests {
+		got, err := payloadText(json.RawMessage(tt.raw))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Expected %q (error %v) for %s, got %q (%v)", tt.want, tt.wantErr, tt.raw, got, err)
+		}
+	}
+}
+
+func TestTypedCollection(t *testing.T) {
+	dir := t.TempDir()
+	collection := Collection{Name: "sensors", TTL: 1, Type: typeFloat64}
+	db, err := openDatabase("sensors", collection, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if err := db.Insert("1", int64(i+1), "21.5"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Insert("1", 11, `"21.5"`); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("Expected a string to be refused, got %v", err)
+	}
+	if memory := db.Stats().MemoryBytes; memory != 10*recordOverhead {
+		t.Errorf("Expected no memory for payloads, got %d", memory)
+	}
+
+	records := db.GetRecordsForUser("1", 1, 2)
+	data, _ := json.Marshal(db.renderRecords(records, ""))
+	if string(data) != `[{"ts":1,"value":21.5},{"ts":2,"value":21.5}]` {
+		t.Errorf("Expected native values, got %s", data)
+	}
+	data, _ = json.Marshal(db.renderLatest(db.GetAllLatestRecords(100), ""))
+	if string(data) != `{"1":{"ts":10,"value":21.5}}` {
+		t.Errorf("Expected native values, got %s", data)
+	}
+
+	// files hold the value as text and are decoded again on load
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := os.ReadDir(path.Join(dir, "sensors", "1"))
+	file, _ := os.ReadFile(path.Join(dir, "sensors", "1", files[0].Name()))
+	if !strings.Contains(string(file), `{"ts":1,"data":"21.5"}`) {
+		t.Errorf("Expected the value as text, got %s", file)
+	}
+	loaded, err := openDatabase("sensors", collection, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory := loaded.Stats().MemoryBytes; memory != 10*recordOverhead {
+		t.Errorf("Expected loaded records to be typed, got %d bytes", memory)
+	}
+	if latest := loaded.GetLatestRecordForUser("1", 100); latest == nil || !latest.typed() || latest.payload() != "21.5" {
+		t.Errorf("Expected a typed record, got %+v", latest)
+	}
+}
+
+func TestTypedRollups(t *testing.T) {
+	reg, err := newRegistry(storageOptions{}, []Collection{{Name: "sensors", TTL: 1, Type: typeInt64, Rollups: []Rollup{{Resolution: 60, TTL: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("sensors")
+	db.Insert("1", 1, "2")
+	db.Insert("1", 2, "4")
+	records, _ := db.GetRollupRecords("1", 0, 60, 60)
+	if len(records) != 1 || records[0].Data != `{"value":{"min":2,"max":4,"sum":6,"count":2,"avg":3}}` {
+		t.Errorf("Expected a summary of the values, got %v", records)
+	}
+}
+
+func TestRecordMarshalJSON(t *testing.T) {
+	type plain struct {
+		Timestamp int64  `json:"ts"`
+		Data      string `json:"data"`
+	}
+	for _, data := range []string{"", `{"a":"b"}`, "line\nbreak\ttab\r", "quote \" backslash \\", "\x01\x1f", "<html> & é 😀", "bad \xff utf8", "\u2028"} {
+		// encoding/json decodes both to the same string
+		var expected, got plain
+		encoded, _ := json.Marshal(plain{1, data})
+		json.Unmarshal(encoded, &expected)
+		encoded, err := json.Marshal(Record{Timestamp: 1, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(encoded, &got); err != nil || got != expected {
+			t.Errorf("Expected %+v, got %+v from %s (%v)", expected, got, encoded, err)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/gorilla/websocket"
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
 
 // all requests have an id, secret key, message type and data
 type request struct {
@@ -11,14 +15,32 @@ type request struct {
 
 // data payload for insert requests
 type dataPayload struct {
-	Ts         *int64  `json:"ts"`
-	Uid        *string `json:"uid"`
-	Data       *string `json:"data"`
-	Collection *string `json:"collection"`
+	Ts         *insertTimestamp `json:"ts"` // the time of the server when omitted or "now"
+	Uid        *string          `json:"uid"`
+	Data       json.RawMessage  `json:"data"` // a string, or any JSON value
+	Collection *string          `json:"collection"`
+	WriteId    string           `json:"writeId,omitempty"` // a retry with the same write id gets the first result
 }
 
+// insert requests are a list of records, or an object with the records when
+// options are set
+type insertRequest struct {
+	Records []dataPayload `json:"records"`
+	Atomic  bool          `json:"atomic"`  // insert all the records or none
+	WriteId string        `json:"writeId"` // a retry with the same write id gets the first results
+}
+
+// insert responses have the result of every record, in the order of the request
 type dataPayloadResponse struct {
-	Id string `json:"id"`
+	Id      string         `json:"id"`
+	Results []insertResult `json:"results"`
+}
+
+type insertResult struct {
+	Status  string `json:"status"` // accepted, overwrote, merged, ignored or rejected
+	Error   string `json:"error,omitempty"`
+	Ts      *int64 `json:"ts,omitempty"`      // the timestamp stored when the server stamped or clamped it
+	Clamped bool   `json:"clamped,omitempty"` // the timestamp was beyond the time limits of the collection
 }
 
 // query requests have a timestamp and collection
@@ -26,12 +48,15 @@ type query struct {
 	Ts         *int64  `json:"ts"`
 	Collection *string `json:"collection"`
 	Uid        string  `json:"uid"`
+	Filter     string  `json:"filter"`
+	TimeFormat string  `json:"timeFormat"` // unix or rfc3339
 }
 
-// query responses have a list of records
+// query responses have the latest record of the uids, with a value instead
+// of data in typed collections
 type queryResponse struct {
-	Id      string             `json:"id"`
-	Records map[string]*Record `json:"records"`
+	Id      string `json:"id"`
+	Records any    `json:"records"`
 }
 
 type queryUser struct {
@@ -39,12 +64,17 @@ type queryUser struct {
 	From       *int64  `json:"from"`
 	To         *int64  `json:"to"`
 	Collection *string `json:"collection"`
+	Filter     string  `json:"filter"`
+	Resolution int64   `json:"resolution"` // seconds, selects a rollup tier when set
+	TimeFormat string  `json:"timeFormat"` // unix or rfc3339
 }
 
-// query user responses have a list of records
+// query user responses have a list of records, summaries of the rollup tier
+// of the resolution when it's not 0
 type queryUserResponse struct {
-	Id      string   `json:"id"`
-	Records []Record `json:"records"`
+	Id         string `json:"id"`
+	Records    any    `json:"records"`
+	Resolution int64  `json:"resolution,omitempty"`
 }
 
 type queryDeleteUser struct {
@@ -52,9 +82,178 @@ type queryDeleteUser struct {
 	Collection string  `json:"collection"`
 }
 
+// delete records requests remove a range, or a single record when ts is set
+type queryDeleteRecords struct {
+	Uid        *string `json:"uid"`
+	Collection *string `json:"collection"`
+	From       *int64  `json:"from"`
+	To         *int64  `json:"to"`
+	Ts         *int64  `json:"ts"`
+}
+
+type deleteRecordsResponse struct {
+	Id      string `json:"id"`
+	Deleted int    `json:"deleted"`
+}
+
+type listCollectionsResponse struct {
+	Id          string           `json:"id"`
+	Collections []collectionInfo `json:"collections"`
+	Patterns    []Collection     `json:"patterns"`
+}
+
+type collectionInfo struct {
+	Name             string            `json:"name"`
+	Pattern          string            `json:"pattern"`
+	TTL              int64             `json:"ttl"`
+	MaxUids          int               `json:"maxUids,omitempty"`
+	MaxRecordsPerUid int               `json:"maxRecordsPerUid,omitempty"`
+	Rollups          []Rollup          `json:"rollups,omitempty"`
+	Type             string            `json:"type,omitempty"`
+	Schema           map[string]string `json:"schema,omitempty"`
+	JSONSchema       json.RawMessage   `json:"jsonSchema,omitempty"`
+	Conflict         string            `json:"conflict,omitempty"`
+	MaxPast          int64             `json:"maxPast,omitempty"`
+	MaxFuture        int64             `json:"maxFuture,omitempty"`
+	Skew             string            `json:"skew,omitempty"`
+	Unit             string            `json:"unit,omitempty"`
+	Uids             int               `json:"uids"`
+	Records          int               `json:"records"`
+	Oldest           *int64            `json:"oldest"`
+	Newest           *int64            `json:"newest"`
+	BytesOnDisk      int64             `json:"bytesOnDisk"`
+	MemoryBytes      int64             `json:"memoryBytes"`
+	Status           string            `json:"status"`
+}
+
+// list uids requests are paginated with the last uid of the previous page
+type listUids struct {
+	Collection *string `json:"collection"`
+	Prefix     string  `json:"prefix"`
+	After      string  `json:"after"`
+	Limit      int     `json:"limit"`
+}
+
+type listUidsResponse struct {
+	Id   string     `json:"id"`
+	Uids []UidStats `json:"uids"`
+	Next string     `json:"next,omitempty"`
+}
+
+// status is ready once the records of every collection are loaded
+type statusResponse struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// snapshot requests select the collections to archive, all when empty
+type snapshotRequest struct {
+	Collections []string `json:"collections"`
+}
+
+type snapshotResponse struct {
+	Id          string               `json:"id"`
+	File        string               `json:"file"`
+	Checksum    string               `json:"checksum"`
+	Collections []snapshotCollection `json:"collections"`
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
 type callback func(message request) ([]byte, error)
+
+// create-collection and update-collection requests, updates only change the fields that are set
+type collectionRequest struct {
+	Pattern          *string            `json:"pattern"`
+	TTL              *int               `json:"ttl"`
+	MaxUids          *int               `json:"maxUids"`
+	MaxRecordsPerUid *int               `json:"maxRecordsPerUid"`
+	Rollups          *[]Rollup          `json:"rollups"`
+	Type             *string            `json:"type"`
+	Schema           *map[string]string `json:"schema"`
+	JSONSchema       json.RawMessage    `json:"jsonSchema"` // null removes the schema
+	Conflict         *string            `json:"conflict"`
+	MaxPast          *int64             `json:"maxPast"`
+	MaxFuture        *int64             `json:"maxFuture"`
+	Skew             *string            `json:"skew"`
+	Unit             *string            `json:"unit"`
+}
+
+func (r collectionRequest) apply(collection *Collection) {
+	if r.TTL != nil {
+		collection.TTL = *r.TTL
+	}
+	if r.MaxUids != nil {
+		collection.MaxUids = *r.MaxUids
+	}
+	if r.MaxRecordsPerUid != nil {
+		collection.MaxRecordsPerUid = *r.MaxRecordsPerUid
+	}
+	if r.Rollups != nil {
+		collection.Rollups = *r.Rollups
+	}
+	// a new type replaces the schema
+	if r.Type != nil {
+		collection.Type, collection.Schema = *r.Type, nil
+	}
+	if r.Schema != nil {
+		collection.Schema = *r.Schema
+	}
+	if len(r.JSONSchema) > 0 {
+		collection.JSONSchema = r.JSONSchema
+		if string(r.JSONSchema) == "null" {
+			collection.JSONSchema = nil
+		}
+	}
+	if r.Conflict != nil {
+		collection.Conflict = *r.Conflict
+	}
+	if r.MaxPast != nil {
+		collection.MaxPast = *r.MaxPast
+	}
+	if r.MaxFuture != nil {
+		collection.MaxFuture = *r.MaxFuture
+	}
+	if r.Skew != nil {
+		collection.Skew = *r.Skew
+	}
+	if r.Unit != nil {
+		collection.Unit = *r.Unit
+	}
+}
+
+type collectionResponse struct {
+	Id         string     `json:"id"`
+	Collection Collection `json:"collection"`
+}
+
+// drop-collection requests drop a single collection, or a pattern and the
+// collections no other pattern matches
+type dropCollectionRequest struct {
+	Collection string `json:"collection"`
+	Pattern    string `json:"pattern"`
+}
+
+type dropCollectionResponse struct {
+	Id      string   `json:"id"`
+	Dropped []string `json:"dropped"`
+}
+
+// metrics responses have the counters of every open collection
+type metricsResponse struct {
+	Id          string                  `json:"id"`
+	Collections []collectionMetricsInfo `json:"collections"`
+}
+
+type collectionMetricsInfo struct {
+	Name     string `json:"name"`
+	Inserted int64  `json:"inserted"`
+	Valid    int64  `json:"valid"`   // records that passed the validation of the type or schema
+	Invalid  int64  `json:"invalid"` // records refused by the validation
+
+	Clamped    int64 `json:"clamped"`    // timestamps moved to the time limits
+	OutOfRange int64 `json:"outOfRange"` // records refused for a timestamp beyond the time limits
+}
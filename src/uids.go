@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maximum number of uids in a block of a uid set, a full block is split in
+// two
+const uidBlockSize = 512
+
+// uidSet keeps the uids of a database in lexical order, so ListUids pages
+// through them without collecting and sorting every uid. The uids are kept
+// in blocks, adding or removing a uid only moves the uids of its block.
+type uidSet struct {
+	mu     sync.RWMutex
+	blocks [][]string // sorted, the last uid of a block is before the first of the next
+}
+
+// block returns the first block whose last uid is >= uid, len(blocks) if
+// there is none. The caller must hold mu.
+func (set *uidSet) block(uid string) int {
+	return sort.Search(len(set.blocks), func(i int) bool {
+		b := set.blocks[i]
+		return b[len(b)-1] >= uid
+	})
+}
+
+// add adds the uid if it's not in the set yet
+func (set *uidSet) add(uid string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if len(set.blocks) == 0 {
+		set.blocks = [][]string{{uid}}
+		return
+	}
+	// uids after the last one go to the last block
+	i := min(set.block(uid), len(set.blocks)-1)
+	b := set.blocks[i]
+	j, found := slices.BinarySearch(b, uid)
+	if found {
+		return
+	}
+	b = slices.Insert(b, j, uid)
+	if len(b) > uidBlockSize {
+		half := len(b) / 2
+		set.blocks = slices.Insert(set.blocks, i+1, slices.Clone(b[half:]))
+		b = b[:half]
+	}
+	set.blocks[i] = b
+}
+
+func (set *uidSet) remove(uid string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	i := set.block(uid)
+	if i == len(set.blocks) {
+		return
+	}
+	b := set.blocks[i]
+	j, found := slices.BinarySearch(b, uid)
+	if !found {
+		return
+	}
+	b = slices.Delete(b, j, j+1)
+	if len(b) == 0 {
+		set.blocks = slices.Delete(set.blocks, i, i+1)
+		return
+	}
+	set.blocks[i] = b
+}
+
+// page returns up to limit uids starting with prefix and coming after the
+// uid given in after, in lexical order, and whether there are more. A limit
+// of 0 returns them all.
+func (set *uidSet) page(prefix string, after string, limit int) ([]string, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	start := max(prefix, after)
+	var uids []string
+	for i := set.block(start); i < len(set.blocks); i++ {
+		b := set.blocks[i]
+		j, _ := slices.BinarySearch(b, start)
+		for _, uid := range b[j:] {
+			if uid == after {
+				continue
+			}
+			// the uids with the prefix are next to each other
+			if !strings.HasPrefix(uid, prefix) {
+				return uids, false
+			}
+			if limit > 0 && len(uids) == limit {
+				return uids, true
+			}
+			uids = append(uids, uid)
+		}
+		start = ""
+	}
+	return uids, false
+}
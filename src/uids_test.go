@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUidSet(t *testing.T) {
+	var set uidSet
+	present := make(map[string]bool)
+	// enough uids to split blocks, removed and added back in random order
+	for _, i := range rand.Perm(3000) {
+		uid := fmt.Sprintf("uid-%d", i)
+		set.add(uid)
+		present[uid] = true
+	}
+	for _, i := range rand.Perm(3000)[:1000] {
+		uid := fmt.Sprintf("uid-%d", i)
+		set.remove(uid)
+		delete(present, uid)
+	}
+	set.add("other")
+	set.remove("missing")
+
+	var want []string
+	for uid := range present {
+		if strings.HasPrefix(uid, "uid-1") {
+			want = append(want, uid)
+		}
+	}
+	slices.Sort(want)
+
+	var got []string
+	after := ""
+	for {
+		uids, more := set.page("uid-1", after, 100)
+		got = append(got, uids...)
+		if !more {
+			break
+		}
+		after = uids[len(uids)-1]
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %d uids in order, got %d", len(want), len(got))
+	}
+	if uids, more := set.page("", "", 0); len(uids) != len(present)+1 || more {
+		t.Errorf("Expected every uid without a limit, got %d", len(uids))
+	}
+}
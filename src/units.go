@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// time units of the timestamps of a collection
+const (
+	unitSeconds = "s" // the default
+	unitMillis  = "ms"
+	unitMicros  = "us"
+	unitNanos   = "ns"
+)
+
+// formats of the timestamps of query responses
+const (
+	timeFormatUnix    = "unix"    // integers in the unit of the collection, the default
+	timeFormatRFC3339 = "rfc3339" // RFC 3339 strings with the precision of the unit
+)
+
+func validateUnit(unit string) error {
+	switch unit {
+	case "", unitSeconds, unitMillis, unitMicros, unitNanos:
+		return nil
+	}
+	return fmt.Errorf("unknown time unit %q, expected %s, %s, %s or %s", unit, unitSeconds, unitMillis, unitMicros, unitNanos)
+}
+
+// unitName returns the unit, seconds when it's not set
+func unitName(unit string) string {
+	if unit == "" {
+		return unitSeconds
+	}
+	return unit
+}
+
+// unitDuration returns the duration of one timestamp of the unit
+func unitDuration(unit string) time.Duration {
+	switch unit {
+	case unitMillis:
+		return time.Millisecond
+	case unitMicros:
+		return time.Microsecond
+	case unitNanos:
+		return time.Nanosecond
+	}
+	return time.Second
+}
+
+// unitsPerSecond returns the number of timestamps of the unit in a second
+func unitsPerSecond(unit string) int64 {
+	return int64(time.Second / unitDuration(unit))
+}
+
+// unixTime returns the time of a timestamp in the unit
+func unixTime(ts int64, unit string) time.Time {
+	perSecond := unitsPerSecond(unit)
+	return time.Unix(ts/perSecond, ts%perSecond*int64(unitDuration(unit))).UTC()
+}
+
+// unixTimestamp returns the timestamp of a time in the unit
+func unixTimestamp(t time.Time, unit string) int64 {
+	switch unit {
+	case unitMillis:
+		return t.UnixMilli()
+	case unitMicros:
+		return t.UnixMicro()
+	case unitNanos:
+		return t.UnixNano()
+	}
+	return t.Unix()
+}
+
+// parseUnits sets the time units of the collection patterns named by the
+// unit flags, of the form pattern:unit
+func parseUnits(specs []string, collections []Collection) error {
+	for _, spec := range specs {
+		pattern, unit, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("invalid unit %q: expected pattern:unit", spec)
+		}
+		if err := validateUnit(unit); err != nil {
+			return fmt.Errorf("invalid unit %q: %w", spec, err)
+		}
+		i := 0
+		for i < len(collections) && collections[i].Name != pattern {
+			i++
+		}
+		if i == len(collections) {
+			return fmt.Errorf("invalid unit %q: collection pattern %q is not configured", spec, pattern)
+		}
+		collections[i].Unit = unit
+	}
+	return nil
+}
+
+func validateTimeFormat(format string) error {
+	switch format {
+	case "", timeFormatUnix, timeFormatRFC3339:
+		return nil
+	}
+	return fmt.Errorf("unknown time format %q, expected %s or %s", format, timeFormatUnix, timeFormatRFC3339)
+}
+
+// formatTimestamp returns a timestamp of the unit as an RFC 3339 string with
+// as many fractional digits as the unit has
+func formatTimestamp(ts int64, unit string) string {
+	layout := time.RFC3339
+	switch unit {
+	case unitMillis:
+		layout = "2006-01-02T15:04:05.000Z07:00"
+	case unitMicros:
+		layout = "2006-01-02T15:04:05.000000Z07:00"
+	case unitNanos:
+		layout = "2006-01-02T15:04:05.000000000Z07:00"
+	}
+	return unixTime(ts, unit).Format(layout)
+}
+
+// formattedRecord is a record of a query response with an RFC 3339 timestamp,
+// with a value instead of data in typed collections
+type formattedRecord struct {
+	Timestamp string          `json:"ts"`
+	Data      *string         `json:"data,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+// formatRecord returns a record with an RFC 3339 timestamp, typed returns its
+// value as native JSON
+func formatRecord(record Record, unit string, typed bool) *formattedRecord {
+	formatted := &formattedRecord{Timestamp: formatTimestamp(record.Timestamp, unit)}
+	if typed {
+		formatted.Value = renderValue(record)
+		return formatted
+	}
+	payload := record.payload()
+	formatted.Data = &payload
+	return formatted
+}
+
+// formatRecords returns the records with RFC 3339 timestamps
+func formatRecords(records []Record, unit string, typed bool) []*formattedRecord {
+	formatted := make([]*formattedRecord, len(records))
+	for i, record := range records {
+		formatted[i] = formatRecord(record, unit, typed)
+	}
+	return formatted
+}
+
+// checkUnit refuses to open stored records with another unit than the one
+// of the collection. Collections stored before units existed are in seconds.
+func (db *Database) checkUnit(unit string) error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	stored := unitName(db.manifest.Unit)
+	if stored != unitName(unit) && db.uidCount.Load() > 0 {
+		return fmt.Errorf("collection %s is stored with %s timestamps, it can't be opened with %s timestamps", db.name, stored, unitName(unit))
+	}
+	db.manifest.Unit = unitName(unit)
+	return nil
+}
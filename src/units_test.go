@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	tests := []struct {
+		ts   int64
+		unit string
+		want string
+	}{
+		{1700000000, "", "2023-11-14T22:13:20Z"},
+		{1700000000123, unitMillis, "2023-11-14T22:13:20.123Z"},
+		{1700000000123456, unitMicros, "2023-11-14T22:13:20.123456Z"},
+		{1700000000123456789, unitNanos, "2023-11-14T22:13:20.123456789Z"},
+		{-1500, unitMillis, "1969-12-31T23:59:58.500Z"},
+	}
+	for _, tt := range tests {
+		if got := formatTimestamp(tt.ts, tt.unit); got != tt.want {
+			t.Errorf("Expected %d %s to be %s, got %s", tt.ts, tt.unit, tt.want, got)
+		}
+	}
+}
+
+func TestParseUnits(t *testing.T) {
+	collections := []Collection{{Name: "sensors.*"}}
+	if err := parseUnits([]string{"sensors.*:ms"}, collections); err != nil {
+		t.Fatal(err)
+	}
+	if collections[0].Unit != unitMillis {
+		t.Errorf("Expected ms, got %q", collections[0].Unit)
+	}
+	for _, spec := range []string{"sensors.*", "sensors.*:min", "other:ns"} {
+		if err := parseUnits([]string{spec}, collections); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
+
+func TestMillisecondCollection(t *testing.T) {
+	collections := []Collection{{Name: "sensors", TTL: 1, Unit: unitMillis, MaxFuture: 1, Rollups: []Rollup{{Resolution: 1, TTL: 1}}}}
+	reg, err := newRegistry(storageOptions{}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("sensors")
+	now := time.Now().UnixMilli()
+	if stamped := db.now(); stamped < now || stamped > now+1000 {
+		t.Errorf("Expected the server to stamp milliseconds, got %d for %d", stamped, now)
+	}
+
+	// 100Hz samples within a second
+	for i := range 100 {
+		if err := db.Insert("1", now+int64(i*10), `{"value":1}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Insert("old", now-2*60*60*1000, "{}")
+	if err := db.Insert("1", now+5000, "{}"); err == nil {
+		t.Error("Expected the time limit to be 1s in milliseconds")
+	}
+
+	expireRecords(reg.all())
+	if uids := db.Stats().Uids; uids != 1 {
+		t.Errorf("Expected the records older than the ttl to expire, got %d uids", uids)
+	}
+	if records := db.GetRecordsForUser("1", now, now+990); len(records) != 100 {
+		t.Errorf("Expected 100 records, got %d", len(records))
+	}
+	summaries, resolution := db.GetRollupRecords("1", now, now+990, 1)
+	if resolution != 1 || len(summaries) != 1 && len(summaries) != 2 {
+		t.Fatalf("Expected the samples in buckets of 1s, got %d at %ds", len(summaries), resolution)
+	}
+	if bucket := summaries[0].Timestamp; bucket%1000 != 0 || bucket > now || bucket <= now-1000 {
+		t.Errorf("Expected the bucket to start on a second, got %d for %d", bucket, now)
+	}
+
+	data, _ := json.Marshal(db.renderRecords(db.GetRecordsForUser("1", now, now), timeFormatRFC3339))
+	want := `[{"ts":"` + formatTimestamp(now, unitMillis) + `","data":"{\"value\":1}"}]`
+	if string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
+
+func TestUnitChanges(t *testing.T) {
+	dir := t.TempDir()
+	reg, err := newRegistry(storageOptions{dir: dir}, []Collection{{Name: "sensors.*", TTL: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := reg.getOrOpen("sensors.a")
+	db.Insert("1", time.Now().Unix(), "{}")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	empty, _ := reg.getOrOpen("sensors.b")
+
+	// collections with records keep their unit
+	if _, err := reg.update("sensors.*", func(c *Collection) { c.Unit = unitMillis }); err == nil || !strings.Contains(err.Error(), "sensors.a") {
+		t.Errorf("Expected the unit change to be refused, got %v", err)
+	}
+	if err := reg.drop("sensors.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.update("sensors.*", func(c *Collection) { c.Unit = unitMillis }); err != nil {
+		t.Fatal(err)
+	}
+	if unit := empty.config.Load().Unit; unit != unitMillis {
+		t.Errorf("Expected the empty collection to use milliseconds, got %q", unit)
+	}
+	db.Stop()
+	empty.Stop()
+
+	// stored records are only opened with their unit
+	stored, err := openDatabase("sensors.c", Collection{Name: "sensors.*", TTL: 1}, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Insert("1", time.Now().Unix(), "{}")
+	if err := stored.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stored.Stop()
+	if _, err := openDatabase("sensors.c", Collection{Name: "sensors.*", TTL: 1, Unit: unitNanos}, storageOptions{dir: dir}); err == nil {
+		t.Error("Expected seconds to be refused as nanoseconds")
+	}
+	reopened, err := openDatabase("sensors.c", Collection{Name: "sensors.*", TTL: 1, Unit: unitSeconds}, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Stop()
+}
+
+func TestUnitOfStoredCollections(t *testing.T) {
+	dir := t.TempDir()
+	reg, err := newRegistry(storageOptions{dir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.create(Collection{Name: "metrics.*", TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// stored while the server runs, like a restored collection
+	stored, err := openDatabase("metrics.a", Collection{Name: "metrics.*", TTL: 1}, storageOptions{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Insert("1", time.Now().Unix(), "{}")
+	if err := stored.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stored.Stop()
+
+	// patterns opening the stored collection with another unit aren't saved
+	if err := reg.create(Collection{Name: "metrics.a", TTL: 1, Unit: unitMillis}); err == nil {
+		t.Error("Expected seconds to be refused as milliseconds by create")
+	}
+	if _, err := reg.update("metrics.*", func(c *Collection) { c.Unit = unitMillis }); err == nil {
+		t.Error("Expected seconds to be refused as milliseconds by update")
+	}
+	restarted, err := newRegistry(storageOptions{dir: dir}, nil)
+	if err != nil {
+		t.Fatalf("Expected the server to start again, got %v", err)
+	}
+	if db := restarted.get("metrics.a"); db == nil || db.Stats().Records != 1 {
+		t.Errorf("Expected the stored collection to be opened in seconds")
+	}
+
+	if _, err := reg.update("metrics.*", func(c *Collection) { c.TTL = 2 }); err != nil {
+		t.Fatal(err)
+	}
+	if reg.get("metrics.a") == nil {
+		t.Error("Expected the stored collection to be opened by the update")
+	}
+}
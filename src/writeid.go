@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// writeIds remembers the results of the inserts sent with a write id, so a
+// retry gets the result of the first attempt instead of inserting again.
+// Results are kept for the window, and only the most recent ones when there
+// are more than the limit. A nil *writeIds remembers nothing.
+type writeIds struct {
+	mu      sync.Mutex
+	window  time.Duration
+	limit   int
+	now     func() time.Time
+	entries map[string]*writeEntry
+	order   []*writeEntry // finished entries, oldest first
+}
+
+type writeEntry struct {
+	key     string
+	at      time.Time
+	done    chan struct{} // closed once the results are known
+	results []insertResult
+}
+
+func newWriteIds(window time.Duration, limit int) *writeIds {
+	if window <= 0 || limit <= 0 {
+		return nil
+	}
+	return &writeIds{
+		window:  window,
+		limit:   limit,
+		now:     time.Now,
+		entries: make(map[string]*writeEntry),
+	}
+}
+
+// begin reserves a write id. It returns the results remembered for it when
+// it was used before, waiting for an insert in progress with the same id.
+// Otherwise the caller must call finish once the insert is done.
+func (w *writeIds) begin(key string) ([]insertResult, bool) {
+	if w == nil {
+		return nil, false
+	}
+	for {
+		w.mu.Lock()
+		w.expire()
+		entry := w.entries[key]
+		if entry == nil {
+			w.entries[key] = &writeEntry{key: key, done: make(chan struct{})}
+			w.mu.Unlock()
+			return nil, false
+		}
+		w.mu.Unlock()
+		<-entry.done
+		// entries that are released are removed, so the reservation is retried
+		if entry.results != nil {
+			return entry.results, true
+		}
+	}
+}
+
+// finish remembers the results of a reserved write id, or releases it when
+// results is nil so the insert can be sent again
+func (w *writeIds) finish(key string, results []insertResult) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entry := w.entries[key]
+	if results == nil {
+		delete(w.entries, key)
+	} else {
+		entry.results = results
+		entry.at = w.now()
+		w.order = append(w.order, entry)
+	}
+	close(entry.done)
+	w.expire()
+}
+
+// expire forgets the results older than the window and the oldest ones over
+// the limit, the caller must hold mu
+func (w *writeIds) expire() {
+	cutoff := w.now().Add(-w.window)
+	n := 0
+	for n < len(w.order) && (w.order[n].at.Before(cutoff) || len(w.order)-n > w.limit) {
+		delete(w.entries, w.order[n].key)
+		n++
+	}
+	clear(w.order[:n])
+	w.order = w.order[n:]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteIds(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ids := newWriteIds(time.Minute, 2)
+	ids.now = func() time.Time { return now }
+	accepted := []insertResult{{Status: insertAccepted}}
+
+	if _, ok := ids.begin("a"); ok {
+		t.Fatal("Expected a new write id")
+	}
+	ids.finish("a", accepted)
+	if results, ok := ids.begin("a"); !ok || results[0].Status != insertAccepted {
+		t.Errorf("Expected the results of a, got %v %v", results, ok)
+	}
+
+	// released write ids can be used again
+	ids.begin("b")
+	ids.finish("b", nil)
+	if _, ok := ids.begin("b"); ok {
+		t.Error("Expected b to be released")
+	}
+	ids.finish("b", accepted)
+
+	// the oldest results are dropped over the limit
+	now = now.Add(time.Second)
+	ids.begin("c")
+	ids.finish("c", accepted)
+	if _, ok := ids.begin("a"); ok {
+		t.Error("Expected a to be dropped over the limit")
+	}
+	ids.finish("a", nil)
+
+	// and once the window has passed
+	now = now.Add(time.Minute)
+	if _, ok := ids.begin("c"); !ok {
+		t.Error("Expected c to be kept within the window")
+	}
+	now = now.Add(time.Second)
+	if _, ok := ids.begin("c"); ok {
+		t.Error("Expected c to expire after the window")
+	}
+	ids.finish("c", nil)
+	if len(ids.entries) != 0 || len(ids.order) != 0 {
+		t.Errorf("Expected nothing kept, got %d entries and %d in order", len(ids.entries), len(ids.order))
+	}
+
+	var disabled *writeIds
+	disabled.finish("a", accepted)
+	if _, ok := disabled.begin("a"); ok {
+		t.Error("Expected nothing remembered without a window")
+	}
+}
+
+func TestWriteIdsConcurrentRetries(t *testing.T) {
+	ids := newWriteIds(time.Minute, 100)
+	var applied atomic.Int64
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if results, ok := ids.begin("a"); ok {
+				if results[0].Status != insertAccepted {
+					t.Errorf("Expected the first result, got %v", results)
+				}
+				return
+			}
+			applied.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			ids.finish("a", []insertResult{{Status: insertAccepted}})
+		}()
+	}
+	wg.Wait()
+	if applied.Load() != 1 {
+		t.Errorf("Expected a single insert, got %d", applied.Load())
+	}
+}